@@ -238,10 +238,47 @@ func gcAssigned(inMsg *tgbotapi.Update) {
 		d.MarkersFormatted = append(d.MarkersFormatted, b.String())
 	}
 
+	sort.Slice(o.Tasks, func(i, j int) bool { return o.Tasks[i].Order < o.Tasks[j].Order })
+	for _, t := range o.Tasks {
+		if filterGid != "" && !t.IsAssignedTo(filterGid) {
+			continue
+		}
+		if t.State != "pending" && len(t.Assignments) > 0 {
+			a, _ := t.Assignments[0].IngressName()
+			tg, _ := t.Assignments[0].TelegramName()
+			if tg != "" {
+				a = fmt.Sprintf("@%s", tg)
+			}
+			stateIndicatorStart := ""
+			stateIndicatorEnd := ""
+			if t.State == "completed" {
+				stateIndicatorStart = "<strike>"
+				stateIndicatorEnd = "</strike>"
+			}
+			b.WriteString(fmt.Sprintf("%d / %s%s / %s / %s%s\n",
+				t.Order, stateIndicatorStart, genericTaskPlace(&o, &t, gid), a, t.State, stateIndicatorEnd))
+		}
+		d.MarkersFormatted = append(d.MarkersFormatted, b.String())
+	}
+
 	msg.Text, _ = templates.ExecuteLang("assignments", inMsg.Message.From.LanguageCode, d)
 	sendQueue <- msg
 }
 
+// genericTaskPlace formats a generic task's name, linked to its portal or location if it has one
+func genericTaskPlace(o *model.Operation, t *model.GenericTask, gid model.GoogleID) string {
+	lat, lon := t.Lat, t.Lon
+	if t.PortalID != "" {
+		if p, err := o.PortalDetails(t.PortalID, gid); err == nil {
+			lat, lon = p.Lat, p.Lon
+		}
+	}
+	if lat == "" || lon == "" {
+		return t.Name
+	}
+	return fmt.Sprintf("<a href=\"http://maps.google.com/?q=%s,%s\">%s</a>", lat, lon, t.Name)
+}
+
 func gcUnassigned(inMsg *tgbotapi.Update) {
 	msg := tgbotapi.NewMessage(inMsg.Message.Chat.ID, "")
 	msg.ParseMode = "HTML"
@@ -298,6 +335,14 @@ func gcUnassigned(inMsg *tgbotapi.Update) {
 		d.MarkersFormatted = append(d.MarkersFormatted, b.String())
 	}
 
+	sort.Slice(o.Tasks, func(i, j int) bool { return o.Tasks[i].Order < o.Tasks[j].Order })
+	for _, t := range o.Tasks {
+		if t.State == "pending" {
+			b.WriteString(fmt.Sprintf("<b>%d</b> / %s\n", t.Order, genericTaskPlace(&o, &t, gid)))
+		}
+		d.MarkersFormatted = append(d.MarkersFormatted, b.String())
+	}
+
 	msg.Text, _ = templates.ExecuteLang("assignments", inMsg.Message.From.LanguageCode, d)
 	sendQueue <- msg
 }
@@ -456,7 +501,7 @@ func gcAcknowledge(inMsg *tgbotapi.Update) {
 		return
 	}
 
-	if err := task.Acknowledge(); err != nil {
+	if err := task.Acknowledge(gid); err != nil {
 		log.Error(err)
 		msg.Text = err.Error()
 		sendQueue <- msg
@@ -2,6 +2,7 @@ package wtg
 
 import (
 	"fmt"
+	"html"
 	"strconv"
 	"strings"
 
@@ -111,6 +112,8 @@ func processMessage(inMsg *tgbotapi.Update, gid model.GoogleID) error {
 		if err := gid.SetLocation(lat, lon); err != nil {
 			log.Error(err)
 		}
+		msg.Text = nearbyOps(gid, inMsg.Message.Location.Latitude, inMsg.Message.Location.Longitude)
+		msg.ReplyMarkup = baseKbd
 	}
 
 	sendQueue <- msg
@@ -233,3 +236,22 @@ func whois(inMsg *tgbotapi.Update) error {
 
 	return nil
 } */
+
+// nearbyOps lists the agent's ops around a shared location
+func nearbyOps(gid model.GoogleID, lat, lon float64) string {
+	nearby, err := gid.NearbyOps(lat, lon, model.NearbyRadius)
+	if err != nil {
+		log.Error(err)
+		return err.Error()
+	}
+	if len(nearby) == 0 {
+		return fmt.Sprintf("No operations within %d km", model.NearbyRadius/1000)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Operations within %d km:\n", model.NearbyRadius/1000)
+	for _, op := range nearby {
+		fmt.Fprintf(&b, "<b>%s</b> %.1f km\n", html.EscapeString(op.Name), op.Distance/1000)
+	}
+	return b.String()
+}
@@ -15,6 +15,9 @@ func Start(ctx context.Context) {
 	log.Infow("startup", "message", "running initial background tasks")
 	model.LocationClean()
 
+	minutely := time.NewTicker(time.Minute)
+	defer minutely.Stop()
+
 	hourly := time.NewTicker(time.Hour)
 	defer hourly.Stop()
 
@@ -30,8 +33,15 @@ func Start(ctx context.Context) {
 		case <-ctx.Done():
 			log.Infow("shutdown", "message", "background tasks shutting down")
 			return
+		case <-minutely.C:
+			model.SendReminders(config.Get().ReminderMinutes)
 		case <-hourly.C:
 			model.LocationClean()
+			model.ChangeLogClean(config.Get().ChangeLogDays)
+			model.RevisionClean(config.Get().RevisionDays, config.Get().RevisionKeep)
+			model.PurgeTrash(config.Get().TrashDays)
+			model.ArchiveOps(config.Get().ArchiveDays)
+			model.ReminderClean()
 			wfb.ResetDefaultRateLimits()
 		case <-weekly.C:
 			wfb.Resubscribe()
@@ -42,9 +42,15 @@ type WasabeeConf struct {
 	RevisionsDir      string // where to keep them
 
 	// configuraiton for various subsystems
-	Rocks          wrocks
-	Telegram       wtg
-	StoreRevisions bool   // keep a copy of each upload
+	Rocks           wrocks
+	Telegram        wtg
+	StoreRevisions  bool  // keep a copy of each upload
+	ChangeLogDays   int   // how long to keep the per-op change feed
+	RevisionDays    int   // how long to keep op revisions, the newest revision of each op is always kept
+	RevisionKeep    int   // the most revisions kept per op
+	TrashDays       int   // how long deleted ops can be restored
+	ArchiveDays     int   // how long after its reference time an idle op is archived, 0 (the default) to never archive
+	ReminderMinutes []int // how long before a task's scheduled time to remind its assignees
 
 	// not configurable
 	fbRunning bool
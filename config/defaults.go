@@ -19,8 +19,14 @@ var defaults *WasabeeConf = &WasabeeConf{
 	JWKpriv:     "jwkpriv.json",
 	JWKpub:      "jwkpub.json",
 
-	StoreRevisions: false,
-	RevisionsDir:   "ops",
+	StoreRevisions:  false,
+	RevisionsDir:    "ops",
+	ChangeLogDays:   14,
+	RevisionDays:    30,
+	RevisionKeep:    100,
+	TrashDays:       30,
+	ArchiveDays:     0,
+	ReminderMinutes: []int{30, 5},
 
 	RISC: wrisc{
 		Cert:      "risc.json",
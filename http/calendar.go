@@ -0,0 +1,153 @@
+package wasabeehttps
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/wasabee-project/Wasabee-Server/config"
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/model"
+)
+
+// calendarFeeds tells the agent where to subscribe, the op feed is the URL with the op ID in place of {opID}
+type calendarFeeds struct {
+	Token model.CalendarToken `json:"token"`
+	URL   string              `json:"url"`
+	OpURL string              `json:"opurl"`
+}
+
+func newCalendarFeeds(ct model.CalendarToken) calendarFeeds {
+	base := fmt.Sprintf("%s/calendar/%s", config.Get().HTTP.Webroot, ct)
+	return calendarFeeds{
+		Token: ct,
+		URL:   base + ".ics",
+		OpURL: base + "/{opID}.ics",
+	}
+}
+
+func meCalendarTokenRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	ct, err := gid.CalendarToken()
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(newCalendarFeeds(ct)); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func meNewCalendarTokenRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	ct, err := gid.NewCalendarToken()
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(newCalendarFeeds(ct)); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func meRevokeCalendarTokenRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	if err := gid.RevokeCalendarToken(); err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(res, jsonStatusOK)
+}
+
+// calendarAgent resolves the token in the feed URL, locked agents get no feeds
+func calendarAgent(req *http.Request) (model.GoogleID, error) {
+	vars := mux.Vars(req)
+	gid, err := model.CalendarToken(vars["token"]).Gid()
+	if err != nil {
+		return "", err
+	}
+	if gid.RISC() {
+		err := fmt.Errorf("account locked")
+		log.Warnw(err.Error(), "GID", gid, "message", "calendar feed for locked account")
+		return "", err
+	}
+	return gid, nil
+}
+
+// calendarRoute is the agent's assigned tasks in all ops
+func calendarRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := calendarAgent(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	cal, err := gid.Calendar()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeCalendar(res, cal)
+}
+
+// calendarOpRoute is the agent's assigned tasks in one op
+func calendarOpRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := calendarAgent(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var o model.Operation
+	o.ID = model.OperationID(vars["opID"])
+
+	read, _ := o.ReadAccess(gid)
+	if !read && !o.AssignedOnlyAccess(gid) {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", o.ID, "message", "no access to operation")
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// only the agent's own assignments are listed
+	cal, err := o.Calendar(gid)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeCalendar(res, cal)
+}
+
+func writeCalendar(res http.ResponseWriter, cal []byte) {
+	res.Header().Set("Content-Type", model.CalendarContentType)
+	res.Header().Set("Cache-Control", "no-store")
+	if _, err := res.Write(cal); err != nil {
+		log.Error(err)
+	}
+}
@@ -2,12 +2,14 @@ package wasabeehttps
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	// "io"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -187,6 +189,127 @@ func drawGetRoute(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func drawImportRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	if !contentTypeIs(req, jsonTypeShort) {
+		err := fmt.Errorf("invalid request (needs to be application/json)")
+		log.Infow(err.Error(), "GID", gid, "resource", "new operation")
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	var in model.ImportRequest
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	report, err := model.Import(req.Context(), gid, in)
+	if err != nil {
+		if err.Error() == model.ErrImportNoMatches {
+			res.Header().Set("Content-Type", jsonType)
+			res.WriteHeader(http.StatusUnprocessableEntity)
+			if err := json.NewEncoder(res).Encode(report); err != nil {
+				log.Error(err)
+			}
+			return
+		}
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(report); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func drawExportRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var o model.Operation
+	o.ID = model.OperationID(vars["opID"])
+
+	read, _ := o.ReadAccess(gid)
+	if !read && !o.AssignedOnlyAccess(gid) {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", o.ID, "message", "no access to operation")
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	format := req.FormValue("format")
+	if format == "" {
+		format = model.ExportGeoJSON
+	}
+
+	// Export does the zone and assigned-only filtering
+	b, contentType, err := o.Export(gid, format)
+	if err != nil {
+		if err.Error() == model.ErrUnknownExportFormat {
+			http.Error(res, jsonError(err), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", o.ID, format))
+	res.Header().Set("Cache-Control", "no-store")
+	if _, err := res.Write(b); err != nil {
+		log.Error(err)
+	}
+}
+
+func drawValidateRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var o model.Operation
+	o.ID = model.OperationID(vars["opID"])
+
+	read, _ := o.ReadAccess(gid)
+	if !read && !o.AssignedOnlyAccess(gid) {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", o.ID, "message", "no access to operation")
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	// only the links gid can see are checked
+	v, err := o.Validate(gid)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("ETag", v.LastEditID)
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
 func drawDeleteRoute(res http.ResponseWriter, req *http.Request) {
 	gid, err := getAgentID(req)
 	if err != nil {
@@ -207,6 +330,10 @@ func drawDeleteRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	if err := op.Delete(gid); err != nil {
+		if err.Error() == model.ErrOpInTrash {
+			http.Error(res, jsonError(err), http.StatusConflict)
+			return
+		}
 		log.Error(err)
 		http.Error(res, jsonError(err), http.StatusInternalServerError)
 		return
@@ -216,6 +343,41 @@ func drawDeleteRoute(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(res, jsonStatusOK)
 }
 
+func drawUndeleteRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.ID.IsOwner(gid) {
+		err = fmt.Errorf("forbidden: only the owner can restore an operation")
+		log.Warnw(err.Error(), "resource", op.ID, "GID", gid)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	if err := op.ID.Undelete(gid); err != nil {
+		if err.Error() == model.ErrOpNotInTrash {
+			http.Error(res, jsonError(err), http.StatusNotFound)
+			return
+		}
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	// let the teams know it is back
+	if err := op.PopulateTeams(); err != nil {
+		log.Error(err)
+	}
+	uid := touch(op)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
 func drawUpdateRoute(res http.ResponseWriter, req *http.Request) {
 	gid, err := getAgentID(req)
 	if err != nil {
@@ -242,16 +404,21 @@ func drawUpdateRoute(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// merge=true asks the server to merge with changes made since the If-Match version instead of refusing the update
+	im := req.Header.Get("If-Match")
+	merge := req.FormValue("merge") == "true"
+
+	// cheap early refusal, the authoritative check is made by DrawUpdateFrom while holding the op lock
 	s, err := op.ID.Stat()
 	if err != nil {
 		log.Error(err)
 		http.Error(res, jsonError(err), http.StatusInternalServerError)
 		return
 	}
-	im := req.Header.Get("If-Match")
-	if im != "" && im != s.LastEditID {
-		err := fmt.Errorf("local copy out-of-date")
+	if im != "" && im != s.LastEditID && !merge {
+		err := fmt.Errorf(model.ErrOpStale)
 		log.Debugw(err.Error(), "GID", gid, "resource", s.ID, "If-Match", im, "LastEditID", s.LastEditID)
+		res.Header().Set("ETag", s.LastEditID)
 		http.Error(res, jsonError(err), http.StatusPreconditionFailed)
 		return
 	}
@@ -271,12 +438,24 @@ func drawUpdateRoute(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = model.DrawUpdate(req.Context(), &op, gid)
+	err = model.DrawUpdateFrom(req.Context(), &op, gid, im, merge)
 	if err != nil {
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		var conflict *model.OpConflictError
+		if errors.As(err, &conflict) {
+			res.Header().Set("ETag", conflict.LastEditID)
+			if len(conflict.Conflicts) > 0 {
+				http.Error(res, jsonConflict(conflict), http.StatusConflict)
+			} else {
+				http.Error(res, jsonError(err), http.StatusPreconditionFailed)
+			}
+			return
+		}
+		changeError(res, err)
 		return
 	}
-	uid := touch(op)
+	// DrawUpdate sets the new update ID, no need to touch
+	uid := op.LastEditID
+	announceMapChange(op, uid)
 	fmt.Fprint(res, jsonOKUpdateID(uid))
 
 	// store backup revision -- used for testing
@@ -322,6 +501,100 @@ func drawUpdateRoute(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func drawPatchRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !contentTypeIs(req, jsonTypeShort) {
+		err := fmt.Errorf("invalid request (needs to be application/json)")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	if !op.WriteAccess(gid) {
+		err = fmt.Errorf("forbidden: write access required to update an operation")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	var patch []model.PatchItem
+	if err := json.NewDecoder(req.Body).Decode(&patch); err != nil {
+		log.Errorw("decoding incoming patch", "error", err.Error(), "resource", op.ID, "GID", gid)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+	if len(patch) == 0 {
+		http.Error(res, jsonStatusEmpty, http.StatusNotAcceptable)
+		return
+	}
+
+	uid, err := model.DrawPatch(req.Context(), op.ID, gid, patch, req.Header.Get("If-Match"))
+	if err != nil {
+		patchError(res, err)
+		return
+	}
+
+	patchApplied(res, op, uid)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+func drawCloneRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	// cloning does not change the source, archived ops can be cloned back into service
+	if read, _ := op.ReadAccess(gid); !read {
+		err = fmt.Errorf("forbidden: read access required to clone an operation")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	// options may be sent as JSON or as form values
+	var opts model.CloneOptions
+	if contentTypeIs(req, jsonTypeShort) {
+		if err := json.NewDecoder(req.Body).Decode(&opts); err != nil {
+			log.Errorw("decoding clone options", "error", err.Error(), "resource", op.ID, "GID", gid)
+			http.Error(res, jsonError(err), http.StatusNotAcceptable)
+			return
+		}
+	} else {
+		opts.Name = req.FormValue("name")
+		opts.Assignments = req.FormValue("assignments") == "true"
+		opts.States = req.FormValue("states") == "true"
+		opts.Keys = req.FormValue("keys") == "true"
+		opts.Permissions = req.FormValue("permissions") == "true"
+	}
+	// only those who manage the source may hand its teams to the copy
+	if opts.Permissions && !op.WriteAccess(gid) {
+		opts.Permissions = false
+	}
+
+	newID, err := op.ID.Clone(req.Context(), gid, opts)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(res, "{\"status\":\"ok\", \"ID\": \"%s\"}", newID)
+}
+
 func drawChownRoute(res http.ResponseWriter, req *http.Request) {
 	gid, err := getAgentID(req)
 	if err != nil {
@@ -351,6 +624,145 @@ func drawChownRoute(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(res, jsonStatusOK)
 }
 
+func drawRemindersRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	// only the ID needs to be set for this
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.ID.IsOwner(gid) {
+		err = fmt.Errorf("forbidden: only the owner can set operation reminders")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	enabled := vars["state"] == "on"
+	if err := op.ID.SetReminders(gid, enabled); err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	// teams are needed for the announcement
+	if err := op.PopulateTeams(); err != nil {
+		log.Error(err)
+	}
+	uid := touch(op)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+func drawAutoZoneRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	// only the ID needs to be set for this
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.ID.IsOwner(gid) {
+		err = fmt.Errorf("forbidden: only the owner can set automatic zones")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	enabled := vars["state"] == "on"
+	if err := op.ID.SetAutoZone(gid, enabled); err != nil {
+		changeError(res, err)
+		return
+	}
+
+	// teams are needed for the announcement
+	if err := op.PopulateTeams(); err != nil {
+		log.Error(err)
+	}
+	uid := touch(op)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+func drawStateRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	// only the ID needs to be set for this
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.ID.IsOwner(gid) {
+		err = fmt.Errorf("forbidden: only the owner can set the operation state")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	if err := op.ID.SetState(gid, model.OpState(vars["state"])); err != nil {
+		if err.Error() == model.ErrOpNotFound {
+			http.Error(res, jsonError(err), http.StatusNotFound)
+			return
+		}
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	// teams are needed for the announcement
+	if err := op.PopulateTeams(); err != nil {
+		log.Error(err)
+	}
+	uid := touch(op)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+func drawStatsRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if read, _ := op.ReadAccess(gid); !read && !op.AssignedOnlyAccess(gid) {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID, "message", "no access to operation")
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	stats, err := op.Stats(gid)
+	if err != nil {
+		if err.Error() == model.ErrOpNotFound {
+			http.Error(res, jsonError(err), http.StatusNotFound)
+			return
+		}
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("ETag", stats.LastEditID)
+	if err := json.NewEncoder(res).Encode(stats); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
 func drawPortalCommentRoute(res http.ResponseWriter, req *http.Request) {
 	gid, err := getAgentID(req)
 	if err != nil {
@@ -374,7 +786,7 @@ func drawPortalCommentRoute(res http.ResponseWriter, req *http.Request) {
 	comment := req.FormValue("comment")
 	err = op.ID.PortalComment(portalID, comment)
 	if err != nil {
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid := touch(op)
@@ -404,13 +816,115 @@ func drawPortalHardnessRoute(res http.ResponseWriter, req *http.Request) {
 	err = op.ID.PortalHardness(portalID, hardness)
 	if err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid := touch(op)
 	fmt.Fprint(res, jsonOKUpdateID(uid))
 }
 
+func drawPortalSBULRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	// only the ID needs to be set for this
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.WriteAccess(gid) {
+		err = fmt.Errorf("write access required to set portal SBULs")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+	portalID := model.PortalID(vars["portal"])
+	sbul, err := strconv.ParseUint(req.FormValue("sbul"), 10, 8)
+	if err != nil {
+		log.Infow(err.Error(), "GID", gid, "resource", op.ID, "portal", portalID)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+	if err = op.ID.PortalSBUL(portalID, uint8(sbul)); err != nil {
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+	uid := touch(op)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+func portalSearchRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	var s model.PortalSearch
+	s.Name = strings.TrimSpace(req.FormValue("name"))
+
+	// bbox is south,west,north,east
+	if bbox := req.FormValue("bbox"); bbox != "" {
+		for _, v := range strings.Split(bbox, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				log.Infow(err.Error(), "GID", gid, "bbox", bbox)
+				http.Error(res, jsonError(err), http.StatusNotAcceptable)
+				return
+			}
+			s.Box = append(s.Box, f)
+		}
+		if len(s.Box) != 4 {
+			err := fmt.Errorf("bbox requires south, west, north and east")
+			log.Infow(err.Error(), "GID", gid, "bbox", bbox)
+			http.Error(res, jsonError(err), http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	// radius is in meters around lat, lng
+	if radius := req.FormValue("radius"); radius != "" {
+		var errs [3]error
+		s.Radius, errs[0] = strconv.ParseFloat(radius, 64)
+		s.Lat, errs[1] = strconv.ParseFloat(req.FormValue("lat"), 64)
+		s.Lon, errs[2] = strconv.ParseFloat(req.FormValue("lng"), 64)
+		for _, err := range errs {
+			if err != nil {
+				log.Infow(err.Error(), "GID", gid, "radius", radius)
+				http.Error(res, jsonError(err), http.StatusNotAcceptable)
+				return
+			}
+		}
+		if s.Radius <= 0 {
+			err := fmt.Errorf("radius must be positive")
+			http.Error(res, jsonError(err), http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	if s.Name == "" && len(s.Box) == 0 && s.Radius == 0 {
+		err := fmt.Errorf("search requires a name, a bbox or a radius")
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	portals, err := model.SearchPortals(gid, s)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(portals); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
 func drawOrderRoute(res http.ResponseWriter, req *http.Request) {
 	gid, err := getAgentID(req)
 	if err != nil {
@@ -433,13 +947,13 @@ func drawOrderRoute(res http.ResponseWriter, req *http.Request) {
 	err = op.LinkOrder(order)
 	if err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		changeError(res, err)
 		return
 	}
 	err = op.MarkerOrder(order)
 	if err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		changeError(res, err)
 		return
 	}
 	uid := touch(op)
@@ -467,7 +981,7 @@ func drawInfoRoute(res http.ResponseWriter, req *http.Request) {
 	err = op.SetInfo(info, gid)
 	if err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid := touch(op)
@@ -511,6 +1025,41 @@ func drawPortalKeysRoute(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(res, jsonOKUpdateID(uid))
 }
 
+func drawKeyRequirementsRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var o model.Operation
+	o.ID = model.OperationID(vars["opID"])
+
+	read, _ := o.ReadAccess(gid)
+	if !read && !o.AssignedOnlyAccess(gid) {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", o.ID, "message", "no access to operation")
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	// assigned-only agents see only their own links and keys
+	kr, err := o.KeyRequirements(gid)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("ETag", kr.LastEditID)
+	if err := json.NewEncoder(res).Encode(kr); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
 func drawPermsAddRoute(res http.ResponseWriter, req *http.Request) {
 	gid, err := getAgentID(req)
 	if err != nil {
@@ -594,6 +1143,56 @@ func jsonOKUpdateID(uid string) string {
 	return fmt.Sprintf("{\"status\":\"ok\", \"updateID\": \"%s\"}", uid)
 }
 
+// jsonConflict reports the current update ID and the items which could not be merged
+func jsonConflict(c *model.OpConflictError) string {
+	conflicts, err := json.Marshal(c.Conflicts)
+	if err != nil {
+		log.Error(err)
+		return jsonError(c)
+	}
+	return fmt.Sprintf(`{"status":"error","error":"%s","lasteditid":"%s","conflicts":%s}`, c.Error(), c.LastEditID, conflicts)
+}
+
+// patchError writes the response for a patch which was not applied, a stale If-Match gets the current ETag
+func patchError(res http.ResponseWriter, err error) {
+	var conflict *model.OpConflictError
+	var pe *model.PatchError
+	switch {
+	case errors.As(err, &conflict):
+		res.Header().Set("ETag", conflict.LastEditID)
+		http.Error(res, jsonError(err), http.StatusPreconditionFailed)
+	case errors.As(err, &pe):
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+	default:
+		changeError(res, err)
+	}
+}
+
+// changeError writes the response for a change which was not made, archived ops are read-only
+func changeError(res http.ResponseWriter, err error) {
+	var ae *model.MarkerAttributeError
+	switch {
+	case errors.As(err, &ae), err.Error() == model.ErrUnknownMarkerType:
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+	case err.Error() == model.ErrOpArchived:
+		http.Error(res, jsonError(err), http.StatusForbidden)
+	case err.Error() == model.ErrOpBusy:
+		http.Error(res, jsonError(err), http.StatusServiceUnavailable)
+	default:
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+	}
+}
+
+// patchApplied announces an applied patch and sets the new ETag
+// owners are not required to be on a team, WriteAccess may not have loaded them
+func patchApplied(res http.ResponseWriter, op model.Operation, uid string) {
+	if err := op.PopulateTeams(); err != nil {
+		log.Error(err)
+	}
+	announceMapChange(op, uid)
+	res.Header().Set("ETag", uid)
+}
+
 func touch(op model.Operation) string {
 	// update the timestamp and updateID
 	uid, err := op.Touch()
@@ -601,7 +1200,12 @@ func touch(op model.Operation) string {
 		return ""
 	}
 
-	// announce to all relevant teams
+	announceMapChange(op, uid)
+	return uid
+}
+
+// announceMapChange sends the map change to all relevant teams
+func announceMapChange(op model.Operation, uid string) {
 	go func() {
 		teams := make(map[model.TeamID]bool)
 		for _, t := range op.Teams {
@@ -615,5 +1219,4 @@ func touch(op model.Operation) string {
 			_ = wfb.MapChange(ta, op.ID, uid)
 		}
 	}()
-	return uid
 }
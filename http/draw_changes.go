@@ -0,0 +1,60 @@
+package wasabeehttps
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/model"
+)
+
+func drawChangesRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var o model.Operation
+	o.ID = model.OperationID(vars["opID"])
+
+	if o.ID.IsDeletedOp() {
+		err := fmt.Errorf("requested deleted op")
+		log.Infow(err.Error(), "GID", gid, "resource", o.ID)
+		http.Error(res, jsonError(err), http.StatusGone)
+		return
+	}
+
+	read, _ := o.ReadAccess(gid)
+	if !read && !o.AssignedOnlyAccess(gid) {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", o.ID, "message", "no access to operation")
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	since := req.FormValue("since")
+	if since == "" {
+		err := fmt.Errorf("since must be set to a lasteditid")
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	changes, err := o.ChangesSince(since, gid)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("ETag", changes.LastEditID)
+	if err = json.NewEncoder(res).Encode(changes); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
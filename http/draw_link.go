@@ -70,9 +70,9 @@ func drawLinkAssignRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	agent := model.GoogleID(req.FormValue("agent"))
-	if err = link.SetAssignments([]model.GoogleID{agent}, nil); err != nil {
+	if err = link.SetAssignments(gid, []model.GoogleID{agent}, nil); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -94,9 +94,9 @@ func drawLinkDescRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	desc := req.FormValue("desc")
-	if err = link.SetComment(desc); err != nil {
+	if err = link.SetComment(gid, desc); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -120,7 +120,7 @@ func drawLinkColorRoute(res http.ResponseWriter, req *http.Request) {
 	color := req.FormValue("color")
 	if err = link.SetColor(color); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -143,7 +143,7 @@ func drawLinkSwapRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = link.Swap(); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -165,9 +165,9 @@ func drawLinkZoneRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	zone := model.ZoneFromString(req.FormValue("zone"))
-	if err = link.SetZone(zone); err != nil {
+	if err = link.SetZone(gid, zone); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -197,7 +197,7 @@ func drawLinkDeltaRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = link.SetDelta(int(delta)); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -228,15 +228,19 @@ func drawLinkCompRoute(res http.ResponseWriter, req *http.Request, complete bool
 	}
 
 	if complete {
-		if err = link.Complete(); err != nil {
+		if err = link.Complete(gid, req.FormValue("force") == "true"); err != nil {
+			if err.Error() == model.ErrDependsIncomplete {
+				http.Error(res, jsonError(err), http.StatusConflict)
+				return
+			}
 			log.Error(err)
-			http.Error(res, jsonError(err), http.StatusInternalServerError)
+			changeError(res, err)
 			return
 		}
 	} else {
-		if err = link.Incomplete(); err != nil {
+		if err = link.Incomplete(gid); err != nil {
 			log.Error(err)
-			http.Error(res, jsonError(err), http.StatusInternalServerError)
+			changeError(res, err)
 			return
 		}
 	}
@@ -260,7 +264,7 @@ func drawLinkClaimRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	if err = link.Claim(gid); err != nil {
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -283,7 +287,7 @@ func drawLinkRejectRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err := link.Reject(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
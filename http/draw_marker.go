@@ -70,9 +70,9 @@ func drawMarkerAssignRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	agent := model.GoogleID(req.FormValue("agent"))
-	if err = marker.SetAssignments([]model.GoogleID{agent}, nil); err != nil {
+	if err = marker.SetAssignments(gid, []model.GoogleID{agent}, nil); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -96,7 +96,7 @@ func drawMarkerClaimRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = marker.Claim(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -118,9 +118,9 @@ func drawMarkerCommentRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	comment := req.FormValue("comment")
-	if err = marker.SetComment(comment); err != nil {
+	if err = marker.SetComment(gid, comment); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid := markerStatusTouch(op, marker.ID, "comment")
@@ -141,9 +141,9 @@ func drawMarkerZoneRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	zone := model.ZoneFromString(req.FormValue("zone"))
-	if err := marker.SetZone(zone); err != nil {
+	if err := marker.SetZone(gid, zone); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid := markerStatusTouch(op, marker.ID, "zone")
@@ -172,7 +172,7 @@ func drawMarkerDeltaRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = marker.SetDelta(int(delta)); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid := markerStatusTouch(op, marker.ID, "delta")
@@ -217,9 +217,13 @@ func drawMarkerCompleteRoute(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := marker.Complete(); err != nil {
+	if err := marker.Complete(gid, req.FormValue("force") == "true"); err != nil {
+		if err.Error() == model.ErrDependsIncomplete {
+			http.Error(res, jsonError(err), http.StatusConflict)
+			return
+		}
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -241,9 +245,9 @@ func drawMarkerIncompleteRoute(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err = marker.Incomplete(); err != nil {
+	if err = marker.Incomplete(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -267,7 +271,7 @@ func drawMarkerRejectRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = marker.Reject(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -289,9 +293,9 @@ func drawMarkerAcknowledgeRoute(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err = marker.Acknowledge(); err != nil {
+	if err = marker.Acknowledge(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -310,6 +314,15 @@ func markerAssignTouch(gid model.GoogleID, markerID model.MarkerID, op *model.Op
 	return uid
 }
 
+// markerTypesRoute publishes the marker types the server accepts, and the attributes each may carry
+func markerTypesRoute(res http.ResponseWriter, req *http.Request) {
+	if err := json.NewEncoder(res).Encode(model.MarkerTypes()); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
 // markerStatusTouch updates the updateID and notifies all teams of the update
 func markerStatusTouch(op *model.Operation, markerID model.MarkerID, status string) string {
 	// update the timestamp and updateID
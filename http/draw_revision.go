@@ -0,0 +1,112 @@
+package wasabeehttps
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/model"
+)
+
+func drawRevisionsRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.WriteAccess(gid) {
+		err = fmt.Errorf("forbidden: write access required to view revisions")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	revisions, err := op.ID.Revisions()
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err = json.NewEncoder(res).Encode(&revisions); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func drawRevisionRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.WriteAccess(gid) {
+		err = fmt.Errorf("forbidden: write access required to view revisions")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	revision, err := op.ID.Revision(vars["rev"])
+	if err != nil {
+		if err.Error() == model.ErrRevisionNotFound {
+			http.Error(res, jsonError(err), http.StatusNotFound)
+		} else {
+			http.Error(res, jsonError(err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err = json.NewEncoder(res).Encode(revision); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func drawRevisionRestoreRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.WriteAccess(gid) {
+		err = fmt.Errorf("forbidden: write access required to restore revisions")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	uid, err := op.ID.RestoreRevision(req.Context(), vars["rev"], gid)
+	if err != nil {
+		if err.Error() == model.ErrRevisionNotFound {
+			http.Error(res, jsonError(err), http.StatusNotFound)
+		} else {
+			changeError(res, err)
+		}
+		return
+	}
+
+	announceMapChange(op, uid)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
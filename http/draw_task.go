@@ -10,6 +10,7 @@ import (
 	"github.com/wasabee-project/Wasabee-Server/Firebase"
 	"github.com/wasabee-project/Wasabee-Server/log"
 	"github.com/wasabee-project/Wasabee-Server/model"
+	"github.com/wasabee-project/Wasabee-Server/util"
 )
 
 // setup common to all these calls
@@ -96,9 +97,9 @@ func drawTaskAssignRoute(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	if err = task.SetAssignments(assignments, nil); err != nil {
+	if err = task.SetAssignments(gid, assignments, nil); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -131,7 +132,7 @@ func drawTaskClaimRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = task.Claim(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -157,9 +158,9 @@ func drawTaskCommentRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	comment := req.FormValue("comment")
-	if err = task.SetComment(comment); err != nil {
+	if err = task.SetComment(gid, comment); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid, err := op.Touch()
@@ -184,9 +185,9 @@ func drawTaskZoneRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	zone := model.ZoneFromString(req.FormValue("zone"))
-	if err := task.SetZone(zone); err != nil {
+	if err := task.SetZone(gid, zone); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid, err := op.Touch()
@@ -219,7 +220,7 @@ func drawTaskDeltaRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = task.SetDelta(int(delta)); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 	uid, err := op.Touch()
@@ -251,6 +252,12 @@ func drawTaskFetch(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, jsonError(err), http.StatusForbidden)
 		return
 	}
+
+	// generic tasks carry more than the task itself
+	if g, err := op.GetGenericTask(task.ID); err == nil {
+		json.NewEncoder(res).Encode(g)
+		return
+	}
 	json.NewEncoder(res).Encode(task)
 }
 
@@ -268,9 +275,13 @@ func drawTaskCompleteRoute(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := task.Complete(); err != nil {
+	if err := task.Complete(gid, req.FormValue("force") == "true"); err != nil {
+		if err.Error() == model.ErrDependsIncomplete {
+			http.Error(res, jsonError(err), http.StatusConflict)
+			return
+		}
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -296,9 +307,9 @@ func drawTaskIncompleteRoute(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err = task.Incomplete(); err != nil {
+	if err = task.Incomplete(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -326,7 +337,7 @@ func drawTaskRejectRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = task.Reject(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -352,9 +363,9 @@ func drawTaskAcknowledgeRoute(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err = task.Acknowledge(); err != nil {
+	if err = task.Acknowledge(gid); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -389,8 +400,12 @@ func drawTaskDependAddRoute(res http.ResponseWriter, req *http.Request) {
 	}
 
 	if err = task.AddDepend(model.TaskID(dependsOn)); err != nil {
+		if err.Error() == model.ErrDependCycle || err.Error() == model.ErrDependNotFound {
+			http.Error(res, jsonError(err), http.StatusNotAcceptable)
+			return
+		}
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -427,7 +442,7 @@ func drawTaskDependDelRoute(res http.ResponseWriter, req *http.Request) {
 	err = task.DelDepend(dependsOn)
 	if err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -469,7 +484,7 @@ func drawTaskOrderRoute(res http.ResponseWriter, req *http.Request) {
 
 	if err = task.SetOrder(int16(order)); err != nil {
 		log.Error(err)
-		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		changeError(res, err)
 		return
 	}
 
@@ -480,3 +495,343 @@ func drawTaskOrderRoute(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(res, jsonOKUpdateID(uid))
 	go taskStatusAnnounce(op, task.ID, "order", uid)
 }
+
+func drawTasksReadyRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if read, _ := op.ReadAccess(gid); !read && !op.AssignedOnlyAccess(gid) {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID, "message", "no access to operation")
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	ready, err := op.ReadyTasks(gid)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("ETag", ready.LastEditID)
+	if err := json.NewEncoder(res).Encode(ready); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func drawProgressRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if read, _ := op.ReadAccess(gid); !read {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID, "message", "no access to operation")
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	progress, err := op.Progress(gid)
+	if err != nil {
+		if err.Error() == model.ErrOpNotFound {
+			http.Error(res, jsonError(err), http.StatusNotFound)
+			return
+		}
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("ETag", progress.LastEditID)
+	if err := json.NewEncoder(res).Encode(progress); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func drawTaskHistoryRoute(res http.ResponseWriter, req *http.Request) {
+	_, _, task, err := taskRequires(res, req)
+	if err != nil {
+		return
+	}
+
+	events, err := task.History()
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(events); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func drawTasksHistoryRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if read, _ := op.ReadAccess(gid); !read && !op.AssignedOnlyAccess(gid) {
+		err := fmt.Errorf("forbidden")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID, "message", "no access to operation")
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	timeline, err := op.TaskTimeline(gid)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(timeline); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func drawTasksBulkRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !contentTypeIs(req, jsonTypeShort) {
+		err := fmt.Errorf("invalid request (needs to be application/json)")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	if !op.WriteAccess(gid) {
+		err = fmt.Errorf("forbidden: write access required to update tasks")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	var actions []model.TaskAction
+	if err := json.NewDecoder(req.Body).Decode(&actions); err != nil {
+		log.Errorw("decoding incoming task actions", "error", err.Error(), "resource", op.ID, "GID", gid)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+	if len(actions) == 0 {
+		http.Error(res, jsonStatusEmpty, http.StatusNotAcceptable)
+		return
+	}
+
+	uid, err := model.BulkTasks(req.Context(), op.ID, gid, actions, req.Header.Get("If-Match"))
+	if err != nil {
+		patchError(res, err)
+		return
+	}
+
+	patchApplied(res, op, uid)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+// drawAutoAssignRoute returns a proposal for the unassigned tasks, it is only applied if commit is set
+// a previewed proposal may be sent back as the body to commit exactly what was previewed
+func drawAutoAssignRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var op model.Operation
+	op.ID = model.OperationID(vars["opID"])
+
+	if !op.WriteAccess(gid) {
+		err = fmt.Errorf("forbidden: write access required to assign tasks")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return
+	}
+
+	var proposal *model.AutoAssignProposal
+	if contentTypeIs(req, jsonTypeShort) {
+		var p model.AutoAssignProposal
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			log.Errorw("decoding autoassign proposal", "error", err.Error(), "resource", op.ID, "GID", gid)
+			http.Error(res, jsonError(err), http.StatusNotAcceptable)
+			return
+		}
+		if p.LastEditID == "" {
+			err := fmt.Errorf("proposal lasteditid required")
+			log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+			http.Error(res, jsonError(err), http.StatusNotAcceptable)
+			return
+		}
+		p.ID = op.ID
+		proposal = &p
+	} else {
+		proposal, err = op.AutoAssign(gid)
+		if err != nil {
+			http.Error(res, jsonError(err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if commit, _ := strconv.ParseBool(req.FormValue("commit")); !commit {
+		res.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(res).Encode(proposal); err != nil {
+			log.Error(err)
+			http.Error(res, jsonError(err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	uid, err := model.CommitAutoAssign(req.Context(), gid, proposal)
+	if err != nil {
+		patchError(res, err)
+		return
+	}
+
+	patchApplied(res, op, uid)
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+func drawTaskAddRoute(res http.ResponseWriter, req *http.Request) {
+	gid, op, err := genericTaskRequires(res, req)
+	if err != nil {
+		return
+	}
+
+	var g model.GenericTask
+	if err := json.NewDecoder(req.Body).Decode(&g); err != nil {
+		log.Errorw("decoding incoming task", "error", err.Error(), "resource", op.ID, "GID", gid)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+	if g.ID == "" {
+		g.ID = model.TaskID(util.GenerateID(40))
+	}
+
+	uid, err := genericTaskPatch(res, req, gid, op, "add", g)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(res, "{\"status\":\"ok\", \"updateID\": \"%s\", \"task\": \"%s\"}", uid, g.ID)
+}
+
+func drawTaskUpdateRoute(res http.ResponseWriter, req *http.Request) {
+	gid, op, err := genericTaskRequires(res, req)
+	if err != nil {
+		return
+	}
+
+	var g model.GenericTask
+	if err := json.NewDecoder(req.Body).Decode(&g); err != nil {
+		log.Errorw("decoding incoming task", "error", err.Error(), "resource", op.ID, "GID", gid)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+	g.ID = model.TaskID(mux.Vars(req)["taskID"])
+
+	uid, err := genericTaskPatch(res, req, gid, op, "update", g)
+	if err != nil {
+		return
+	}
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+func drawTaskDeleteRoute(res http.ResponseWriter, req *http.Request) {
+	gid, op, err := genericTaskRequires(res, req)
+	if err != nil {
+		return
+	}
+
+	g := model.GenericTask{ID: model.TaskID(mux.Vars(req)["taskID"])}
+	uid, err := genericTaskPatch(res, req, gid, op, "delete", g)
+	if err != nil {
+		return
+	}
+	fmt.Fprint(res, jsonOKUpdateID(uid))
+}
+
+// genericTaskRequires is the setup common to the generic task add, update and delete calls
+func genericTaskRequires(res http.ResponseWriter, req *http.Request) (model.GoogleID, *model.Operation, error) {
+	var op model.Operation
+
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return gid, &op, err
+	}
+
+	op.ID = model.OperationID(mux.Vars(req)["opID"])
+
+	if req.Method != http.MethodDelete && !contentTypeIs(req, jsonTypeShort) {
+		err := fmt.Errorf("invalid request (needs to be application/json)")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return gid, &op, err
+	}
+
+	if !op.WriteAccess(gid) {
+		err := fmt.Errorf("forbidden: write access required to change tasks")
+		log.Warnw(err.Error(), "GID", gid, "resource", op.ID)
+		http.Error(res, jsonError(err), http.StatusForbidden)
+		return gid, &op, err
+	}
+	return gid, &op, nil
+}
+
+// genericTaskPatch applies a single generic task change as a patch, any error is written to res
+func genericTaskPatch(res http.ResponseWriter, req *http.Request, gid model.GoogleID, op *model.Operation, action string, g model.GenericTask) (string, error) {
+	item := model.PatchItem{Op: action, Type: "task", ID: string(g.ID)}
+	if action != "delete" {
+		value, err := json.Marshal(g)
+		if err != nil {
+			log.Error(err)
+			http.Error(res, jsonError(err), http.StatusInternalServerError)
+			return "", err
+		}
+		item.Value = value
+	}
+
+	uid, err := model.DrawPatch(req.Context(), op.ID, gid, []model.PatchItem{item}, req.Header.Get("If-Match"))
+	if err != nil {
+		patchError(res, err)
+		return "", err
+	}
+
+	patchApplied(res, *op, uid)
+	return uid, nil
+}
@@ -9,7 +9,7 @@ import (
 	"net"
 	"net/http"
 	"os"
-	// "strconv"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -44,10 +44,81 @@ func meRoute(res http.ResponseWriter, req *http.Request) {
 	}
 	agent.QueryToken = formValidationToken(req)
 
+	if req.FormValue("archived") == "true" {
+		if err := agent.IncludeArchivedOps(); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	res.Header().Set("Cache-Control", "no-store")
 	json.NewEncoder(res).Encode(&agent)
 }
 
+// list the agent's deleted ops which can still be restored
+func meTrashRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	trash, err := gid.Trash(config.Get().TrashDays)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(&trash); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func meNearbyOpsRoute(res http.ResponseWriter, req *http.Request) {
+	gid, err := getAgentID(req)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusUnauthorized)
+		return
+	}
+
+	lat, err := strconv.ParseFloat(req.FormValue("lat"), 64)
+	if err != nil {
+		log.Infow(err.Error(), "GID", gid)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+	lon, err := strconv.ParseFloat(req.FormValue("lon"), 64)
+	if err != nil {
+		log.Infow(err.Error(), "GID", gid)
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+	radius := float64(model.NearbyRadius)
+	if r := req.FormValue("radius"); r != "" {
+		if radius, err = strconv.ParseFloat(r, 64); err != nil {
+			log.Infow(err.Error(), "GID", gid)
+			http.Error(res, jsonError(err), http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	nearby, err := gid.NearbyOps(lat, lon, radius)
+	if err != nil {
+		http.Error(res, jsonError(err), http.StatusNotAcceptable)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(&nearby); err != nil {
+		log.Error(err)
+		http.Error(res, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+}
+
 // use this to verify that form data is sent from a client that requested it
 func formValidationToken(req *http.Request) string {
 	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
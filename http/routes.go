@@ -45,6 +45,10 @@ func setupRouter() *mux.Router {
 	router.HandleFunc("/firebase-messaging-sw.js", fbmswRoute).Methods("GET")
 	router.HandleFunc("/", frontRoute).Methods("GET")
 
+	// calendar apps cannot log in, the token in the URL identifies the agent
+	router.HandleFunc("/calendar/{token}.ics", calendarRoute).Methods("GET")
+	router.HandleFunc("/calendar/{token}/{opID}.ics", calendarOpRoute).Methods("GET")
+
 	// /api/v1/... route
 	api := config.Subrouter(c.APIPathURL)
 	api.Methods("OPTIONS").HandlerFunc(optionsRoute)
@@ -69,17 +73,35 @@ func setupRouter() *mux.Router {
 func setupAuthRoutes(r *mux.Router) {
 	// This block requires authentication
 	r.HandleFunc("/draw", drawUploadRoute).Methods("POST")
+	r.HandleFunc("/draw/import", drawImportRoute).Methods("POST") // format drawtools, geojson
 	r.HandleFunc("/draw/{opID}", drawGetRoute).Methods("GET", "HEAD")
 	r.HandleFunc("/draw/{opID}", drawDeleteRoute).Methods("DELETE")
 	r.HandleFunc("/draw/{opID}", drawUpdateRoute).Methods("PUT")
+	r.HandleFunc("/draw/{opID}", drawPatchRoute).Methods("PATCH")
 	r.HandleFunc("/draw/{opID}/delete", drawDeleteRoute).Methods("GET", "DELETE")
+	r.HandleFunc("/draw/{opID}/undelete", drawUndeleteRoute).Methods("POST")
+	r.HandleFunc("/draw/{opID}/clone", drawCloneRoute).Methods("POST")
+	r.HandleFunc("/draw/{opID}/export", drawExportRoute).Methods("GET") // format geojson, kml, gpx
+	r.HandleFunc("/draw/{opID}/validate", drawValidateRoute).Methods("GET")
+	r.HandleFunc("/draw/{opID}/keys/requirements", drawKeyRequirementsRoute).Methods("GET")
 	r.HandleFunc("/draw/{opID}/chown", drawChownRoute).Methods("GET").Queries("to", "{to}")
+	r.HandleFunc("/draw/{opID}/reminders", drawRemindersRoute).Methods("PUT").Queries("state", "{state}") // on or off, owner only
+	r.HandleFunc("/draw/{opID}/autozone", drawAutoZoneRoute).Methods("PUT").Queries("state", "{state}")   // on or off, owner only
+	r.HandleFunc("/draw/{opID}/state", drawStateRoute).Methods("PUT").Queries("state", "{state}")         // planning, briefed, live, finished or archived, owner only
 	r.HandleFunc("/draw/{opID}/order", drawOrderRoute).Methods("POST")
 	r.HandleFunc("/draw/{opID}/info", drawInfoRoute).Methods("POST")
 	r.HandleFunc("/draw/{opID}/perms", drawPermsAddRoute).Methods("POST")
 	r.HandleFunc("/draw/{opID}/perms", drawPermsDeleteRoute).Methods("DELETE")
 	r.HandleFunc("/draw/{opID}/delperm", drawPermsDeleteRoute).Methods("GET") // .Queries("team", "{team}", "role", "{role}")
 
+	// change feed
+	r.HandleFunc("/draw/{opID}/changes", drawChangesRoute).Methods("GET") // since lasteditid
+
+	// revisions
+	r.HandleFunc("/draw/{opID}/revisions", drawRevisionsRoute).Methods("GET")
+	r.HandleFunc("/draw/{opID}/revisions/{rev}", drawRevisionRoute).Methods("GET")
+	r.HandleFunc("/draw/{opID}/revisions/{rev}/restore", drawRevisionRestoreRoute).Methods("POST")
+
 	// links
 	r.HandleFunc("/draw/{opID}/link/{link}", drawLinkFetch).Methods("GET")
 	r.HandleFunc("/draw/{opID}/link/{link}/color", drawLinkColorRoute).Methods("POST")
@@ -94,6 +116,7 @@ func setupAuthRoutes(r *mux.Router) {
 	r.HandleFunc("/draw/{opID}/link/{link}/delta", drawLinkDeltaRoute).Methods("POST")          // deprecated, use task
 
 	// markers
+	r.HandleFunc("/markertypes", markerTypesRoute).Methods("GET")
 	r.HandleFunc("/draw/{opID}/marker/{marker}", drawMarkerFetch).Methods("GET")
 	r.HandleFunc("/draw/{opID}/marker/{marker}/assign", drawMarkerAssignRoute).Methods("POST")          // deprecated, use task
 	r.HandleFunc("/draw/{opID}/marker/{marker}/comment", drawMarkerCommentRoute).Methods("POST")        // deprecated, use task
@@ -109,26 +132,43 @@ func setupAuthRoutes(r *mux.Router) {
 	r.HandleFunc("/draw/{opID}/portal/{portal}/comment", drawPortalCommentRoute).Methods("POST", "PUT")   // prefer PUT
 	r.HandleFunc("/draw/{opID}/portal/{portal}/hardness", drawPortalHardnessRoute).Methods("POST", "PUT") // prefer PUT
 	r.HandleFunc("/draw/{opID}/portal/{portal}/keyonhand", drawPortalKeysRoute).Methods("POST", "PUT")    // prefer PUT
+	r.HandleFunc("/draw/{opID}/portal/{portal}/sbul", drawPortalSBULRoute).Methods("PUT")
+	r.HandleFunc("/portals/search", portalSearchRoute).Methods("GET")
 
 	// tasks -- TODO unify between markers, links and generic tasks -- note changes from POST/GET to PUT
+	r.HandleFunc("/draw/{opID}/task", drawTaskAddRoute).Methods("POST")                                     // generic task JSON
 	r.HandleFunc("/draw/{opID}/task/{taskID}", drawTaskFetch).Methods("GET")                                // none
+	r.HandleFunc("/draw/{opID}/task/{taskID}", drawTaskUpdateRoute).Methods("PUT")                          // generic task JSON
+	r.HandleFunc("/draw/{opID}/task/{taskID}", drawTaskDeleteRoute).Methods("DELETE")                       // none
 	r.HandleFunc("/draw/{opID}/task/{taskID}/order", drawTaskOrderRoute).Methods("PUT")                     // order int16
 	r.HandleFunc("/draw/{opID}/task/{taskID}/assign", drawTaskAssignRoute).Methods("PUT")                   // assign []GoogleID
 	r.HandleFunc("/draw/{opID}/task/{taskID}/assign", drawTaskAssignRoute).Methods("DELETE")                // none
 	r.HandleFunc("/draw/{opID}/task/{taskID}/comment", drawTaskCommentRoute).Methods("PUT")                 // none
-	r.HandleFunc("/draw/{opID}/task/{taskID}/complete", drawTaskCompleteRoute).Methods("PUT")               // none
+	r.HandleFunc("/draw/{opID}/task/{taskID}/complete", drawTaskCompleteRoute).Methods("PUT")               // force bool, to complete with incomplete dependencies
 	r.HandleFunc("/draw/{opID}/task/{taskID}/acknowledge", drawTaskAcknowledgeRoute).Methods("PUT")         // none
 	r.HandleFunc("/draw/{opID}/task/{taskID}/incomplete", drawTaskIncompleteRoute).Methods("PUT")           // none
 	r.HandleFunc("/draw/{opID}/task/{taskID}/reject", drawTaskRejectRoute).Methods("PUT")                   // none
 	r.HandleFunc("/draw/{opID}/task/{taskID}/claim", drawTaskClaimRoute).Methods("PUT")                     // none
 	r.HandleFunc("/draw/{opID}/task/{taskID}/zone", drawTaskZoneRoute).Methods("PUT")                       // zone uint8
 	r.HandleFunc("/draw/{opID}/task/{taskID}/delta", drawTaskDeltaRoute).Methods("PUT")                     // delta int64
+	r.HandleFunc("/draw/{opID}/task/{taskID}/history", drawTaskHistoryRoute).Methods("GET")                 // none
 	r.HandleFunc("/draw/{opID}/task/{taskID}/depend/{dependsOn}", drawTaskDependAddRoute).Methods("PUT")    // none
 	r.HandleFunc("/draw/{opID}/task/{taskID}/depend/{dependsOn}", drawTaskDependDelRoute).Methods("DELETE") // none
+	r.HandleFunc("/draw/{opID}/tasks/ready", drawTasksReadyRoute).Methods("GET")
+	r.HandleFunc("/draw/{opID}/progress", drawProgressRoute).Methods("GET")
+	r.HandleFunc("/draw/{opID}/stats", drawStatsRoute).Methods("GET")
+	r.HandleFunc("/draw/{opID}/tasks/history", drawTasksHistoryRoute).Methods("GET")
+	r.HandleFunc("/draw/{opID}/tasks/bulk", drawTasksBulkRoute).Methods("POST")
+	r.HandleFunc("/draw/{opID}/autoassign", drawAutoAssignRoute).Methods("POST")
 
 	r.HandleFunc("/me", meSetAgentLocationRoute).Methods("GET", "PUT").Queries("lat", "{lat}", "lon", "{lon}") // prefer PUT
 	r.HandleFunc("/me", meRoute).Methods("GET", "POST", "HEAD")
 	r.HandleFunc("/me/delete", meDeleteRoute).Methods("DELETE")                                     // purge all info for a agent, requires query token
+	r.HandleFunc("/me/trash", meTrashRoute).Methods("GET")                                          // deleted ops which can be restored
+	r.HandleFunc("/me/calendar", meCalendarTokenRoute).Methods("GET")                               // feed URLs, creating the token if needed
+	r.HandleFunc("/me/calendar", meNewCalendarTokenRoute).Methods("PUT")                            // replace the token, old feed URLs stop working
+	r.HandleFunc("/me/calendar", meRevokeCalendarTokenRoute).Methods("DELETE")                      // remove the token, feed URLs stop working
+	r.HandleFunc("/me/ops/nearby", meNearbyOpsRoute).Methods("GET")                                 // readable ops around a location
 	r.HandleFunc("/me/{team}", meToggleTeamRoute).Methods("GET", "PUT").Queries("state", "{state}") // prefer PUT
 	r.HandleFunc("/me/{team}", meRemoveTeamRoute).Methods("DELETE")
 	r.HandleFunc("/me/{team}/delete", meRemoveTeamRoute).Methods("GET")                                            // deprecated, use DELETE /me/{team}
@@ -44,6 +44,11 @@ func (o *Operation) ReadAccess(gid GoogleID) (bool, []Zone) {
 	var zones []Zone
 	var permitted bool
 
+	// ops in the trash are only visible via the trash
+	if o.ID.IsDeletedOp() {
+		return false, zones
+	}
+
 	if o.ID.IsOwner(gid) {
 		zones = append(zones, ZoneAll)
 		return true, zones
@@ -79,6 +84,10 @@ func (o *Operation) ReadAccess(gid GoogleID) (bool, []Zone) {
 
 // WriteAccess determines if an agent has write access to an op
 func (o *Operation) WriteAccess(gid GoogleID) bool {
+	if o.ID.IsDeletedOp() {
+		return false
+	}
+
 	if o.ID.IsOwner(gid) {
 		return true
 	}
@@ -145,6 +154,10 @@ func (opID OperationID) Chown(gid GoogleID, to string) error {
 
 // AssignedOnlyAccess verifies if an agent has AO access to an op
 func (o *Operation) AssignedOnlyAccess(gid GoogleID) bool {
+	if o.ID.IsDeletedOp() {
+		return false
+	}
+
 	if err := o.PopulateTeams(); err != nil {
 		log.Error(err)
 		return false
@@ -269,3 +282,22 @@ func (opID OperationID) Teams() ([]TeamID, error) {
 	}
 	return teams, nil
 }
+
+// fullReadOps lists the ops for which gid can see every portal, used for searching portal data across ops
+// archived ops are included, their portal data is still useful
+func (gid GoogleID) fullReadOps() ([]OperationID, error) {
+	var ops []OperationID
+
+	ad := Agent{GoogleID: gid}
+	if err := adOps(&ad, true); err != nil {
+		return ops, err
+	}
+
+	for _, adop := range ad.Ops {
+		o := Operation{ID: adop.ID}
+		if read, zones := o.ReadAccess(gid); read && ZoneAll.inZones(zones) {
+			ops = append(ops, adop.ID)
+		}
+	}
+	return ops, nil
+}
@@ -61,6 +61,7 @@ type AdOperation struct {
 	Modified   string
 	LastEditID string
 	IsOwner    bool
+	State      OpState
 }
 
 // AgentID is anything that can be converted to a GoogleID or a string
@@ -134,7 +135,7 @@ func (gid GoogleID) GetAgent() (*Agent, error) {
 		return &a, err
 	}
 
-	if err = adOps(&a); err != nil {
+	if err = adOps(&a, false); err != nil {
 		return &a, err
 	}
 
@@ -216,10 +217,11 @@ func adTelegram(ad *Agent) error {
 	return nil
 }
 
-func adOps(ad *Agent) error {
+// adOps fills in the ops the agent owns or can see through a team, archived ops are only included if archived is set
+func adOps(ad *Agent, archived bool) error {
 	seen := make(map[OperationID]bool)
 
-	rowOwned, err := db.Query("SELECT ID, Name, Color, modified, lasteditid FROM operation WHERE gid = ?", ad.GoogleID)
+	rowOwned, err := db.Query("SELECT ID, Name, Color, modified, lasteditid, state FROM operation WHERE gid = ? AND (? OR state != 'archived') AND ID NOT IN (SELECT opID FROM deletedops)", ad.GoogleID, archived)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -228,7 +230,7 @@ func adOps(ad *Agent) error {
 
 	for rowOwned.Next() {
 		var op AdOperation
-		err := rowOwned.Scan(&op.ID, &op.Name, &op.Color, &op.Modified, &op.LastEditID)
+		err := rowOwned.Scan(&op.ID, &op.Name, &op.Color, &op.Modified, &op.LastEditID, &op.State)
 		if err != nil {
 			log.Error(err)
 			return err
@@ -241,7 +243,7 @@ func adOps(ad *Agent) error {
 		seen[op.ID] = true
 	}
 
-	rowTeam, err := db.Query("SELECT operation.ID, operation.Name, operation.Color, permissions.teamID, operation.modified, operation.lasteditid FROM agentteams JOIN permissions ON agentteams.teamID = permissions.teamID JOIN operation ON permissions.opID = operation.ID WHERE agentteams.gid = ?", ad.GoogleID)
+	rowTeam, err := db.Query("SELECT operation.ID, operation.Name, operation.Color, permissions.teamID, operation.modified, operation.lasteditid, operation.state FROM agentteams JOIN permissions ON agentteams.teamID = permissions.teamID JOIN operation ON permissions.opID = operation.ID WHERE agentteams.gid = ? AND (? OR operation.state != 'archived') AND operation.ID NOT IN (SELECT opID FROM deletedops)", ad.GoogleID, archived)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -250,7 +252,7 @@ func adOps(ad *Agent) error {
 
 	for rowTeam.Next() {
 		var op AdOperation
-		err := rowTeam.Scan(&op.ID, &op.Name, &op.Color, &op.TeamID, &op.Modified, &op.LastEditID)
+		err := rowTeam.Scan(&op.ID, &op.Name, &op.Color, &op.TeamID, &op.Modified, &op.LastEditID, &op.State)
 		if err != nil {
 			log.Error(err)
 			return err
@@ -264,6 +266,12 @@ func adOps(ad *Agent) error {
 	return nil
 }
 
+// IncludeArchivedOps replaces the agent's op list with one which includes archived ops
+func (a *Agent) IncludeArchivedOps() error {
+	a.Ops = nil
+	return adOps(a, true)
+}
+
 // SetLocation updates the database to reflect a agent's current location
 func (gid GoogleID) SetLocation(lat, lon string) error {
 	if lat == "" || lon == "" {
@@ -467,6 +475,7 @@ func (gid GoogleID) Delete() error {
 	_, _ = db.Exec("DELETE FROM telegram WHERE gid = ?", gid)
 	_, _ = db.Exec("DELETE FROM firebase WHERE gid = ?", gid)
 	_, _ = db.Exec("DELETE FROM rocks WHERE gid = ?", gid)
+	_, _ = db.Exec("DELETE FROM calendartoken WHERE gid = ?", gid)
 
 	return nil
 }
@@ -0,0 +1,415 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// AutoAssignment is a single proposed assignment
+type AutoAssignment struct {
+	Task   TaskID   `json:"task"`
+	Agent  GoogleID `json:"gid"`
+	Reason string   `json:"reason"`
+}
+
+// AutoAssignProposal is the set of assignments autoassign would make, it is not applied until committed
+// the proposal is only valid while the op remains at LastEditID
+type AutoAssignProposal struct {
+	ID          OperationID      `json:"opID"`
+	LastEditID  string           `json:"lasteditid"`
+	Assignments []AutoAssignment `json:"assignments"`
+	Unassigned  []TaskID         `json:"unassigned"` // tasks no agent on the op's teams can be given
+}
+
+// assignee is an agent on one of the op's teams, as considered by autoassign
+type assignee struct {
+	gid   GoogleID
+	zones []Zone
+	lat   float64
+	lon   float64
+	known bool // location is known
+	load  int
+}
+
+// assignGroup is a set of tasks which must go to the same agent
+type assignGroup struct {
+	tasks []TaskID
+	zones []Zone // every zone the agent must be able to see
+	order int16
+	lat   float64
+	lon   float64
+	known bool       // location is known
+	keys  []PortalID // portals the agent needs a key for
+	agent GoogleID   // set if part of the group is already assigned
+}
+
+// AutoAssign proposes assignments for the unassigned tasks in the op
+// agents must be permitted to see the task's zone; links thrown from one portal are kept together;
+// agents holding the keys the tasks need are preferred, then the nearest, while the load is kept even
+func (o *Operation) AutoAssign(gid GoogleID) (*AutoAssignProposal, error) {
+	if !o.WriteAccess(gid) {
+		err := fmt.Errorf("write access denied to op: %s", o.ID)
+		log.Error(err)
+		return nil, err
+	}
+	if err := o.Populate(gid); err != nil {
+		return nil, err
+	}
+
+	p := AutoAssignProposal{
+		ID:          o.ID,
+		LastEditID:  o.LastEditID,
+		Assignments: make([]AutoAssignment, 0),
+		Unassigned:  make([]TaskID, 0),
+	}
+
+	agents, err := o.assignees()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[PortalID]map[GoogleID]bool)
+	for _, k := range o.Keys {
+		if k.Onhand < 1 {
+			continue
+		}
+		if _, ok := keys[k.ID]; !ok {
+			keys[k.ID] = make(map[GoogleID]bool)
+		}
+		keys[k.ID][k.Gid] = true
+	}
+
+	groups, total := o.assignGroups(agents)
+	if len(agents) == 0 {
+		for _, g := range groups {
+			p.Unassigned = append(p.Unassigned, g.tasks...)
+		}
+		return &p, nil
+	}
+
+	// no agent takes more than an even share unless everyone eligible is full
+	capacity := int(math.Ceil(float64(total) / float64(len(agents))))
+
+	for _, g := range groups {
+		a := pickAssignee(g, agents, keys, capacity)
+		if a == nil {
+			p.Unassigned = append(p.Unassigned, g.tasks...)
+			continue
+		}
+		a.load += len(g.tasks)
+
+		reason := "chain"
+		if a.gid != g.agent {
+			reason = "nearest"
+			if !g.known || !a.known {
+				reason = "load"
+			}
+			if len(g.keys) > 0 && a.missingKeys(g.keys, keys) == 0 {
+				reason = "keys"
+			}
+		}
+		for _, t := range g.tasks {
+			p.Assignments = append(p.Assignments, AutoAssignment{Task: t, Agent: a.gid, Reason: reason})
+		}
+	}
+	return &p, nil
+}
+
+// Actions converts the proposal to bulk task actions
+func (p *AutoAssignProposal) Actions() ([]TaskAction, error) {
+	actions := make([]TaskAction, 0, len(p.Assignments))
+	for _, a := range p.Assignments {
+		value, err := json.Marshal([]GoogleID{a.Agent})
+		if err != nil {
+			log.Error(err)
+			return actions, err
+		}
+		actions = append(actions, TaskAction{Task: a.Task, Action: "assign", Value: value})
+	}
+	return actions, nil
+}
+
+// CommitAutoAssign applies a proposal in a single transaction, it is refused if the op changed since it was made
+// the proposal may have come back from the client, so each assignment is checked against the op's current teams
+func CommitAutoAssign(ctx context.Context, gid GoogleID, p *AutoAssignProposal) (string, error) {
+	if len(p.Assignments) == 0 {
+		return "", errors.New("nothing to assign")
+	}
+
+	o := Operation{ID: p.ID}
+	if !o.WriteAccess(gid) {
+		err := fmt.Errorf("write access denied to op: %s", o.ID)
+		log.Error(err)
+		return "", err
+	}
+	if err := o.Populate(gid); err != nil {
+		return "", err
+	}
+	if o.LastEditID != p.LastEditID {
+		return "", &OpConflictError{LastEditID: o.LastEditID}
+	}
+	if err := o.checkAutoAssignments(p.Assignments); err != nil {
+		log.Infow("refusing autoassign", "GID", gid, "resource", o.ID, "reason", err.Error())
+		return "", err
+	}
+
+	actions, err := p.Actions()
+	if err != nil {
+		return "", err
+	}
+	return BulkTasks(ctx, p.ID, gid, actions, p.LastEditID)
+}
+
+// checkAutoAssignments refuses assignments of tasks not in the populated op, or to agents who are not on its teams or cannot see the task's zone
+func (o *Operation) checkAutoAssignments(assignments []AutoAssignment) error {
+	agents, err := o.assignees()
+	if err != nil {
+		return err
+	}
+	byGID := make(map[GoogleID]*assignee)
+	for _, a := range agents {
+		byGID[a.gid] = a
+	}
+
+	zones := make(map[TaskID]Zone)
+	for _, l := range o.Links {
+		zones[l.Task.ID] = l.Zone
+	}
+	for _, m := range o.Markers {
+		zones[m.Task.ID] = m.Zone
+	}
+	for _, t := range o.Tasks {
+		zones[t.Task.ID] = t.Zone
+	}
+
+	for i, a := range assignments {
+		z, ok := zones[a.Task]
+		if !ok {
+			return &PatchError{Index: i, Reason: ErrTaskNotFound}
+		}
+		if agent, ok := byGID[a.Agent]; !ok || !agent.canSee([]Zone{z}) {
+			return &PatchError{Index: i, Reason: fmt.Sprintf("agent %s may not be assigned task %s", a.Agent, a.Task)}
+		}
+	}
+	return nil
+}
+
+// assignees lists the agents on the op's teams, with the zones they may see and their last known location
+func (o *Operation) assignees() ([]*assignee, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	am, err := allOpAgents(o.Teams, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	agents := make([]*assignee, 0, len(am))
+	for agent := range am {
+		a := assignee{gid: agent}
+		for _, t := range o.Teams {
+			if inteam, _ := agent.AgentInTeam(t.TeamID); !inteam {
+				continue
+			}
+			switch t.Role {
+			case opPermRoleRead:
+				a.zones = append(a.zones, t.Zone)
+			case opPermRoleWrite, opPermRoleAssignedOnly:
+				// assigned-only agents see whatever they are given
+				a.zones = append(a.zones, ZoneAll)
+			}
+		}
+
+		var lat, lon float64
+		if err := db.QueryRow("SELECT Y(loc), X(loc) FROM locations WHERE gid = ?", agent).Scan(&lat, &lon); err == nil && (lat != 0 || lon != 0) {
+			a.lat, a.lon, a.known = lat, lon, true
+		}
+		agents = append(agents, &a)
+	}
+
+	// deterministic proposals
+	sort.Slice(agents, func(i, j int) bool { return agents[i].gid < agents[j].gid })
+	return agents, nil
+}
+
+// assignGroups collects the unassigned tasks into groups which go to a single agent, in op order
+// assigned tasks are counted against their agents' load; returns the groups and the total number of tasks
+func (o *Operation) assignGroups(agents []*assignee) ([]*assignGroup, int) {
+	byGID := make(map[GoogleID]*assignee)
+	for _, a := range agents {
+		byGID[a.gid] = a
+	}
+
+	portals := make(map[PortalID]Portal)
+	for _, p := range o.OpPortals {
+		portals[p.ID] = p
+	}
+	locate := func(g *assignGroup, portalID PortalID) {
+		if p, ok := portals[portalID]; ok {
+			g.lat, g.lon, g.known = parseLatLon(p.Lat, p.Lon)
+		}
+	}
+
+	total := 0
+	current := func(t Task) bool {
+		if t.State == "completed" {
+			return false
+		}
+		total++
+		if len(t.Assignments) == 0 {
+			return true
+		}
+		for _, gid := range t.Assignments {
+			if a, ok := byGID[gid]; ok {
+				a.load++
+			}
+		}
+		return false
+	}
+
+	var groups []*assignGroup
+
+	// links are grouped by source portal, an agent already throwing from the portal keeps the chain
+	chains := make(map[PortalID]*assignGroup)
+	owners := make(map[PortalID]GoogleID)
+	for _, l := range o.Links {
+		if !current(l.Task) {
+			if len(l.Assignments) > 0 && l.State != "completed" {
+				owners[l.From] = l.Assignments[0]
+			}
+			continue
+		}
+		g, ok := chains[l.From]
+		if !ok {
+			g = &assignGroup{order: l.Order}
+			locate(g, l.From)
+			chains[l.From] = g
+			groups = append(groups, g)
+		}
+		g.tasks = append(g.tasks, l.Task.ID)
+		g.zones = append(g.zones, l.Zone)
+		g.keys = append(g.keys, l.To)
+		if l.Order < g.order {
+			g.order = l.Order
+		}
+	}
+	for from, g := range chains {
+		if agent, ok := owners[from]; ok {
+			g.agent = agent
+		}
+	}
+
+	for _, m := range o.Markers {
+		if !current(m.Task) {
+			continue
+		}
+		g := &assignGroup{tasks: []TaskID{m.Task.ID}, zones: []Zone{m.Zone}, order: m.Order}
+		locate(g, m.PortalID)
+		groups = append(groups, g)
+	}
+
+	for i := range o.Tasks {
+		t := &o.Tasks[i]
+		if !current(t.Task) {
+			continue
+		}
+		g := &assignGroup{tasks: []TaskID{t.Task.ID}, zones: []Zone{t.Zone}, order: t.Order}
+		if lat, lon, ok := t.location(); ok {
+			g.lat, g.lon, g.known = lat, lon, true
+		} else if t.PortalID != "" {
+			locate(g, t.PortalID)
+		}
+		groups = append(groups, g)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].order < groups[j].order })
+	return groups, total
+}
+
+// pickAssignee chooses the agent for a group: fewest missing keys, then nearest, then least loaded
+// agents at capacity are only used if every eligible agent is at capacity
+func pickAssignee(g *assignGroup, agents []*assignee, keys map[PortalID]map[GoogleID]bool, capacity int) *assignee {
+	var eligible []*assignee
+	for _, a := range agents {
+		if a.canSee(g.zones) {
+			eligible = append(eligible, a)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+
+	if g.agent != "" {
+		for _, a := range eligible {
+			if a.gid == g.agent {
+				return a
+			}
+		}
+	}
+
+	var open []*assignee
+	for _, a := range eligible {
+		if a.load < capacity {
+			open = append(open, a)
+		}
+	}
+	if len(open) == 0 {
+		open = eligible
+	}
+
+	var best *assignee
+	var bestMissing int
+	var bestDist float64
+	for _, a := range open {
+		missing := a.missingKeys(g.keys, keys)
+		dist := math.Inf(1)
+		if g.known && a.known {
+			dist = util.Distance(g.lat, g.lon, a.lat, a.lon)
+		}
+
+		switch {
+		case best == nil,
+			missing < bestMissing,
+			missing == bestMissing && dist < bestDist,
+			missing == bestMissing && dist == bestDist && a.load < best.load:
+			best, bestMissing, bestDist = a, missing, dist
+		}
+	}
+	return best
+}
+
+// canSee reports if the agent may see every one of the zones
+func (a *assignee) canSee(zones []Zone) bool {
+	for _, z := range zones {
+		if !z.inZones(a.zones) {
+			return false
+		}
+	}
+	return true
+}
+
+// missingKeys counts the portals for which the agent has no keys
+func (a *assignee) missingKeys(need []PortalID, keys map[PortalID]map[GoogleID]bool) int {
+	missing := 0
+	for _, p := range need {
+		if !keys[p][a.gid] {
+			missing++
+		}
+	}
+	return missing
+}
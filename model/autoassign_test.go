@@ -0,0 +1,64 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestPickAssignee(t *testing.T) {
+	agents := func() []*assignee {
+		return []*assignee{
+			{gid: "near", zones: []Zone{ZoneAll}, lat: 0, lon: 0.01, known: true},
+			{gid: "far", zones: []Zone{ZoneAll}, lat: 0, lon: 1, known: true},
+			{gid: "zone2", zones: []Zone{2}, lat: 0, lon: 0, known: true},
+		}
+	}
+	none := make(map[PortalID]map[GoogleID]bool)
+
+	g := &assignGroup{zones: []Zone{1}, lat: 0, lon: 0, known: true}
+	if a := pickAssignee(g, agents(), none, 10); a == nil || a.gid != "near" {
+		t.Errorf("nearest eligible agent not chosen: %v", a)
+	}
+
+	// only agents who can see the zone are eligible, even if nearer
+	g = &assignGroup{zones: []Zone{2}, lat: 0, lon: 0, known: true}
+	if a := pickAssignee(g, []*assignee{agents()[2]}, none, 10); a == nil || a.gid != "zone2" {
+		t.Errorf("agent limited to the zone not chosen: %v", a)
+	}
+	if a := pickAssignee(&assignGroup{zones: []Zone{3}}, []*assignee{agents()[2]}, none, 10); a != nil {
+		t.Errorf("agent who cannot see the zone chosen: %v", a)
+	}
+
+	// holding the keys beats being nearer
+	keys := map[PortalID]map[GoogleID]bool{"p1": {"far": true}}
+	g = &assignGroup{zones: []Zone{1}, lat: 0, lon: 0, known: true, keys: []PortalID{"p1"}}
+	if a := pickAssignee(g, agents(), keys, 10); a == nil || a.gid != "far" {
+		t.Errorf("agent with the keys not chosen: %v", a)
+	}
+
+	// agents at capacity are passed over while others have room
+	as := agents()
+	as[0].load = 2
+	g = &assignGroup{zones: []Zone{1}, lat: 0, lon: 0, known: true}
+	if a := pickAssignee(g, as, none, 2); a == nil || a.gid != "far" {
+		t.Errorf("agent at capacity chosen: %v", a)
+	}
+	as[1].load = 2
+	if a := pickAssignee(g, as, none, 2); a == nil || a.gid != "near" {
+		t.Errorf("nearest agent not chosen when all are at capacity: %v", a)
+	}
+
+	// a partly assigned chain stays with its agent
+	g = &assignGroup{zones: []Zone{1}, lat: 0, lon: 0, known: true, agent: "far"}
+	if a := pickAssignee(g, agents(), none, 10); a == nil || a.gid != "far" {
+		t.Errorf("chain not kept with its agent: %v", a)
+	}
+
+	// without locations the least loaded agent is chosen
+	as = agents()
+	as[0].load = 3
+	as[1].load = 1
+	g = &assignGroup{zones: []Zone{1}}
+	if a := pickAssignee(g, as[:2], none, 10); a == nil || a.gid != "far" {
+		t.Errorf("least loaded agent not chosen: %v", a)
+	}
+}
@@ -0,0 +1,170 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// SetAutoZone turns automatic zone membership on or off for an op, only the owner may do this
+// when turned on the zones are computed immediately
+func (opID OperationID) SetAutoZone(gid GoogleID, enabled bool) error {
+	if !opID.IsOwner(gid) {
+		err := errors.New(ErrNotOpOwner)
+		log.Warnw(err.Error(), "GID", gid, "resource", opID)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && err != sql.ErrTxDone {
+			log.Error(err)
+		}
+	}()
+
+	if err := opID.checkWritable(tx); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE operation SET autozone = ? WHERE ID = ?", enabled, opID); err != nil {
+		log.Error(err)
+		return err
+	}
+	opID.logChange(changeOp, string(opID), changeChange, tx)
+
+	if err := opID.applyAutoZones(gid, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// autoZone is a zone with enough points to be a polygon
+type autoZone struct {
+	zone   Zone
+	points []zonepoint
+}
+
+// applyAutoZones sets the zone of each link and marker from the zone polygon containing its portal, links use the source portal
+// it does nothing unless autozone is set on the op; tasks outside every polygon keep the zone they have
+// where polygons overlap the lowest numbered zone wins
+func (opID OperationID) applyAutoZones(gid GoogleID, tx *sql.Tx) error {
+	var enabled bool
+	if err := tx.QueryRow("SELECT autozone FROM operation WHERE ID = ?", opID).Scan(&enabled); err != nil {
+		log.Error(err)
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+
+	zones, err := opID.autoZones(tx)
+	if err != nil {
+		return err
+	}
+	if len(zones) == 0 {
+		return nil
+	}
+
+	type located struct {
+		id   TaskID
+		zone Zone
+		lat  float64
+		lon  float64
+	}
+	var tasks []located
+
+	rows, err := tx.Query("SELECT task.ID, task.zone, Y(COALESCE(portalcatalog.loc, portal.loc)), X(COALESCE(portalcatalog.loc, portal.loc)) FROM task JOIN link ON task.ID = link.ID AND task.opID = link.opID JOIN portal ON link.fromPortalID = portal.ID AND link.opID = portal.opID "+catalogJoin+" WHERE task.opID = ? "+
+		"UNION ALL SELECT task.ID, task.zone, Y(COALESCE(portalcatalog.loc, portal.loc)), X(COALESCE(portalcatalog.loc, portal.loc)) FROM task JOIN marker ON task.ID = marker.ID AND task.opID = marker.opID JOIN portal ON marker.PortalID = portal.ID AND marker.opID = portal.opID "+catalogJoin+" WHERE task.opID = ?", opID, opID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	for rows.Next() {
+		var l located
+		if err := rows.Scan(&l.id, &l.zone, &l.lat, &l.lon); err != nil {
+			log.Error(err)
+			continue
+		}
+		tasks = append(tasks, l)
+	}
+	rows.Close()
+
+	for _, l := range tasks {
+		for _, z := range zones {
+			if !z.contains(l.lat, l.lon) {
+				continue
+			}
+			if z.zone != l.zone {
+				if _, err := tx.Exec("UPDATE task SET zone = ? WHERE ID = ? AND opID = ?", z.zone, l.id, opID); err != nil {
+					log.Error(err)
+					return err
+				}
+				t := Task{ID: l.id, opID: opID}
+				opID.logChange(changeTask, string(l.id), changeChange, tx)
+				t.logEvent(gid, taskEventZone, strconv.Itoa(int(l.zone)), strconv.Itoa(int(z.zone)), tx)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// autoZones loads the op's zone polygons, lowest zone first
+func (opID OperationID) autoZones(tx *sql.Tx) ([]autoZone, error) {
+	byZone := make(map[Zone]*autoZone)
+
+	rows, err := tx.Query("SELECT zoneID, position, X(point), Y(point) FROM zonepoints WHERE opID = ? ORDER BY zoneID, position", opID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var z Zone
+		var p zonepoint
+		if err := rows.Scan(&z, &p.Position, &p.Lat, &p.Lon); err != nil {
+			log.Error(err)
+			continue
+		}
+		if _, ok := byZone[z]; !ok {
+			byZone[z] = &autoZone{zone: z}
+		}
+		byZone[z].points = append(byZone[z].points, p)
+	}
+
+	zones := make([]autoZone, 0, len(byZone))
+	for _, z := range byZone {
+		if len(z.points) < 3 {
+			continue
+		}
+		zones = append(zones, *z)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].zone < zones[j].zone })
+	return zones, nil
+}
+
+// contains reports if the point is inside the zone's polygon, by ray casting
+func (z *autoZone) contains(lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(z.points)-1; i < len(z.points); j, i = i, i+1 {
+		pi, pj := z.points[i], z.points[j]
+		if (pi.Lat > lat) != (pj.Lat > lat) && lon < (pj.Lon-pi.Lon)*(lat-pi.Lat)/(pj.Lat-pi.Lat)+pi.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
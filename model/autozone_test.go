@@ -0,0 +1,54 @@
+package model
+
+import (
+	"math"
+	"testing"
+)
+
+func square() *autoZone {
+	return &autoZone{zone: 1, points: []zonepoint{
+		{Position: 0, Lat: 0, Lon: 0},
+		{Position: 1, Lat: 0, Lon: 1},
+		{Position: 2, Lat: 1, Lon: 1},
+		{Position: 3, Lat: 1, Lon: 0},
+	}}
+}
+
+func TestAutoZoneContains(t *testing.T) {
+	z := square()
+	tests := []struct {
+		lat, lon float64
+		inside   bool
+	}{
+		{0.5, 0.5, true},
+		{0.01, 0.99, true},
+		{1.5, 0.5, false},
+		{0.5, -0.5, false},
+		{-0.5, -0.5, false},
+	}
+	for _, tt := range tests {
+		if got := z.contains(tt.lat, tt.lon); got != tt.inside {
+			t.Errorf("contains(%f, %f) = %v, want %v", tt.lat, tt.lon, got, tt.inside)
+		}
+	}
+
+	// concave: an L shape does not contain its missing corner
+	l := &autoZone{zone: 2, points: []zonepoint{
+		{Lat: 0, Lon: 0}, {Lat: 0, Lon: 2}, {Lat: 1, Lon: 2}, {Lat: 1, Lon: 1}, {Lat: 2, Lon: 1}, {Lat: 2, Lon: 0},
+	}}
+	if !l.contains(1.5, 0.5) || l.contains(1.5, 1.5) {
+		t.Error("concave zone membership is wrong")
+	}
+}
+
+func TestAutoZoneDistance(t *testing.T) {
+	z := square()
+	if d := z.distance(0.5, 0.5); d != 0 {
+		t.Errorf("distance from inside is %f", d)
+	}
+
+	// 0.1 degrees of latitude south of the bottom edge is about 11.1 km
+	if d := z.distance(-0.1, 0.5); math.Abs(d-11119) > 50 {
+		t.Errorf("distance below the zone is %f", d)
+	}
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// Blocker is a known enemy link which must be cleared before the planned links can be thrown
+// the portals of a blocker must be in the op's portal list
+type Blocker struct {
+	ID   string   `json:"ID"`
+	From PortalID `json:"fromPortalId"`
+	To   PortalID `json:"toPortalId"`
+}
+
+// setBlockers replaces the op's blockers, blockers on unknown portals are dropped
+func (opID OperationID) setBlockers(blockers []Blocker, portals map[PortalID]bool, tx *sql.Tx) error {
+	if _, err := tx.Exec("DELETE FROM blocker WHERE opID = ?", opID); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	for _, b := range blockers {
+		if b.From == b.To || !portals[b.From] || !portals[b.To] {
+			log.Infow("ignoring blocker on unknown portal", "resource", opID, "from", b.From, "to", b.To)
+			continue
+		}
+		if b.ID == "" {
+			b.ID = util.GenerateID(40)
+		}
+
+		if _, err := tx.Exec("INSERT IGNORE INTO blocker (ID, opID, fromPortalID, toPortalID) VALUES (?, ?, ?, ?)", b.ID, opID, b.From, b.To); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// populateBlockers fills in the Blockers list for the Operation. No authorization takes place.
+func (o *Operation) populateBlockers() error {
+	rows, err := db.Query("SELECT ID, fromPortalID, toPortalID FROM blocker WHERE opID = ?", o.ID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer rows.Close()
+
+	o.Blockers = make([]Blocker, 0)
+	for rows.Next() {
+		var b Blocker
+		if err := rows.Scan(&b.ID, &b.From, &b.To); err != nil {
+			log.Error(err)
+			continue
+		}
+		o.Blockers = append(o.Blockers, b)
+	}
+	return nil
+}
+
+// blockersChanged reports if two lists of blockers cover different portal pairs
+func blockersChanged(a, b []Blocker) bool {
+	pairs := func(bl []Blocker) []string {
+		var s []string
+		for _, x := range bl {
+			s = append(s, string(x.From)+":"+string(x.To))
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	pa, pb := pairs(a), pairs(b)
+	if len(pa) != len(pb) {
+		return true
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			return true
+		}
+	}
+	return false
+}
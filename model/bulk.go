@@ -0,0 +1,254 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/messaging"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// TaskAction is a single change in a bulk task update
+// Value is a list of GoogleIDs for assign, a number for zone, order and delta, a string for comment and state; clear takes no value
+type TaskAction struct {
+	Task   TaskID          `json:"task"`
+	Action string          `json:"action"` // assign, clear, zone, order, delta, comment, state
+	Value  json.RawMessage `json:"value"`
+}
+
+// BulkTasks applies a list of task actions to an op in a single transaction, lasteditid is bumped once
+// newly assigned agents are sent one message covering all their new tasks, rather than one per task
+// if base is set the update is refused with an *OpConflictError unless base is the current lasteditid
+// a bad action is reported as a *PatchError; returns the new lasteditid
+func BulkTasks(ctx context.Context, opID OperationID, gid GoogleID, actions []TaskAction, base string) (string, error) {
+	if opID.IsDeletedOp() {
+		err := errors.New("attempt to update a deleted opID")
+		log.Infow(err.Error(), "GID", gid, "opID", opID)
+		return "", err
+	}
+
+	o := Operation{ID: opID}
+	if !o.WriteAccess(gid) {
+		err := fmt.Errorf("write access denied to op: %s", o.ID)
+		log.Error(err)
+		return "", err
+	}
+
+	lock, err := o.ID.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+
+	var checked string
+	if base != "" {
+		if checked, err = o.checkBase(base, false, gid); err != nil {
+			return "", err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && err != sql.ErrTxDone {
+			log.Error(err)
+		}
+	}()
+
+	if base != "" {
+		if err := o.ID.checkLastEdit(checked, tx); err != nil {
+			return "", err
+		}
+	}
+	if err := o.ID.checkWritable(tx); err != nil {
+		return "", err
+	}
+
+	assigned := make(map[GoogleID][]TaskID)
+	// only tasks which were not completed before this update may make others ready
+	before := make(map[TaskID]string)
+	after := make(map[TaskID]string)
+	for i, a := range actions {
+		t := Task{ID: a.Task, opID: o.ID}
+		added, previous, err := t.applyAction(a, gid, tx)
+		if err != nil {
+			var pe *PatchError
+			if errors.As(err, &pe) {
+				pe.Index = i
+				log.Infow("refusing bulk task update", "GID", gid, "resource", o.ID, "index", i, "reason", pe.Reason)
+			}
+			return "", err
+		}
+		for _, agent := range added {
+			assigned[agent] = append(assigned[agent], t.ID)
+		}
+		if a.Action == "state" {
+			var s string
+			if json.Unmarshal(a.Value, &s) == nil {
+				if _, ok := before[t.ID]; !ok {
+					before[t.ID] = previous
+				}
+				after[t.ID] = s
+			}
+		}
+	}
+
+	updateID := util.GenerateID(40)
+	if _, err := tx.Exec("UPDATE operation SET modified = UTC_TIMESTAMP(), lasteditid = ? WHERE ID = ?", updateID, o.ID); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if err := o.ID.stampChanges(updateID, tx); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	if err := o.ID.saveRevision(gid); err != nil {
+		log.Error(err)
+		// carry on, the changes are saved
+	}
+
+	o.ID.notifyBulkAssigned(assigned)
+	for id, s := range after {
+		if s != "completed" || before[id] == "completed" {
+			continue
+		}
+		t := Task{ID: id, opID: o.ID}
+		t.notifyReady()
+	}
+	return updateID, nil
+}
+
+// applyAction makes a single bulk change to the task, returning any newly assigned agents and the task's previous state
+func (t *Task) applyAction(a TaskAction, gid GoogleID, tx *sql.Tx) ([]GoogleID, string, error) {
+	var state, comment string
+	var c sql.NullString
+	var zone Zone
+	err := tx.QueryRow("SELECT state, comment, zone FROM task WHERE ID = ? AND opID = ?", t.ID, t.opID).Scan(&state, &c, &zone)
+	if err == sql.ErrNoRows {
+		return nil, state, &PatchError{Reason: ErrTaskNotFound}
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, state, err
+	}
+	comment = c.String
+
+	if a.Action != "clear" && len(a.Value) == 0 {
+		return nil, state, &PatchError{Reason: fmt.Sprintf("value required for %s", a.Action)}
+	}
+
+	switch a.Action {
+	case "assign":
+		var gs []GoogleID
+		if err := json.Unmarshal(a.Value, &gs); err != nil {
+			return nil, state, &PatchError{Reason: err.Error()}
+		}
+		added, err := t.assign(gid, gs, tx)
+		return added, state, err
+	case "clear":
+		added, err := t.assign(gid, []GoogleID{}, tx)
+		return added, state, err
+	case "zone":
+		var z Zone
+		if err := json.Unmarshal(a.Value, &z); err != nil {
+			return nil, state, &PatchError{Reason: err.Error()}
+		}
+		if !z.Valid() || z == ZoneAll {
+			return nil, state, &PatchError{Reason: fmt.Sprintf("invalid zone: %d", z)}
+		}
+		if _, err := tx.Exec("UPDATE task SET zone = ? WHERE ID = ? AND opID = ?", z, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return nil, state, err
+		}
+		t.logEvent(gid, taskEventZone, strconv.Itoa(int(zone)), strconv.Itoa(int(z)), tx)
+	case "order":
+		var order int16
+		if err := json.Unmarshal(a.Value, &order); err != nil {
+			return nil, state, &PatchError{Reason: err.Error()}
+		}
+		if _, err := tx.Exec("UPDATE task SET taskorder = ? WHERE ID = ? AND opID = ?", order, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return nil, state, err
+		}
+	case "delta":
+		var delta int32
+		if err := json.Unmarshal(a.Value, &delta); err != nil {
+			return nil, state, &PatchError{Reason: err.Error()}
+		}
+		if _, err := tx.Exec("UPDATE task SET delta = ? WHERE ID = ? AND opID = ?", delta, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return nil, state, err
+		}
+	case "comment":
+		var s string
+		if err := json.Unmarshal(a.Value, &s); err != nil {
+			return nil, state, &PatchError{Reason: err.Error()}
+		}
+		desc := makeNullString(util.Sanitize(s))
+		if _, err := tx.Exec("UPDATE task SET comment = ? WHERE ID = ? AND opID = ?", desc, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return nil, state, err
+		}
+		t.logEvent(gid, taskEventComment, comment, desc.String, tx)
+	case "state":
+		var s string
+		if err := json.Unmarshal(a.Value, &s); err != nil {
+			return nil, state, &PatchError{Reason: err.Error()}
+		}
+		switch s {
+		case "pending", "assigned", "acknowledged", "completed":
+		default:
+			return nil, state, &PatchError{Reason: fmt.Sprintf("invalid state: %s", s)}
+		}
+		// like an upload, the operator is trusted to know the state of the op, dependencies are not checked
+		if _, err := tx.Exec("UPDATE task SET state = ? WHERE ID = ? AND opID = ?", s, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return nil, state, err
+		}
+		if s != state {
+			t.logEvent(gid, taskEventState, state, s, tx)
+		}
+	default:
+		return nil, state, &PatchError{Reason: fmt.Sprintf("unknown action: %s", a.Action)}
+	}
+
+	t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+	return nil, state, nil
+}
+
+// notifyBulkAssigned sends each newly assigned agent a single message covering all of their new tasks
+func (opID OperationID) notifyBulkAssigned(assigned map[GoogleID][]TaskID) {
+	if len(assigned) == 0 {
+		return
+	}
+
+	var name string
+	if err := db.QueryRow("SELECT name FROM operation WHERE ID = ?", opID).Scan(&name); err != nil {
+		log.Error(err)
+		name = string(opID)
+	}
+
+	for agent, tasks := range assigned {
+		msg := fmt.Sprintf("You have been assigned %d tasks in %s", len(tasks), name)
+		if len(tasks) == 1 {
+			msg = fmt.Sprintf("You have been assigned a task in %s", name)
+		}
+		if _, err := messaging.SendMessage(messaging.GoogleID(agent), msg); err != nil {
+			log.Info(err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package model
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// CalendarContentType is the MIME type of the calendar feeds
+const CalendarContentType = "text/calendar; charset=utf-8"
+
+// icsTime is the UTC form of DATE-TIME from RFC 5545
+const icsTime = "20060102T150405Z"
+
+// how long a calendar event lasts, tasks are points in time but calendars want a duration
+const calendarTaskDuration = 15 * time.Minute
+
+// CalendarToken identifies an agent's calendar feeds, calendar apps cannot log in so the token is in the feed URL
+type CalendarToken string
+
+// String is a stringer for CalendarToken
+func (ct CalendarToken) String() string {
+	return string(ct)
+}
+
+// Gid returns the agent whose calendar feeds the token opens
+func (ct CalendarToken) Gid() (GoogleID, error) {
+	var gid GoogleID
+
+	err := db.QueryRow("SELECT gid FROM calendartoken WHERE token = ?", ct).Scan(&gid)
+	if err != nil && err == sql.ErrNoRows {
+		err := errors.New(ErrInvalidCalendarToken)
+		log.Warn(err)
+		return "", err
+	}
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return gid, nil
+}
+
+// CalendarToken returns the agent's calendar feed token, creating one if the agent has none
+func (gid GoogleID) CalendarToken() (CalendarToken, error) {
+	var ct CalendarToken
+
+	err := db.QueryRow("SELECT token FROM calendartoken WHERE gid = ?", gid).Scan(&ct)
+	if err != nil && err == sql.ErrNoRows {
+		return gid.NewCalendarToken()
+	}
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return ct, nil
+}
+
+// NewCalendarToken replaces the agent's calendar feed token, feeds subscribed with the old token stop working
+func (gid GoogleID) NewCalendarToken() (CalendarToken, error) {
+	ct := CalendarToken(util.GenerateID(40))
+	if _, err := db.Exec("INSERT INTO calendartoken (gid, token) VALUES (?, ?) ON DUPLICATE KEY UPDATE token = ?, created = UTC_TIMESTAMP()", gid, ct, ct); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	log.Infow("new calendar token", "GID", gid)
+	return ct, nil
+}
+
+// RevokeCalendarToken removes the agent's calendar feed token, feeds subscribed with it stop working
+func (gid GoogleID) RevokeCalendarToken() error {
+	if _, err := db.Exec("DELETE FROM calendartoken WHERE gid = ?", gid); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infow("revoked calendar token", "GID", gid)
+	return nil
+}
+
+// Calendar returns an iCalendar feed of the incomplete tasks assigned to gid in this op, archived ops have none
+func (o *Operation) Calendar(gid GoogleID) ([]byte, error) {
+	if err := o.Populate(gid); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	calendarStart(&b, o.Name)
+	if o.State != OpStateArchived {
+		o.calendarEvents(&b, gid)
+	}
+	calendarEnd(&b)
+	return b.Bytes(), nil
+}
+
+// Calendar returns an iCalendar feed of the incomplete tasks assigned to the agent in all ops which are not archived
+func (gid GoogleID) Calendar() ([]byte, error) {
+	rows, err := db.Query("SELECT DISTINCT assignments.opID FROM assignments JOIN operation ON assignments.opID = operation.ID WHERE assignments.gid = ? AND operation.state != 'archived' AND assignments.opID NOT IN (SELECT opID FROM deletedops)", gid)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	var ops []OperationID
+	for rows.Next() {
+		var opID OperationID
+		if err := rows.Scan(&opID); err != nil {
+			log.Error(err)
+			continue
+		}
+		ops = append(ops, opID)
+	}
+	rows.Close()
+
+	var b bytes.Buffer
+	calendarStart(&b, "Wasabee")
+	for _, opID := range ops {
+		o := Operation{ID: opID}
+		if err := o.Populate(gid); err != nil {
+			// assigned on an op they can no longer see
+			continue
+		}
+		o.calendarEvents(&b, gid)
+	}
+	calendarEnd(&b)
+	return b.Bytes(), nil
+}
+
+func calendarStart(b *bytes.Buffer, name string) {
+	icsLine(b, "BEGIN:VCALENDAR")
+	icsLine(b, "VERSION:2.0")
+	icsLine(b, "PRODID:-//Wasabee//Wasabee-Server//EN")
+	icsLine(b, "CALSCALE:GREGORIAN")
+	icsLine(b, "X-WR-CALNAME:"+icsEscape(name))
+}
+
+func calendarEnd(b *bytes.Buffer) {
+	icsLine(b, "END:VCALENDAR")
+}
+
+// calendarEvents writes a VEVENT for each incomplete task in the populated op assigned to gid
+func (o *Operation) calendarEvents(b *bytes.Buffer, gid GoogleID) {
+	portals := make(map[PortalID]Portal)
+	for _, p := range o.OpPortals {
+		portals[p.ID] = p
+	}
+	stamp := time.Now().UTC().Format(icsTime)
+
+	event := func(t Task, summary string, p Portal) {
+		start, err := time.Parse(time.RFC1123, t.Scheduled)
+		if err != nil {
+			return
+		}
+		start = start.UTC()
+
+		icsLine(b, "BEGIN:VEVENT")
+		icsLine(b, fmt.Sprintf("UID:%s@%s", t.ID, o.ID))
+		icsLine(b, "DTSTAMP:"+stamp)
+		icsLine(b, "DTSTART:"+start.Format(icsTime))
+		icsLine(b, "DTEND:"+start.Add(calendarTaskDuration).Format(icsTime))
+		icsLine(b, "SUMMARY:"+icsEscape(summary))
+		if p.Name != "" {
+			icsLine(b, "LOCATION:"+icsEscape(p.Name))
+		}
+		if p.Lat != "" && p.Lon != "" {
+			icsLine(b, fmt.Sprintf("GEO:%s;%s", p.Lat, p.Lon))
+		}
+		desc := fmt.Sprintf("%s\nstep %d", o.Name, t.Order)
+		if t.Comment != "" {
+			desc = desc + "\n" + t.Comment
+		}
+		icsLine(b, "DESCRIPTION:"+icsEscape(desc))
+		icsLine(b, "END:VEVENT")
+	}
+
+	for _, l := range o.Links {
+		if l.State == "completed" || !assignedTo(l.Assignments, gid) {
+			continue
+		}
+		from, to := portals[l.From], portals[l.To]
+		event(l.Task, fmt.Sprintf("Link %s to %s", from.Name, to.Name), from)
+	}
+	for _, m := range o.Markers {
+		if m.State == "completed" || !assignedTo(m.Assignments, gid) {
+			continue
+		}
+		p := portals[m.PortalID]
+		event(m.Task, fmt.Sprintf("%s: %s", m.Type, p.Name), p)
+	}
+	for _, g := range o.Tasks {
+		if g.State == "completed" || !assignedTo(g.Assignments, gid) {
+			continue
+		}
+		p := portals[g.PortalID]
+		if p.Lat == "" {
+			// a task without a portal may still have a location
+			p.Lat, p.Lon = g.Lat, g.Lon
+		}
+		event(g.Task, g.Name, p)
+	}
+}
+
+func assignedTo(assignments []GoogleID, gid GoogleID) bool {
+	for _, a := range assignments {
+		if a == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// icsEscape escapes TEXT values as described in RFC 5545 3.3.11
+func icsEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// icsLine writes a content line, folded at 75 octets as RFC 5545 requires
+func icsLine(b *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		// do not split a multi-byte character
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // the leading space counts
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestIcsEscape(t *testing.T) {
+	tests := map[string]string{
+		"plain":          "plain",
+		"a,b;c":          `a\,b\;c`,
+		`back\slash`:     `back\\slash`,
+		"two\nlines":     `two\nlines`,
+		"crlf\r\nending": `crlf\nending`,
+	}
+	for in, want := range tests {
+		if got := icsEscape(in); got != want {
+			t.Errorf("icsEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestIcsLine(t *testing.T) {
+	var b bytes.Buffer
+	icsLine(&b, "SUMMARY:short")
+	if b.String() != "SUMMARY:short\r\n" {
+		t.Errorf("short line written as %q", b.String())
+	}
+
+	b.Reset()
+	long := "DESCRIPTION:" + strings.Repeat("x", 200)
+	icsLine(&b, long)
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+	if len(lines) < 3 {
+		t.Fatalf("long line folded into %d lines", len(lines))
+	}
+	var unfolded string
+	for i, l := range lines {
+		if len(l) > 75 {
+			t.Errorf("line %d is %d octets", i, len(l))
+		}
+		if i > 0 {
+			if !strings.HasPrefix(l, " ") {
+				t.Errorf("continuation line %d does not start with a space", i)
+			}
+			l = l[1:]
+		}
+		unfolded += l
+	}
+	if unfolded != long {
+		t.Error("unfolding does not give back the line")
+	}
+
+	// multi-byte characters are not split
+	b.Reset()
+	icsLine(&b, "SUMMARY:"+strings.Repeat("é", 100))
+	for i, l := range strings.Split(b.String(), "\r\n") {
+		if !utf8.ValidString(l) {
+			t.Errorf("line %d splits a character", i)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// changeFeedMax is the number of changed items above which a full op is sent instead of the changes
+const changeFeedMax = 500
+
+// item kinds recorded in the opchanges table
+const (
+	changeOp      = "op"
+	changePortal  = "portal"
+	changeLink    = "link"
+	changeMarker  = "marker"
+	changeTask    = "task" // a link, marker or generic task, resolved when the feed is built
+	changeZone    = "zone"
+	changeKey     = "key"     // itemID is the portalID
+	changeBlocker = "blocker" // itemID is the opID, blockers are always sent as a complete list
+	changeGeneric = "generictask"
+)
+
+// actions recorded in the opchanges table
+const (
+	changeAdd    = "add"
+	changeChange = "change"
+	changeDelete = "delete"
+	changeTouch  = "touch" // marks a new lasteditid
+)
+
+// OpChanges is the set of items which changed since a given lasteditid
+// if Full is set the base was unknown or too old and Operation contains the whole op instead
+type OpChanges struct {
+	ID            OperationID `json:"ID"`
+	Since         string      `json:"since"`
+	LastEditID    string      `json:"lasteditid"`
+	Modified      string      `json:"modified"`
+	Full          bool        `json:"full"`
+	Operation     *Operation  `json:"operation,omitempty"`
+	Name          string      `json:"name"`
+	Color         string      `json:"color"`
+	Comment       string      `json:"comment"`
+	ReferenceTime string      `json:"referencetime"`
+	State         OpState     `json:"state"`
+	Added         OpChangeSet `json:"added"`
+	Changed       OpChangeSet `json:"changed"`
+	Deleted       OpDeleteSet `json:"deleted"`
+	Keys          []KeyOnHand `json:"keysonhand,omitempty"` // the complete list of keys for any portal whose key counts changed
+	Blockers      []Blocker   `json:"blockers,omitempty"`   // the complete list of blockers, if any changed
+}
+
+// OpChangeSet holds the current versions of added or changed items
+type OpChangeSet struct {
+	Portals []Portal          `json:"opportals"`
+	Links   []Link            `json:"links"`
+	Markers []Marker          `json:"markers"`
+	Tasks   []GenericTask     `json:"tasks"`
+	Zones   []ZoneListElement `json:"zones"`
+}
+
+// OpDeleteSet holds the IDs of removed items
+type OpDeleteSet struct {
+	Portals []PortalID `json:"opportals"`
+	Links   []LinkID   `json:"links"`
+	Markers []MarkerID `json:"markers"`
+	Tasks   []TaskID   `json:"tasks"`
+	Zones   []Zone     `json:"zones"`
+}
+
+// logChange records a change to an item in the op, the change is tagged with the next lasteditid by Touch
+// it must be written in the transaction making the change, so the entry is only visible once the change is
+func (opID OperationID) logChange(kind string, itemID string, action string, tx *sql.Tx) {
+	if _, err := tx.Exec("INSERT INTO opchanges (opID, kind, itemID, action) VALUES (?, ?, ?, ?)", opID, kind, itemID, action); err != nil {
+		// the feed falls back to a full op if it is unsure, never fail the change itself
+		log.Error(err)
+	}
+}
+
+// changeTx runs a single change to the op in its own transaction, for changes made outside an upload or patch
+// changes to archived ops are refused
+func (opID OperationID) changeTx(change func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && err != sql.ErrTxDone {
+			log.Error(err)
+		}
+	}()
+
+	if err := opID.checkWritable(tx); err != nil {
+		return err
+	}
+
+	if err := change(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// stampChanges tags all untagged changes with updateID and records updateID as a known base for the feed
+// callers must hold the op lock, changes committed later are left untagged for the next stamp
+func (opID OperationID) stampChanges(updateID string, tx *sql.Tx) error {
+	if _, err := tx.Exec("UPDATE opchanges SET updateID = ? WHERE opID = ? AND updateID = ''", updateID, opID); err != nil {
+		log.Error(err)
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO opchanges (opID, updateID, kind, itemID, action) VALUES (?, ?, ?, ?, ?)", opID, updateID, changeOp, opID, changeTouch); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// logDiff records the changes between two versions of an op, used for full uploads
+func (opID OperationID) logDiff(before, after *Operation, tx *sql.Tx) {
+	diff := func(kind string, b, a map[string]string) {
+		for id, av := range a {
+			bv, ok := b[id]
+			if !ok {
+				opID.logChange(kind, id, changeAdd, tx)
+			} else if bv != av {
+				opID.logChange(kind, id, changeChange, tx)
+			}
+		}
+		for id := range b {
+			if _, ok := a[id]; !ok {
+				opID.logChange(kind, id, changeDelete, tx)
+			}
+		}
+	}
+
+	portals := func(o *Operation) map[string]string {
+		m := make(map[string]string)
+		for _, p := range o.OpPortals {
+			m[string(p.ID)] = canonicalPortal(p)
+		}
+		return m
+	}
+	links := func(o *Operation) map[string]string {
+		m := make(map[string]string)
+		for _, l := range o.Links {
+			m[string(l.ID)] = canonicalLink(l)
+		}
+		return m
+	}
+	markers := func(o *Operation) map[string]string {
+		m := make(map[string]string)
+		for _, mk := range o.Markers {
+			m[string(mk.ID)] = canonicalMarker(mk)
+		}
+		return m
+	}
+	tasks := func(o *Operation) map[string]string {
+		m := make(map[string]string)
+		for _, g := range o.Tasks {
+			m[string(g.ID)] = canonicalGenericTask(g)
+		}
+		return m
+	}
+	zones := func(o *Operation) map[string]string {
+		m := make(map[string]string)
+		for _, z := range o.Zones {
+			m[strconv.Itoa(int(z.Zone))] = canonical(z)
+		}
+		return m
+	}
+
+	diff(changePortal, portals(before), portals(after))
+	diff(changeLink, links(before), links(after))
+	diff(changeMarker, markers(before), markers(after))
+	diff(changeZone, zones(before), zones(after))
+	if after.Tasks != nil {
+		diff(changeGeneric, tasks(before), tasks(after))
+	}
+
+	if after.Blockers != nil && blockersChanged(before.Blockers, after.Blockers) {
+		opID.logChange(changeBlocker, string(opID), changeChange, tx)
+	}
+}
+
+// ChangesSince returns the items changed since the op was at lasteditid since, filtered to what gid can see
+func (o *Operation) ChangesSince(since string, gid GoogleID) (*OpChanges, error) {
+	if err := o.Populate(gid); err != nil {
+		return nil, err
+	}
+
+	c := OpChanges{
+		ID:            o.ID,
+		Since:         since,
+		LastEditID:    o.LastEditID,
+		Modified:      o.Modified,
+		Name:          o.Name,
+		Color:         o.Color,
+		Comment:       o.Comment,
+		ReferenceTime: o.ReferenceTime,
+		State:         o.State,
+	}
+
+	if since == o.LastEditID {
+		return &c, nil
+	}
+
+	var mark sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(seq) FROM opchanges WHERE opID = ? AND updateID = ?", o.ID, since).Scan(&mark); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if !mark.Valid {
+		log.Debugw("change feed base unknown, sending full op", "resource", o.ID, "GID", gid, "since", since)
+		c.Full = true
+		c.Operation = o
+		return &c, nil
+	}
+
+	type item struct {
+		kind   string
+		id     string
+		action string // the first action seen since the base
+	}
+	var items []*item
+	seen := make(map[string]*item)
+
+	// changes are selected by the lasteditid they were stamped with rather than by seq alone
+	// a change committed while another writer was stamping has a lower seq but is stamped by a later touch
+	rows, err := db.Query("SELECT kind, itemID, action FROM opchanges WHERE opID = ? AND action != ? AND (updateID = '' OR updateID IN (SELECT updateID FROM opchanges WHERE opID = ? AND action = ? AND seq > ?)) ORDER BY seq",
+		o.ID, changeTouch, o.ID, changeTouch, mark.Int64)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i item
+		if err := rows.Scan(&i.kind, &i.id, &i.action); err != nil {
+			log.Error(err)
+			continue
+		}
+		key := i.kind + ":" + i.id
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = &i
+		items = append(items, &i)
+	}
+
+	if len(items) > changeFeedMax {
+		log.Debugw("too many changes, sending full op", "resource", o.ID, "GID", gid, "since", since, "count", len(items))
+		c.Full = true
+		c.Operation = o
+		return &c, nil
+	}
+
+	portals := make(map[PortalID]Portal)
+	for _, p := range o.OpPortals {
+		portals[p.ID] = p
+	}
+	links := make(map[LinkID]Link)
+	for _, l := range o.Links {
+		links[l.ID] = l
+	}
+	markers := make(map[MarkerID]Marker)
+	for _, m := range o.Markers {
+		markers[m.ID] = m
+	}
+	tasks := make(map[TaskID]GenericTask)
+	for _, g := range o.Tasks {
+		tasks[g.ID] = g
+	}
+	zones := make(map[string]ZoneListElement)
+	for _, z := range o.Zones {
+		zones[strconv.Itoa(int(z.Zone))] = z
+	}
+
+	// agents limited to some zones do not get the whole op, items missing from their copy may still exist
+	read, readZones := o.ReadAccess(gid)
+	limited := !read || !ZoneAll.inZones(readZones)
+	deleted := func(kind, id string) bool {
+		if !limited {
+			return true
+		}
+		return !o.ID.itemExists(kind, id)
+	}
+
+	// task-level changes are reported as changes to the link, marker or generic task
+	done := make(map[string]bool)
+	keyPortals := make(map[PortalID]bool)
+	for _, i := range items {
+		if i.kind == changeTask {
+			if _, ok := links[LinkID(i.id)]; ok {
+				i.kind = changeLink
+			} else if _, ok := markers[MarkerID(i.id)]; ok {
+				i.kind = changeMarker
+			} else if _, ok := tasks[TaskID(i.id)]; ok {
+				i.kind = changeGeneric
+			} else {
+				// deleted tasks are logged as deleted links/markers/generic tasks, hidden tasks are left out
+				continue
+			}
+		}
+		if done[i.kind+":"+i.id] {
+			continue
+		}
+		done[i.kind+":"+i.id] = true
+
+		set := &c.Changed
+		if i.action == changeAdd {
+			set = &c.Added
+		}
+
+		switch i.kind {
+		case changePortal:
+			if p, ok := portals[PortalID(i.id)]; ok {
+				set.Portals = append(set.Portals, p)
+			} else if i.action != changeAdd && deleted(changePortal, i.id) {
+				c.Deleted.Portals = append(c.Deleted.Portals, PortalID(i.id))
+			}
+		case changeLink:
+			if l, ok := links[LinkID(i.id)]; ok {
+				set.Links = append(set.Links, l)
+			} else if i.action != changeAdd && deleted(changeLink, i.id) {
+				c.Deleted.Links = append(c.Deleted.Links, LinkID(i.id))
+			}
+		case changeMarker:
+			if m, ok := markers[MarkerID(i.id)]; ok {
+				set.Markers = append(set.Markers, m)
+			} else if i.action != changeAdd && deleted(changeMarker, i.id) {
+				c.Deleted.Markers = append(c.Deleted.Markers, MarkerID(i.id))
+			}
+		case changeGeneric:
+			if g, ok := tasks[TaskID(i.id)]; ok {
+				set.Tasks = append(set.Tasks, g)
+			} else if i.action != changeAdd && deleted(changeGeneric, i.id) {
+				c.Deleted.Tasks = append(c.Deleted.Tasks, TaskID(i.id))
+			}
+		case changeZone:
+			if z, ok := zones[i.id]; ok {
+				set.Zones = append(set.Zones, z)
+			} else if i.action != changeAdd && deleted(changeZone, i.id) {
+				zid, _ := strconv.Atoi(i.id)
+				c.Deleted.Zones = append(c.Deleted.Zones, Zone(zid))
+			}
+		case changeKey:
+			keyPortals[PortalID(i.id)] = true
+		case changeBlocker:
+			c.Blockers = o.Blockers
+		}
+	}
+
+	for _, k := range o.Keys {
+		if keyPortals[k.ID] {
+			c.Keys = append(c.Keys, k)
+		}
+	}
+
+	return &c, nil
+}
+
+// itemExists reports if an item is still in the op, used to tell hidden items from deleted ones
+func (opID OperationID) itemExists(kind, id string) bool {
+	var q string
+	switch kind {
+	case changePortal:
+		q = "SELECT COUNT(*) FROM portal WHERE opID = ? AND ID = ?"
+	case changeLink:
+		q = "SELECT COUNT(*) FROM link WHERE opID = ? AND ID = ?"
+	case changeMarker:
+		q = "SELECT COUNT(*) FROM marker WHERE opID = ? AND ID = ?"
+	case changeGeneric:
+		q = "SELECT COUNT(*) FROM task WHERE opID = ? AND ID = ?"
+	case changeZone:
+		q = "SELECT COUNT(*) FROM zone WHERE opID = ? AND ID = ?"
+	default:
+		return false
+	}
+
+	var i int
+	if err := db.QueryRow(q, opID, id).Scan(&i); err != nil {
+		log.Error(err)
+		// when unsure, leave it out rather than tell the client to delete it
+		return true
+	}
+	return i > 0
+}
+
+// ChangeLogClean removes change log entries older than the given number of days
+// clients asking for changes since a purged lasteditid receive the full op
+func ChangeLogClean(days int) {
+	if _, err := db.Exec("DELETE FROM opchanges WHERE changed < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? DAY)", days); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"context"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// CloneOptions controls what is carried over to a cloned op; portals, links, markers, attributes, zones and dependencies are always copied
+type CloneOptions struct {
+	Name        string `json:"name"`        // defaults to the source name
+	Assignments bool   `json:"assignments"` // keep task assignments
+	States      bool   `json:"states"`      // keep task states, otherwise everything is reset to pending
+	Keys        bool   `json:"keys"`        // keep keys-on-hand
+	Permissions bool   `json:"permissions"` // keep team permissions, only for teams the caller is on
+}
+
+// Clone copies an op to a new OperationID owned by gid, returns the new ID
+// gid must have full read access to the source op; callers should check write access
+func (opID OperationID) Clone(ctx context.Context, gid GoogleID, opts CloneOptions) (OperationID, error) {
+	o := Operation{ID: opID}
+	if err := o.Populate(gid); err != nil {
+		return "", err
+	}
+	perms := o.Teams
+
+	o.ID = OperationID(util.GenerateID(40))
+	o.Gid = gid
+	o.Teams = nil
+	o.Anchors = nil
+	if opts.Name != "" {
+		o.Name = opts.Name
+	}
+	if !opts.Keys {
+		o.Keys = nil
+	}
+
+	for i := range o.Links {
+		// populate fills in the deprecated fields, clear them so they do not override the task fields
+		o.Links[i].Desc = ""
+		o.Links[i].ThrowOrder = 0
+		o.Links[i].AssignedTo = ""
+		o.Links[i].Completed = false
+		o.Links[i].MuCaptured = 0
+		cloneTask(&o.Links[i].Task, opts)
+	}
+	for i := range o.Markers {
+		o.Markers[i].AssignedTo = ""
+		cloneTask(&o.Markers[i].Task, opts)
+	}
+	for i := range o.Tasks {
+		cloneTask(&o.Tasks[i].Task, opts)
+	}
+
+	if err := DrawInsert(ctx, &o, gid); err != nil {
+		return "", err
+	}
+
+	if opts.Permissions {
+		for _, p := range perms {
+			if err := o.ID.AddPerm(gid, p.TeamID, string(p.Role), p.Zone); err != nil {
+				log.Infow("not copying permission", "GID", gid, "resource", o.ID, "source", opID, "team", p.TeamID, "error", err.Error())
+				continue
+			}
+		}
+	}
+
+	log.Infow("cloned operation", "GID", gid, "resource", o.ID, "source", opID)
+	return o.ID, nil
+}
+
+func cloneTask(t *Task, opts CloneOptions) {
+	if !opts.Assignments {
+		t.Assignments = nil
+	}
+	if !opts.States {
+		t.State = "pending"
+		return
+	}
+	// assigned and acknowledged make no sense without an assignment
+	if len(t.Assignments) == 0 && t.State != "completed" {
+		t.State = "pending"
+	}
+}
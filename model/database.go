@@ -52,25 +52,33 @@ var tabledefs = []struct {
 	// agent must come first, team must come second, operation must come third, task fourth, the rest can be in alphabetical order
 	{"agent", `CREATE TABLE agent (gid char(21) NOT NULL, OneTimeToken varchar(64) NOT NULL DEFAULT "", RISC tinyint(1) NOT NULL DEFAULT 0, intelname varchar(16) DEFAULT NULL, intelfaction tinyint(1) NOT NULL DEFAULT -1, communityname varchar(16) DEFAULT NULL, picurl text DEFAULT NULL, PRIMARY KEY (gid), UNIQUE KEY OneTimeToken (OneTimeToken), UNIQUE KEY communityname (communityname)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"team", `CREATE TABLE team (teamID varchar(64) NOT NULL, owner char(21) NOT NULL, name varchar(64) DEFAULT NULL, rockskey varchar(32) DEFAULT NULL, rockscomm varchar(32) DEFAULT NULL, joinLinkToken varchar(64) DEFAULT NULL, vteam int(11) unsigned DEFAULT 0, vrole int(11) unsigned DEFAULT 0, PRIMARY KEY (teamID), KEY fk_team_owner (owner), CONSTRAINT fk_team_owner FOREIGN KEY (owner) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
-	{"operation", `CREATE TABLE operation (ID char(40) NOT NULL, name varchar(128) NOT NULL DEFAULT 'new op', gid char(21) NOT NULL, color varchar(16) NOT NULL DEFAULT 'purple', modified timestamp NOT NULL DEFAULT current_timestamp(), comment text DEFAULT NULL, referencetime timestamp NOT NULL DEFAULT current_timestamp(), lasteditid char(40) NOT NULL DEFAULT 'unset', PRIMARY KEY (ID), KEY gid (gid), CONSTRAINT fk_operation_agent FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"operation", `CREATE TABLE operation (ID char(40) NOT NULL, name varchar(128) NOT NULL DEFAULT 'new op', gid char(21) NOT NULL, color varchar(16) NOT NULL DEFAULT 'purple', modified timestamp NOT NULL DEFAULT current_timestamp(), comment text DEFAULT NULL, referencetime timestamp NOT NULL DEFAULT current_timestamp(), lasteditid char(40) NOT NULL DEFAULT 'unset', reminders tinyint(1) NOT NULL DEFAULT 0, autozone tinyint(1) NOT NULL DEFAULT 0, state enum('planning','briefed','live','finished','archived') NOT NULL DEFAULT 'planning', PRIMARY KEY (ID), KEY gid (gid), CONSTRAINT fk_operation_agent FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"task", `CREATE TABLE task(ID char(40) NOT NULL, opID char(40) NOT NULL, comment text DEFAULT NULL, taskorder int(11) NOT NULL DEFAULT 0, state enum('pending','assigned','acknowledged','completed') NOT NULL DEFAULT 'pending', zone tinyint(4) NOT NULL DEFAULT 1, delta int(11) NOT NULL DEFAULT 0, PRIMARY KEY (ID,opID), KEY fk_operation_id_task (opID), CONSTRAINT fk_operation_id_task FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 
 	{"agentteams", `CREATE TABLE agentteams (teamID varchar(64) NOT NULL, gid char(21) NOT NULL, shareLoc tinyint(4) NOT NULL DEFAULT 0, shareWD tinyint(4) NOT NULL DEFAULT 0, loadWD tinyint(4) NOT NULL DEFAULT 0, comment varchar(32), PRIMARY KEY (teamID,gid), KEY gidkey (gid), CONSTRAINT fk_agent_teams FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE, CONSTRAINT fk_t_teams FOREIGN KEY (teamID) REFERENCES team (teamID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"assignments", `CREATE TABLE assignments (opID char(40) NOT NULL, taskID char(40) NOT NULL, gid char(21) NOT NULL, KEY opID (opID), KEY gid (gid), CONSTRAINT fk_assignments_gid FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE, CONSTRAINT fk_assignments_opid FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, KEY taskID (taskID,opID), CONSTRAINT fk_assignments_taskid FOREIGN KEY (taskID,opID) REFERENCES task (ID, opID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"blocker", `CREATE TABLE blocker (ID varchar(64) NOT NULL, opID char(40) NOT NULL, fromPortalID varchar(41) NOT NULL, toPortalID varchar(41) NOT NULL, PRIMARY KEY (ID,opID), KEY fk_operation_blocker (opID), CONSTRAINT fk_operation_blocker FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"calendartoken", `CREATE TABLE calendartoken (gid char(21) NOT NULL, token char(40) NOT NULL, created timestamp NOT NULL DEFAULT current_timestamp(), PRIMARY KEY (gid), UNIQUE KEY token (token), CONSTRAINT fk_calendartoken_gid FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"defensivekeys", `CREATE TABLE defensivekeys (gid char(21) NOT NULL, portalID varchar(41) NOT NULL, capID varchar(16) DEFAULT NULL, count int(3) NOT NULL DEFAULT 0, name varchar(128) DEFAULT NULL, loc point DEFAULT NULL, PRIMARY KEY (portalID,gid), KEY fk_dk_gid (gid), CONSTRAINT fk_dk_gid FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"deletedops", `CREATE TABLE deletedops (opID char(40) NOT NULL, deletedate timestamp NOT NULL DEFAULT current_timestamp(), gid char(21) DEFAULT NULL, PRIMARY KEY (opID)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
-	{"depends", `CREATE TABLE depends (opID char(40) NOT NULL, taskID char(40) NOT NULL, dependsOn char(40) DEFAULT NULL, KEY fk_depends_opID (opID), PRIMARY KEY key_optask (opID,taskID), CONSTRAINT fk_depends_opID FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, CONSTRAINT fk_depends_pk FOREIGN KEY (taskID, opID) REFERENCES task (ID, opID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"depends", `CREATE TABLE depends (opID char(40) NOT NULL, taskID char(40) NOT NULL, dependsOn char(40) NOT NULL, KEY fk_depends_opID (opID), PRIMARY KEY key_optask (opID,taskID,dependsOn), KEY fk_depends_pk (taskID,opID), CONSTRAINT fk_depends_opID FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, CONSTRAINT fk_depends_pk FOREIGN KEY (taskID, opID) REFERENCES task (ID, opID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"firebase", `CREATE TABLE firebase (gid char(21) NOT NULL, token varchar(256) NOT NULL, KEY fk_gid (gid), CONSTRAINT fk_gid FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 
+	{"generictask", `CREATE TABLE generictask (ID char(40) NOT NULL, opID char(40) NOT NULL, name varchar(128) NOT NULL DEFAULT '', portalID varchar(41) DEFAULT NULL, loc point DEFAULT NULL, PRIMARY KEY (ID,opID), KEY fk_operation_generictask (opID), CONSTRAINT fk_operation_generictask FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, KEY fk_task_generictask (ID,opID), CONSTRAINT fk_task_generictask FOREIGN KEY (ID,opID) REFERENCES task (ID,opID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"link", `CREATE TABLE link (ID char(40) NOT NULL, opID char(40) NOT NULL, fromPortalID varchar(41) NOT NULL, toPortalID varchar(41) NOT NULL, color varchar(16) NOT NULL DEFAULT 'main', mu bigint(20) unsigned NOT NULL DEFAULT 0, PRIMARY KEY (ID,opID), KEY fk_operation_id_link (opID), KEY fk_task_link (ID) , CONSTRAINT fk_operation_id_link FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, CONSTRAINT fk_task_link FOREIGN KEY (ID) REFERENCES task (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"locations", `CREATE TABLE locations (gid char(21) NOT NULL, upTime timestamp NOT NULL DEFAULT current_timestamp(), loc point NOT NULL, PRIMARY KEY (gid), CONSTRAINT fk_location_agent FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"marker", `CREATE TABLE marker (ID char(40) NOT NULL, opID char(40) NOT NULL, portalID varchar(41) NOT NULL, type varchar(24) NOT NULL, PRIMARY KEY (ID,opID), KEY fk_operation_marker (opID), CONSTRAINT fk_operation_marker FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, KEY fk_task_marker (ID), CONSTRAINT fk_task_marker FOREIGN KEY (ID) REFERENCES task (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"markerattributes", `CREATE TABLE markerattributes (ID char(40) NOT NULL, opID char(40) NOT NULL, markerID char(40) NOT NULL, name varchar(32) NOT NULL DEFAULT 'unset', value text DEFAULT NULL, PRIMARY KEY (ID,opID), KEY fk_makerattr_opID (opID), KEY fk_marker_attr (markerID), CONSTRAINT fk_markerattr_opID FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, KEY fk_marker_markerattr (ID), CONSTRAINT fk_marker_markerattr FOREIGN KEY (ID) REFERENCES marker (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"messagelog", `CREATE TABLE messagelog (timestamp timestamp NOT NULL DEFAULT current_timestamp(), gid char(21) NOT NULL, message text NOT NULL) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"opkeys", `CREATE TABLE opkeys (opID char(40) NOT NULL, portalID varchar(41) NOT NULL, gid char(21) NOT NULL, onhand int(11) unsigned NOT NULL DEFAULT 0, capsule varchar(16) DEFAULT NULL, UNIQUE KEY key_unique (opID,portalID,gid,capsule), KEY fk_operation_id_keys (opID), CONSTRAINT fk_operation_id_keys FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, KEY fk_agent_keys (gid), CONSTRAINT fk_agent_keys FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"opchanges", `CREATE TABLE opchanges (seq bigint(20) unsigned NOT NULL AUTO_INCREMENT, opID char(40) NOT NULL, updateID char(40) NOT NULL DEFAULT '', kind enum('op','portal','link','marker','task','zone','key','blocker','generictask') NOT NULL, itemID varchar(41) NOT NULL, action enum('add','change','delete','touch') NOT NULL DEFAULT 'change', changed timestamp NOT NULL DEFAULT current_timestamp(), PRIMARY KEY (seq), KEY opseq (opID,seq), KEY opupdate (opID,updateID), KEY changed (changed), CONSTRAINT fk_operation_id_changes FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"oprevisions", `CREATE TABLE oprevisions (opID char(40) NOT NULL, lasteditid char(40) NOT NULL, gid char(21) NOT NULL, created timestamp NOT NULL DEFAULT current_timestamp(), snapshot longtext NOT NULL, PRIMARY KEY (opID,lasteditid), KEY fk_operation_id_revisions (opID), CONSTRAINT fk_operation_id_revisions FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"permissions", `CREATE TABLE permissions (teamID varchar(64) NOT NULL, opID char(40) NOT NULL, permission enum('read','write','assignedonly') NOT NULL DEFAULT 'read', zone tinyint(4) NOT NULL DEFAULT 0, KEY opID (opID), KEY teamID (teamID), CONSTRAINT fk_ops_teamID FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, CONSTRAINT fk_teamIDs_op FOREIGN KEY (teamID) REFERENCES team (teamID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
-	{"portal", `CREATE TABLE portal (ID varchar(41) NOT NULL, opID char(40) NOT NULL, name varchar(128) NOT NULL, loc point NOT NULL, comment text DEFAULT NULL, hardness varchar(64) DEFAULT NULL, PRIMARY KEY (ID,opID), KEY fk_operation_id (opID), CONSTRAINT FOREIGN KEY fk_operation_id (opID) REFERENCES operation (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"portal", `CREATE TABLE portal (ID varchar(41) NOT NULL, opID char(40) NOT NULL, name varchar(128) NOT NULL, loc point NOT NULL, comment text DEFAULT NULL, hardness varchar(64) DEFAULT NULL, sbul tinyint(1) unsigned NOT NULL DEFAULT 0, PRIMARY KEY (ID,opID), KEY fk_operation_id (opID), CONSTRAINT FOREIGN KEY fk_operation_id (opID) REFERENCES operation (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"portalcatalog", `CREATE TABLE portalcatalog (ID varchar(41) NOT NULL, name varchar(128) NOT NULL, loc point NOT NULL, updated timestamp NOT NULL DEFAULT current_timestamp(), pendingname varchar(128) DEFAULT NULL, pendingloc point DEFAULT NULL, pendinggid char(21) DEFAULT NULL, pendingsince timestamp NULL DEFAULT NULL, PRIMARY KEY (ID)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"reminders", `CREATE TABLE reminders (opID char(40) NOT NULL, taskID char(40) NOT NULL, gid char(21) NOT NULL, scheduled timestamp NOT NULL DEFAULT current_timestamp(), leadtime int(11) NOT NULL DEFAULT 0, sent timestamp NOT NULL DEFAULT current_timestamp(), PRIMARY KEY (opID,taskID,gid,scheduled,leadtime), KEY scheduled (scheduled), CONSTRAINT fk_operation_reminders FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE, CONSTRAINT fk_agent_reminders FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"rocks", `CREATE TABLE rocks (gid char(21) NOT NULL, tgid int(11) DEFAULT NULL, agent varchar(16) DEFAULT NULL, verified tinyint(4) NOT NULL DEFAULT 0, smurf tinyint(4) NOT NULL DEFAULT 0, fetched timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (gid), CONSTRAINT fk_rocks_gid FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
+	{"taskevents", `CREATE TABLE taskevents (seq bigint(20) unsigned NOT NULL AUTO_INCREMENT, opID char(40) NOT NULL, taskID char(40) NOT NULL, gid char(21) NOT NULL DEFAULT '', event enum('claim','reject','acknowledge','complete','incomplete','assign','comment','zone','state') NOT NULL, oldvalue text DEFAULT NULL, newvalue text DEFAULT NULL, changed timestamp NOT NULL DEFAULT current_timestamp(), PRIMARY KEY (seq), KEY optask (opID,taskID,seq), KEY fk_operation_taskevents (opID), CONSTRAINT fk_operation_taskevents FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"telegram", `CREATE TABLE telegram (telegramID bigint(20) NOT NULL, telegramName varchar(32) NOT NULL, gid char(21) NOT NULL, verified tinyint(1) NOT NULL DEFAULT 0, authtoken varchar(32) DEFAULT NULL, PRIMARY KEY (telegramID), UNIQUE KEY gid (gid), CONSTRAINT fk_agent_telegram FOREIGN KEY (gid) REFERENCES agent (gid) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"telegramteam", `CREATE TABLE telegramteam (teamID varchar(64) NOT NULL, telegram bigint(20) NOT NULL, opID char(40) DEFAULT NULL, PRIMARY KEY (telegram), UNIQUE KEY (teamID), CONSTRAINT fk_tt_team FOREIGN KEY (teamID) REFERENCES team (teamID) ON DELETE CASCADE, KEY (opID), CONSTRAINT fk_tt_op FOREIGN KEY (opID) REFERENCES operation (ID) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
 	{"telegramchatmembers", `CREATE TABLE telegramchatmembers (agent bigint(20) NOT NULL, chat bigint(20) NOT NULL, PRIMARY KEY (agent,chat), KEY (chat), CONSTRAINT fk_tg_chat FOREIGN KEY (chat) REFERENCES telegramteam (telegram) ON DELETE CASCADE) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`},
@@ -136,6 +144,19 @@ func upgradeTables(ctx context.Context) {
 		upgrade string // the query to run to make the upgrade
 	}{
 		{"SHOW FIELDS FROM zonepoints where field='position' and type like '%unsigned%'", "alter table zonepoints MODIFY COLUMN position tinyint(4) unsigned"},
+		{"SHOW FIELDS FROM portal where field='sbul'", "alter table portal ADD COLUMN sbul tinyint(1) unsigned NOT NULL DEFAULT 0 AFTER hardness"},
+		// tasks can have more than one dependency, the first clears out unusable rows so the second can run
+		{"SHOW INDEX FROM depends WHERE Key_name='PRIMARY' AND Column_name='dependsOn'", "DELETE FROM depends WHERE dependsOn IS NULL"},
+		{"SHOW INDEX FROM depends WHERE Key_name='PRIMARY' AND Column_name='dependsOn'", "ALTER TABLE depends MODIFY COLUMN dependsOn char(40) NOT NULL, DROP PRIMARY KEY, ADD PRIMARY KEY (opID,taskID,dependsOn)"},
+		// remove dependencies on tasks which no longer exist before adding the foreign key, checks are off during upgrades
+		{"SELECT CONSTRAINT_NAME FROM information_schema.REFERENTIAL_CONSTRAINTS WHERE CONSTRAINT_SCHEMA = DATABASE() AND TABLE_NAME = 'depends' AND CONSTRAINT_NAME = 'fk_depends_pk'", "DELETE depends FROM depends LEFT JOIN task ON depends.taskID = task.ID AND depends.opID = task.opID WHERE task.ID IS NULL"},
+		{"SELECT CONSTRAINT_NAME FROM information_schema.REFERENTIAL_CONSTRAINTS WHERE CONSTRAINT_SCHEMA = DATABASE() AND TABLE_NAME = 'depends' AND CONSTRAINT_NAME = 'fk_depends_pk'", "DELETE depends FROM depends LEFT JOIN task ON depends.dependsOn = task.ID AND depends.opID = task.opID WHERE task.ID IS NULL"},
+		{"SELECT CONSTRAINT_NAME FROM information_schema.REFERENTIAL_CONSTRAINTS WHERE CONSTRAINT_SCHEMA = DATABASE() AND TABLE_NAME = 'depends' AND CONSTRAINT_NAME = 'fk_depends_pk'", "ALTER TABLE depends ADD CONSTRAINT fk_depends_pk FOREIGN KEY (taskID, opID) REFERENCES task (ID, opID) ON DELETE CASCADE"},
+		{"SHOW FIELDS FROM operation where field='reminders'", "alter table operation ADD COLUMN reminders tinyint(1) NOT NULL DEFAULT 0 AFTER lasteditid"},
+		{"SHOW FIELDS FROM operation where field='autozone'", "alter table operation ADD COLUMN autozone tinyint(1) NOT NULL DEFAULT 0 AFTER reminders"},
+		{"SHOW FIELDS FROM operation where field='state'", "alter table operation ADD COLUMN state enum('planning','briefed','live','finished','archived') NOT NULL DEFAULT 'planning' AFTER autozone"},
+		// seed the portal catalog from the portals already in ops, a no-op until there are portals
+		{"SELECT ID FROM portalcatalog LIMIT 1", "INSERT IGNORE INTO portalcatalog (ID, name, loc) SELECT ID, name, loc FROM portal"},
 		// drop table v
 	}
 
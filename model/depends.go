@@ -0,0 +1,236 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/messaging"
+)
+
+// ReadyTasks are the incomplete tasks whose dependencies are all complete
+type ReadyTasks struct {
+	ID         OperationID   `json:"ID"`
+	LastEditID string        `json:"lasteditid"`
+	Links      []Link        `json:"links"`
+	Markers    []Marker      `json:"markers"`
+	Tasks      []GenericTask `json:"tasks"`
+}
+
+// checkDependGraph ensures every dependency refers to a task in the op and that there are no cycles
+func checkDependGraph(tasks map[TaskID]bool, depends map[TaskID][]TaskID) error {
+	for t, ds := range depends {
+		for _, d := range ds {
+			if !tasks[d] {
+				err := errors.New(ErrDependNotFound)
+				log.Infow(err.Error(), "task", t, "dependsOn", d)
+				return err
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[TaskID]int)
+
+	var visit func(t TaskID) bool
+	visit = func(t TaskID) bool {
+		switch state[t] {
+		case visiting:
+			return false
+		case visited:
+			return true
+		}
+		state[t] = visiting
+		for _, d := range depends[t] {
+			if !visit(d) {
+				return false
+			}
+		}
+		state[t] = visited
+		return true
+	}
+
+	for t := range depends {
+		if !visit(t) {
+			err := errors.New(ErrDependCycle)
+			log.Infow(err.Error(), "task", t)
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDepends checks the op's dependency graph as it stands in the transaction
+func (opID OperationID) validateDepends(tx *sql.Tx) error {
+	tasks := make(map[TaskID]bool)
+	rows, err := tx.Query("SELECT ID FROM task WHERE opID = ?", opID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t TaskID
+		if err := rows.Scan(&t); err != nil {
+			log.Error(err)
+			continue
+		}
+		tasks[t] = true
+	}
+
+	depends := make(map[TaskID][]TaskID)
+	drows, err := tx.Query("SELECT taskID, dependsOn FROM depends WHERE opID = ?", opID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer drows.Close()
+	for drows.Next() {
+		var t, d TaskID
+		if err := drows.Scan(&t, &d); err != nil {
+			log.Error(err)
+			continue
+		}
+		depends[t] = append(depends[t], d)
+	}
+
+	if err := checkDependGraph(tasks, depends); err != nil {
+		log.Infow("rejecting dependencies", "resource", opID, "error", err.Error())
+		return err
+	}
+	return nil
+}
+
+// taskStates returns the state of every task in the op, regardless of zone
+func (opID OperationID) taskStates() (map[TaskID]string, error) {
+	states := make(map[TaskID]string)
+
+	rows, err := db.Query("SELECT ID, state FROM task WHERE opID = ?", opID)
+	if err != nil {
+		log.Error(err)
+		return states, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t TaskID
+		var s string
+		if err := rows.Scan(&t, &s); err != nil {
+			log.Error(err)
+			continue
+		}
+		states[t] = s
+	}
+	return states, nil
+}
+
+// IncompleteDepends returns the tasks this task depends upon which are not yet completed
+func (t *Task) IncompleteDepends() ([]TaskID, error) {
+	var incomplete []TaskID
+
+	rows, err := db.Query("SELECT depends.dependsOn FROM depends JOIN task ON depends.dependsOn = task.ID AND depends.opID = task.opID WHERE depends.opID = ? AND depends.taskID = ? AND task.state != 'completed'", t.opID, t.ID)
+	if err != nil {
+		log.Error(err)
+		return incomplete, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d TaskID
+		if err := rows.Scan(&d); err != nil {
+			log.Error(err)
+			continue
+		}
+		incomplete = append(incomplete, d)
+	}
+	return incomplete, nil
+}
+
+// notifyReady tells the assignees of tasks waiting on this one if their last dependency is now complete
+func (t *Task) notifyReady() {
+	rows, err := db.Query("SELECT taskID FROM depends WHERE opID = ? AND dependsOn = ?", t.opID, t.ID)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	var waiting []TaskID
+	for rows.Next() {
+		var w TaskID
+		if err := rows.Scan(&w); err != nil {
+			log.Error(err)
+			continue
+		}
+		waiting = append(waiting, w)
+	}
+	rows.Close()
+
+	for _, w := range waiting {
+		wt := Task{ID: w, opID: t.opID}
+		incomplete, err := wt.IncompleteDepends()
+		if err != nil || len(incomplete) > 0 {
+			continue
+		}
+
+		assigned, err := wt.GetAssignments(nil)
+		if err != nil {
+			continue
+		}
+		for _, gid := range assigned {
+			log.Debugw("dependencies complete", "resource", t.opID, "task", w, "GID", gid)
+			messaging.SendAssignment(messaging.GoogleID(gid), messaging.TaskID(w), messaging.OperationID(t.opID), "ready")
+		}
+	}
+}
+
+// ReadyTasks lists the incomplete tasks visible to gid whose dependencies are all complete
+// dependencies in zones gid cannot see are still taken into account
+func (o *Operation) ReadyTasks(gid GoogleID) (*ReadyTasks, error) {
+	if err := o.Populate(gid); err != nil {
+		return nil, err
+	}
+
+	states, err := o.ID.taskStates()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := func(t Task) bool {
+		if t.State == "completed" {
+			return false
+		}
+		for _, d := range t.DependsOn {
+			if states[d] != "completed" {
+				return false
+			}
+		}
+		return true
+	}
+
+	r := ReadyTasks{
+		ID:         o.ID,
+		LastEditID: o.LastEditID,
+		Links:      make([]Link, 0),
+		Markers:    make([]Marker, 0),
+		Tasks:      make([]GenericTask, 0),
+	}
+	for _, l := range o.Links {
+		if ready(l.Task) {
+			r.Links = append(r.Links, l)
+		}
+	}
+	for _, m := range o.Markers {
+		if ready(m.Task) {
+			r.Markers = append(r.Markers, m)
+		}
+	}
+	for _, g := range o.Tasks {
+		if ready(g.Task) {
+			r.Tasks = append(r.Tasks, g)
+		}
+	}
+	return &r, nil
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestCheckDependGraph(t *testing.T) {
+	tasks := map[TaskID]bool{"a": true, "b": true, "c": true, "d": true}
+
+	tests := []struct {
+		name    string
+		depends map[TaskID][]TaskID
+		err     string
+	}{
+		{"none", map[TaskID][]TaskID{}, ""},
+		{"chain", map[TaskID][]TaskID{"c": {"b"}, "b": {"a"}}, ""},
+		{"diamond", map[TaskID][]TaskID{"d": {"b", "c"}, "b": {"a"}, "c": {"a"}}, ""},
+		{"self", map[TaskID][]TaskID{"a": {"a"}}, ErrDependCycle},
+		{"cycle", map[TaskID][]TaskID{"a": {"b"}, "b": {"c"}, "c": {"a"}}, ErrDependCycle},
+		{"unknown", map[TaskID][]TaskID{"a": {"z"}}, ErrDependNotFound},
+	}
+
+	for _, tt := range tests {
+		err := checkDependGraph(tasks, tt.depends)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
@@ -3,15 +3,26 @@ package model
 // These error values are error strings visible to users, they need to be migrated to the translation system
 const (
 	ErrAgentNotFound        = "agent not registered with this wasabee server"
+	ErrDependCycle          = "dependency would create a cycle"
+	ErrDependNotFound       = "dependency is not a task in this operation"
+	ErrDependsIncomplete    = "task has incomplete dependencies"
 	ErrEmptyAgent           = "empty agent request"
 	ErrGetLinkUnpopulated   = "attempt to use GetLink on unpopulated *Operation"
 	ErrGetMarkerUnpopulated = "attempt to use GetMarker on unpopulated *Operation"
+	ErrImportNoMatches      = "nothing in the import could be matched to known portals"
+	ErrInvalidCalendarToken = "invalid calendar token"
 	ErrInvalidOTT           = "invalid OneTimeToken"
 	ErrKeyUnableToRemove    = "unable to remove key count for portal"
 	ErrKeyUnableToRecord    = "unable to record keys, ensure the op on the server is up-to-date"
 	ErrLinkNotFound         = "link not found"
 	ErrMarkerNotFound       = "markernot found"
+	ErrOpArchived           = "operation is archived"
+	ErrOpBusy               = "operation is busy with another update, retry"
+	ErrOpInTrash            = "operation is already in the trash"
+	ErrOpMergeConflict      = "conflicting changes on the server, unable to merge"
 	ErrOpNotFound           = "operation not found"
+	ErrOpNotInTrash         = "operation is not in the trash"
+	ErrOpStale              = "local op out-of-date, refresh and retry or request a merge"
 	ErrMultipleIntelname    = "multiple intelname matches found, not using intelname results"
 	ErrMultipleRocks        = "multiple rocks matches found, not using rocks results"
 	ErrMultipleV            = "multiple V matches found, not using V results"
@@ -19,8 +30,12 @@ const (
 	ErrNotOnTeamAddPerm     = "you must be on a team to add it as a permission"
 	ErrNotOpOwner           = "not owner of op"
 	ErrPortalNotFound       = "portal not found"
+	ErrRevisionNotFound     = "revision not found"
 	ErrTaskNotFound         = "task not found"
+	ErrUnknownExportFormat  = "unknown export format"
 	ErrUnknownGID           = "unknown GoogleID"
+	ErrUnknownImportFormat  = "unknown import format"
+	ErrUnknownMarkerType    = "unknown marker type"
 	ErrUnknownPermType      = "unknown permission type"
 	ErrUnknownUser          = "unknown user"
 )
@@ -0,0 +1,528 @@
+package model
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// export formats
+const (
+	ExportGeoJSON = "geojson"
+	ExportKML     = "kml"
+	ExportGPX     = "gpx"
+)
+
+// Export renders the op, as visible to gid, in one of the export formats
+// returns the document and its content-type
+func (o *Operation) Export(gid GoogleID, format string) ([]byte, string, error) {
+	// Populate filters the portals, links, markers and tasks
+	if err := o.Populate(gid); err != nil {
+		return nil, "", err
+	}
+
+	// zones are not filtered by Populate, only export the ones this agent can read
+	read, zones := o.ReadAccess(gid)
+	if !read {
+		zones = nil
+	}
+	var visible []ZoneListElement
+	for _, z := range o.Zones {
+		if z.Zone.inZones(zones) {
+			visible = append(visible, z)
+		}
+	}
+	o.Zones = visible
+
+	switch format {
+	case ExportGeoJSON, "":
+		b, err := o.exportGeoJSON()
+		return b, "application/geo+json", err
+	case ExportKML:
+		b, err := o.exportKML()
+		return b, "application/vnd.google-earth.kml+xml", err
+	case ExportGPX:
+		b, err := o.exportGPX()
+		return b, "application/gpx+xml", err
+	}
+
+	err := errors.New(ErrUnknownExportFormat)
+	log.Infow(err.Error(), "GID", gid, "resource", o.ID, "format", format)
+	return nil, "", err
+}
+
+// exportPortalMap returns the portals keyed by ID, with the location parsed
+func (o *Operation) exportPortalMap() map[PortalID]exportPoint {
+	m := make(map[PortalID]exportPoint)
+	for _, p := range o.OpPortals {
+		lat, err := strconv.ParseFloat(p.Lat, 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(p.Lon, 64)
+		if err != nil {
+			continue
+		}
+		m[p.ID] = exportPoint{Lat: lat, Lon: lon, Portal: p}
+	}
+	return m
+}
+
+type exportPoint struct {
+	Lat    float64
+	Lon    float64
+	Portal Portal
+}
+
+// exportTaskPoint locates a generic task at its portal, or at its own location if it has no portal
+func exportTaskPoint(portals map[PortalID]exportPoint, g GenericTask) (exportPoint, bool) {
+	if g.PortalID != "" {
+		pt, ok := portals[g.PortalID]
+		return pt, ok
+	}
+	lat, lon, ok := g.location()
+	return exportPoint{Lat: lat, Lon: lon}, ok
+}
+
+// zoneRing returns the zone's points in order, closed
+func zoneRing(z ZoneListElement) []zonepoint {
+	points := make([]zonepoint, len(z.Points))
+	copy(points, z.Points)
+	sort.Slice(points, func(i, j int) bool { return points[i].Position < points[j].Position })
+	if len(points) > 0 {
+		points = append(points, points[0])
+	}
+	return points
+}
+
+func markerAttributes(m Marker) map[string]string {
+	a := make(map[string]string)
+	for _, attr := range m.Attributes {
+		a[attr.Name] = attr.Value
+	}
+	return a
+}
+
+func gidStrings(gids []GoogleID) []string {
+	s := make([]string, 0, len(gids))
+	for _, g := range gids {
+		s = append(s, string(g))
+	}
+	return s
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+func (o *Operation) exportGeoJSON() ([]byte, error) {
+	portals := o.exportPortalMap()
+	features := make([]geoJSONFeature, 0)
+
+	for _, p := range o.OpPortals {
+		pt, ok := portals[p.ID]
+		if !ok {
+			continue
+		}
+		features = append(features, geoJSONFeature{
+			Type:     "Feature",
+			ID:       string(p.ID),
+			Geometry: geoJSONGeometry{Type: "Point", Coordinates: []float64{pt.Lon, pt.Lat}},
+			Properties: map[string]interface{}{
+				"kind":     "portal",
+				"name":     p.Name,
+				"comment":  p.Comment,
+				"hardness": p.Hardness,
+			},
+		})
+	}
+
+	for _, l := range o.Links {
+		from, fok := portals[l.From]
+		to, tok := portals[l.To]
+		if !fok || !tok {
+			continue
+		}
+		features = append(features, geoJSONFeature{
+			Type:     "Feature",
+			ID:       string(l.ID),
+			Geometry: geoJSONGeometry{Type: "LineString", Coordinates: [][]float64{{from.Lon, from.Lat}, {to.Lon, to.Lat}}},
+			Properties: map[string]interface{}{
+				"kind":        "link",
+				"from":        l.From,
+				"to":          l.To,
+				"fromName":    from.Portal.Name,
+				"toName":      to.Portal.Name,
+				"color":       l.Color,
+				"order":       l.Order,
+				"state":       l.State,
+				"zone":        l.Zone,
+				"comment":     l.Comment,
+				"assignments": gidStrings(l.Assignments),
+			},
+		})
+	}
+
+	for _, m := range o.Markers {
+		pt, ok := portals[m.PortalID]
+		if !ok {
+			continue
+		}
+		features = append(features, geoJSONFeature{
+			Type:     "Feature",
+			ID:       string(m.ID),
+			Geometry: geoJSONGeometry{Type: "Point", Coordinates: []float64{pt.Lon, pt.Lat}},
+			Properties: map[string]interface{}{
+				"kind":        "marker",
+				"type":        NewMarkerType(m.Type),
+				"portal":      m.PortalID,
+				"portalName":  pt.Portal.Name,
+				"order":       m.Order,
+				"state":       m.State,
+				"zone":        m.Zone,
+				"comment":     m.Comment,
+				"assignments": gidStrings(m.Assignments),
+				"attributes":  markerAttributes(m),
+			},
+		})
+	}
+
+	for _, g := range o.Tasks {
+		pt, ok := exportTaskPoint(portals, g)
+		if !ok {
+			continue
+		}
+		features = append(features, geoJSONFeature{
+			Type:     "Feature",
+			ID:       string(g.ID),
+			Geometry: geoJSONGeometry{Type: "Point", Coordinates: []float64{pt.Lon, pt.Lat}},
+			Properties: map[string]interface{}{
+				"kind":        "task",
+				"name":        g.Name,
+				"portal":      g.PortalID,
+				"portalName":  pt.Portal.Name,
+				"order":       g.Order,
+				"state":       g.State,
+				"zone":        g.Zone,
+				"comment":     g.Comment,
+				"assignments": gidStrings(g.Assignments),
+			},
+		})
+	}
+
+	for _, z := range o.Zones {
+		ring := zoneRing(z)
+		if len(ring) < 4 {
+			continue
+		}
+		coords := make([][]float64, 0, len(ring))
+		for _, p := range ring {
+			coords = append(coords, []float64{p.Lon, p.Lat})
+		}
+		features = append(features, geoJSONFeature{
+			Type:     "Feature",
+			ID:       strconv.Itoa(int(z.Zone)),
+			Geometry: geoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{coords}},
+			Properties: map[string]interface{}{
+				"kind":  "zone",
+				"name":  z.Name,
+				"color": z.Color,
+				"zone":  z.Zone,
+			},
+		})
+	}
+
+	fc := struct {
+		Type       string                 `json:"type"`
+		Properties map[string]interface{} `json:"properties"`
+		Features   []geoJSONFeature       `json:"features"`
+	}{
+		Type: "FeatureCollection",
+		Properties: map[string]interface{}{
+			"ID":            o.ID,
+			"name":          o.Name,
+			"comment":       o.Comment,
+			"referencetime": o.ReferenceTime,
+			"lasteditid":    o.LastEditID,
+		},
+		Features: features,
+	}
+
+	b, err := json.Marshal(&fc)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return b, nil
+}
+
+type kmlDoc struct {
+	XMLName  xml.Name `xml:"kml"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Document struct {
+		Name        string      `xml:"name"`
+		Description string      `xml:"description,omitempty"`
+		Folders     []kmlFolder `xml:"Folder"`
+	} `xml:"Document"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	ID          string      `xml:"id,attr,omitempty"`
+	Name        string      `xml:"name"`
+	Description string      `xml:"description,omitempty"`
+	Point       *kmlCoords  `xml:"Point,omitempty"`
+	LineString  *kmlCoords  `xml:"LineString,omitempty"`
+	Polygon     *kmlPolygon `xml:"Polygon,omitempty"`
+}
+
+type kmlCoords struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlPolygon struct {
+	Outer struct {
+		LinearRing kmlCoords `xml:"LinearRing"`
+	} `xml:"outerBoundaryIs"`
+}
+
+func kmlCoord(lat, lon float64) string {
+	return strconv.FormatFloat(lon, 'f', 6, 64) + "," + strconv.FormatFloat(lat, 'f', 6, 64)
+}
+
+func (o *Operation) exportKML() ([]byte, error) {
+	portals := o.exportPortalMap()
+
+	var doc kmlDoc
+	doc.Xmlns = "http://www.opengis.net/kml/2.2"
+	doc.Document.Name = o.Name
+	doc.Document.Description = o.Comment
+
+	pf := kmlFolder{Name: "Portals"}
+	for _, p := range o.OpPortals {
+		pt, ok := portals[p.ID]
+		if !ok {
+			continue
+		}
+		pf.Placemarks = append(pf.Placemarks, kmlPlacemark{
+			ID:          string(p.ID),
+			Name:        p.Name,
+			Description: p.Comment,
+			Point:       &kmlCoords{Coordinates: kmlCoord(pt.Lat, pt.Lon)},
+		})
+	}
+
+	lf := kmlFolder{Name: "Links"}
+	for _, l := range o.Links {
+		from, fok := portals[l.From]
+		to, tok := portals[l.To]
+		if !fok || !tok {
+			continue
+		}
+		lf.Placemarks = append(lf.Placemarks, kmlPlacemark{
+			ID:          string(l.ID),
+			Name:        fmt.Sprintf("%d: %s - %s", l.Order, from.Portal.Name, to.Portal.Name),
+			Description: fmt.Sprintf("color: %s\nstate: %s\nzone: %d\n%s", l.Color, l.State, l.Zone, l.Comment),
+			LineString:  &kmlCoords{Coordinates: kmlCoord(from.Lat, from.Lon) + " " + kmlCoord(to.Lat, to.Lon)},
+		})
+	}
+
+	mf := kmlFolder{Name: "Markers"}
+	for _, m := range o.Markers {
+		pt, ok := portals[m.PortalID]
+		if !ok {
+			continue
+		}
+		desc := []string{fmt.Sprintf("state: %s", m.State), fmt.Sprintf("zone: %d", m.Zone)}
+		for _, a := range m.Attributes {
+			desc = append(desc, fmt.Sprintf("%s: %s", a.Name, a.Value))
+		}
+		if m.Comment != "" {
+			desc = append(desc, m.Comment)
+		}
+		mf.Placemarks = append(mf.Placemarks, kmlPlacemark{
+			ID:          string(m.ID),
+			Name:        fmt.Sprintf("%s: %s", NewMarkerType(m.Type), pt.Portal.Name),
+			Description: strings.Join(desc, "\n"),
+			Point:       &kmlCoords{Coordinates: kmlCoord(pt.Lat, pt.Lon)},
+		})
+	}
+
+	tf := kmlFolder{Name: "Tasks"}
+	for _, g := range o.Tasks {
+		pt, ok := exportTaskPoint(portals, g)
+		if !ok {
+			continue
+		}
+		desc := []string{fmt.Sprintf("state: %s", g.State), fmt.Sprintf("zone: %d", g.Zone)}
+		if pt.Portal.Name != "" {
+			desc = append(desc, fmt.Sprintf("portal: %s", pt.Portal.Name))
+		}
+		if g.Comment != "" {
+			desc = append(desc, g.Comment)
+		}
+		tf.Placemarks = append(tf.Placemarks, kmlPlacemark{
+			ID:          string(g.ID),
+			Name:        fmt.Sprintf("%d: %s", g.Order, g.Name),
+			Description: strings.Join(desc, "\n"),
+			Point:       &kmlCoords{Coordinates: kmlCoord(pt.Lat, pt.Lon)},
+		})
+	}
+
+	zf := kmlFolder{Name: "Zones"}
+	for _, z := range o.Zones {
+		ring := zoneRing(z)
+		if len(ring) < 4 {
+			continue
+		}
+		coords := make([]string, 0, len(ring))
+		for _, p := range ring {
+			coords = append(coords, kmlCoord(p.Lat, p.Lon))
+		}
+		var poly kmlPolygon
+		poly.Outer.LinearRing.Coordinates = strings.Join(coords, " ")
+		zf.Placemarks = append(zf.Placemarks, kmlPlacemark{
+			ID:      strconv.Itoa(int(z.Zone)),
+			Name:    z.Name,
+			Polygon: &poly,
+		})
+	}
+
+	doc.Document.Folders = []kmlFolder{pf, lf, mf, tf, zf}
+	return marshalXML(&doc)
+}
+
+type gpxDoc struct {
+	XMLName   xml.Name `xml:"gpx"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	Version   string   `xml:"version,attr"`
+	Creator   string   `xml:"creator,attr"`
+	Metadata  gpxMeta  `xml:"metadata"`
+	Waypoints []gpxWpt `xml:"wpt"`
+	Routes    []gpxRte `xml:"rte"`
+}
+
+type gpxMeta struct {
+	Name string `xml:"name"`
+	Desc string `xml:"desc,omitempty"`
+}
+
+type gpxWpt struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Name string  `xml:"name,omitempty"`
+	Desc string  `xml:"desc,omitempty"`
+	Type string  `xml:"type,omitempty"`
+}
+
+type gpxRte struct {
+	Name   string   `xml:"name,omitempty"`
+	Desc   string   `xml:"desc,omitempty"`
+	Type   string   `xml:"type,omitempty"`
+	Points []gpxWpt `xml:"rtept"`
+}
+
+func (o *Operation) exportGPX() ([]byte, error) {
+	portals := o.exportPortalMap()
+
+	doc := gpxDoc{
+		Xmlns:    "http://www.topografix.com/GPX/1/1",
+		Version:  "1.1",
+		Creator:  "Wasabee",
+		Metadata: gpxMeta{Name: o.Name, Desc: o.Comment},
+	}
+
+	for _, p := range o.OpPortals {
+		pt, ok := portals[p.ID]
+		if !ok {
+			continue
+		}
+		doc.Waypoints = append(doc.Waypoints, gpxWpt{Lat: pt.Lat, Lon: pt.Lon, Name: p.Name, Desc: p.Comment, Type: "portal"})
+	}
+
+	for _, m := range o.Markers {
+		pt, ok := portals[m.PortalID]
+		if !ok {
+			continue
+		}
+		doc.Waypoints = append(doc.Waypoints, gpxWpt{
+			Lat:  pt.Lat,
+			Lon:  pt.Lon,
+			Name: fmt.Sprintf("%s: %s", NewMarkerType(m.Type), pt.Portal.Name),
+			Desc: m.Comment,
+			Type: NewMarkerType(m.Type),
+		})
+	}
+
+	for _, g := range o.Tasks {
+		pt, ok := exportTaskPoint(portals, g)
+		if !ok {
+			continue
+		}
+		doc.Waypoints = append(doc.Waypoints, gpxWpt{
+			Lat:  pt.Lat,
+			Lon:  pt.Lon,
+			Name: g.Name,
+			Desc: g.Comment,
+			Type: "task",
+		})
+	}
+
+	for _, l := range o.Links {
+		from, fok := portals[l.From]
+		to, tok := portals[l.To]
+		if !fok || !tok {
+			continue
+		}
+		doc.Routes = append(doc.Routes, gpxRte{
+			Name: fmt.Sprintf("%d: %s - %s", l.Order, from.Portal.Name, to.Portal.Name),
+			Desc: l.Comment,
+			Type: "link",
+			Points: []gpxWpt{
+				{Lat: from.Lat, Lon: from.Lon, Name: from.Portal.Name},
+				{Lat: to.Lat, Lon: to.Lon, Name: to.Portal.Name},
+			},
+		})
+	}
+
+	for _, z := range o.Zones {
+		ring := zoneRing(z)
+		if len(ring) < 4 {
+			continue
+		}
+		r := gpxRte{Name: z.Name, Type: "zone"}
+		for _, p := range ring {
+			r.Points = append(r.Points, gpxWpt{Lat: p.Lat, Lon: p.Lon})
+		}
+		doc.Routes = append(doc.Routes, r)
+	}
+
+	return marshalXML(&doc)
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
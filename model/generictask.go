@@ -0,0 +1,246 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// GenericTask is a task which is not a link or a marker: bringing gear to a meetup, driving a team, watching comms
+// the portal and the location are both optional
+type GenericTask struct {
+	ID       TaskID   `json:"ID"`
+	Name     string   `json:"name"`
+	PortalID PortalID `json:"portalId,omitempty"`
+	Lat      string   `json:"lat,omitempty"` // passing these as strings saves me parsing them
+	Lon      string   `json:"lng,omitempty"`
+	Task
+}
+
+// location returns the task's location as lat, lon; ok is false if it has none or it is not usable
+func (g *GenericTask) location() (float64, float64, bool) {
+	return parseLatLon(g.Lat, g.Lon)
+}
+
+// parseLatLon converts the string form of a location, ok is false if it is missing or not usable
+func parseLatLon(lat, lon string) (float64, float64, bool) {
+	if lat == "" || lon == "" {
+		return 0, 0, false
+	}
+	la, err := strconv.ParseFloat(lat, 64)
+	if err != nil || la < -90 || la > 90 {
+		return 0, 0, false
+	}
+	lo, err := strconv.ParseFloat(lon, 64)
+	if err != nil || lo < -180 || lo > 180 {
+		return 0, 0, false
+	}
+	return la, lo, true
+}
+
+// insertGenericTask adds a generic task to the database, if the task exists it is updated
+func (opID OperationID) insertGenericTask(g GenericTask, gid GoogleID, tx *sql.Tx) error {
+	if g.ID == "" {
+		g.ID = TaskID(util.GenerateID(40))
+	}
+
+	// copy these values down
+	g.Task.ID = g.ID
+	g.opID = opID
+
+	if g.State == "" {
+		g.State = "pending"
+	}
+	if !g.Zone.Valid() || g.Zone == ZoneAll {
+		g.Zone = zonePrimary
+	}
+
+	comment := makeNullString(util.Sanitize(g.Comment))
+	if err := g.logUpload(gid, comment.String, tx); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec("INSERT INTO task (ID, opID, comment, taskorder, state, zone, delta) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE comment = ?, taskorder = ?, state = ?, zone = ?, delta = ?",
+		g.ID, opID, comment, g.Order, g.State, g.Zone, g.DeltaMinutes,
+		comment, g.Order, g.State, g.Zone, g.DeltaMinutes)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	name := util.Sanitize(g.Name)
+	portal := makeNullString(string(g.PortalID))
+	if lat, lon, ok := g.location(); ok {
+		_, err = tx.Exec("REPLACE INTO generictask (ID, opID, name, portalID, loc) VALUES (?, ?, ?, ?, POINT(?, ?))", g.ID, opID, name, portal, lon, lat) // REPLACE OK SCB
+	} else {
+		_, err = tx.Exec("REPLACE INTO generictask (ID, opID, name, portalID, loc) VALUES (?, ?, ?, ?, NULL)", g.ID, opID, name, portal) // REPLACE OK SCB
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	// empty assignments clears them
+	if err := g.SetAssignments(gid, g.Assignments, tx); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	// generic tasks are new, there are no old clients to worry about: an empty list clears them
+	if _, err := tx.Exec("DELETE FROM depends WHERE opID = ? AND taskID = ?", opID, g.ID); err != nil {
+		log.Error(err)
+		return err
+	}
+	if err := g.SetDepends(g.DependsOn, tx); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (opID OperationID) deleteGenericTask(id TaskID, tx *sql.Tx) error {
+	// deleting the task cascades to the generictask
+	if _, err := tx.Exec("DELETE FROM task WHERE opID = ? and ID = ?", opID, id); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	// nothing can depend on a task which no longer exists
+	if _, err := tx.Exec("DELETE FROM depends WHERE opID = ? and dependsOn = ?", opID, id); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// populateGenericTasks fills in the Tasks list for the Operation.
+func (o *Operation) populateGenericTasks(zones []Zone, gid GoogleID, assignments map[TaskID][]GoogleID, depends map[TaskID][]TaskID) error {
+	o.Tasks = make([]GenericTask, 0)
+
+	rows, err := db.Query("SELECT generictask.ID, generictask.name, generictask.portalID, Y(generictask.loc) AS lat, X(generictask.loc) AS lon, task.comment, task.state, task.taskorder, task.zone, task.delta FROM generictask JOIN task ON generictask.ID = task.ID AND generictask.opID = task.opID WHERE generictask.opID = ?", o.ID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g GenericTask
+		var portal, lat, lon, comment sql.NullString
+		g.opID = o.ID
+
+		if err := rows.Scan(&g.ID, &g.Name, &portal, &lat, &lon, &comment, &g.State, &g.Order, &g.Zone, &g.DeltaMinutes); err != nil {
+			log.Error(err)
+			continue
+		}
+		// fill in shadowed ID
+		g.Task.ID = g.ID
+		g.PortalID = PortalID(portal.String)
+		g.Lat = lat.String
+		g.Lon = lon.String
+		g.Comment = comment.String
+
+		if g.State == "" { // enums in sql default to "" if invalid
+			g.State = "pending"
+		}
+		if a, ok := assignments[g.ID]; ok {
+			g.Assignments = a
+		}
+		if d, ok := depends[g.ID]; ok {
+			g.DependsOn = d
+		}
+
+		if !g.Zone.inZones(zones) && !g.IsAssignedTo(gid) {
+			continue
+		}
+		o.Tasks = append(o.Tasks, g)
+	}
+	return nil
+}
+
+// GetGenericTask looks up and returns a generic task from a populated op
+func (o *Operation) GetGenericTask(taskID TaskID) (*GenericTask, error) {
+	for _, g := range o.Tasks {
+		if g.ID == taskID {
+			return &g, nil
+		}
+	}
+	return &GenericTask{}, errors.New(ErrTaskNotFound)
+}
+
+// drawOpUpdateGenericTasks writes the generic tasks sent in a full upload, those not sent are removed
+func drawOpUpdateGenericTasks(o *Operation, portals map[PortalID]bool, gid GoogleID, tx *sql.Tx) error {
+	current := make(map[TaskID]bool)
+	rows, err := tx.Query("SELECT ID FROM generictask WHERE opID = ?", o.ID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id TaskID
+		if err := rows.Scan(&id); err != nil {
+			log.Error(err)
+			continue
+		}
+		current[id] = true
+	}
+
+	if err := o.checkGenericTasks(portals); err != nil {
+		return err
+	}
+
+	for _, g := range o.Tasks {
+		if err := o.ID.insertGenericTask(g, gid, tx); err != nil {
+			return err
+		}
+		delete(current, g.ID)
+	}
+
+	for id := range current {
+		if err := o.ID.deleteGenericTask(id, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGenericTasks makes sure the op's generic tasks refer to known portals and do not reuse the ID of a link or marker
+func (o *Operation) checkGenericTasks(portals map[PortalID]bool) error {
+	// links and markers share the task table
+	others := make(map[TaskID]bool)
+	for _, l := range o.Links {
+		others[TaskID(l.ID)] = true
+	}
+	for _, m := range o.Markers {
+		others[TaskID(m.ID)] = true
+	}
+
+	for _, g := range o.Tasks {
+		if others[g.ID] {
+			err := errors.New("task ID already in use by a link or marker")
+			log.Warnw(err.Error(), "task", g.ID, "resource", o.ID)
+			return err
+		}
+		if g.PortalID != "" {
+			if !portals[g.PortalID] {
+				err := errors.New("attempt to add task to unknown portal")
+				log.Warnw(err.Error(), "portal", g.PortalID, "resource", o.ID)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clearGenericTaskPortals drops the portal from generic tasks whose portal has been removed from the op
+func (opID OperationID) clearGenericTaskPortals(tx *sql.Tx) error {
+	if _, err := tx.Exec("UPDATE generictask SET portalID = NULL WHERE opID = ? AND portalID IS NOT NULL AND portalID NOT IN (SELECT ID FROM portal WHERE opID = ?)", opID, opID); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// import formats
+const (
+	ImportDrawTools = "drawtools"
+	ImportGeoJSON   = "geojson"
+)
+
+// importDefaultTolerance is how far, in meters, a vertex may be from a portal and still match it
+const importDefaultTolerance = 10.0
+
+// importZonePointsMax is the most points a polygon can have and still become a zone, positions are stored as a tinyint
+const importZonePointsMax = 256
+
+// ImportRequest is the data sent to create an op from IITC draw-tools or GeoJSON data
+type ImportRequest struct {
+	Format     string          `json:"format"` // drawtools or geojson
+	Name       string          `json:"name"`
+	Color      string          `json:"color"`
+	Data       json.RawMessage `json:"data"`
+	Portals    []Portal        `json:"portals"`    // checked before the portals in the agent's ops
+	Tolerance  float64         `json:"tolerance"`  // meters
+	MarkerType MarkerType      `json:"markertype"` // used for points, defaults to goto
+}
+
+// ImportReport describes the op created by an import
+type ImportReport struct {
+	ID        OperationID   `json:"ID"`
+	Portals   int           `json:"portals"`
+	Links     int           `json:"links"`
+	Markers   int           `json:"markers"`
+	Zones     int           `json:"zones"`
+	Unmatched []ImportPoint `json:"unmatched"`
+	Skipped   []ImportSkip  `json:"skipped"` // shapes which were not imported at all
+}
+
+// ImportSkip is a shape which could not be imported and why
+type ImportSkip struct {
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+// ImportPoint is a vertex which could not be matched to a portal
+type ImportPoint struct {
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lng"`
+	Source string  `json:"source"` // the shape the point belongs to
+}
+
+// importShape is the common form of draw-tools and GeoJSON items
+type importShape struct {
+	kind   string // line, polygon, point
+	name   string
+	points []ImportPoint
+}
+
+// Import builds a new op owned by gid from draw-tools or GeoJSON data
+// vertices are matched to the supplied portals, then to the portals in ops the agent can fully read
+func Import(ctx context.Context, gid GoogleID, in ImportRequest) (*ImportReport, error) {
+	var shapes []importShape
+	var err error
+
+	switch in.Format {
+	case ImportDrawTools:
+		shapes, err = parseDrawTools(in.Data)
+	case ImportGeoJSON, "":
+		shapes, err = parseGeoJSON(in.Data)
+	default:
+		err = errors.New(ErrUnknownImportFormat)
+	}
+	if err != nil {
+		log.Infow("import failed", "GID", gid, "format", in.Format, "error", err.Error())
+		return nil, err
+	}
+
+	if in.Tolerance <= 0 {
+		in.Tolerance = importDefaultTolerance
+	}
+	if in.MarkerType == "" {
+		in.MarkerType = "goto"
+	}
+	in.MarkerType = MarkerType(NewMarkerType(in.MarkerType))
+	if _, ok := markerTypeSchema(in.MarkerType); !ok {
+		err := errors.New(ErrUnknownMarkerType)
+		log.Infow("import failed", "GID", gid, "markertype", in.MarkerType, "error", err.Error())
+		return nil, err
+	}
+
+	m, err := newPortalMatcher(gid, in.Portals, in.Tolerance)
+	if err != nil {
+		return nil, err
+	}
+
+	o := Operation{
+		ID:    OperationID(util.GenerateID(40)),
+		Name:  in.Name,
+		Color: in.Color,
+		Zones: defaultZones(),
+	}
+	if o.Name == "" {
+		o.Name = "imported op"
+	}
+	if o.Color == "" {
+		o.Color = "main"
+	}
+
+	report := ImportReport{ID: o.ID, Unmatched: make([]ImportPoint, 0), Skipped: make([]ImportSkip, 0)}
+	portals := make(map[PortalID]Portal)
+	seenLinks := make(map[string]bool)
+	var order int16
+
+	addLink := func(from, to Portal) {
+		if from.ID == to.ID {
+			return
+		}
+		key := string(from.ID) + ":" + string(to.ID)
+		rkey := string(to.ID) + ":" + string(from.ID)
+		if seenLinks[key] || seenLinks[rkey] {
+			return
+		}
+		seenLinks[key] = true
+		portals[from.ID] = from
+		portals[to.ID] = to
+
+		order++
+		id := util.GenerateID(40)
+		l := Link{ID: LinkID(id), From: from.ID, To: to.ID, Color: "main"}
+		l.Task.ID = TaskID(id)
+		l.Order = order
+		o.Links = append(o.Links, l)
+	}
+
+	nextZone := zonePrimary + 1
+	for _, s := range shapes {
+		matched := make([]Portal, len(s.points))
+		var unmatched []ImportPoint
+		for i, pt := range s.points {
+			p, ok := m.match(pt.Lat, pt.Lon)
+			if !ok {
+				pt.Source = s.name
+				unmatched = append(unmatched, pt)
+				continue
+			}
+			matched[i] = p
+		}
+
+		switch s.kind {
+		case "point":
+			if len(unmatched) > 0 {
+				report.Unmatched = append(report.Unmatched, unmatched...)
+				continue
+			}
+			p := matched[0]
+			portals[p.ID] = p
+			order++
+			id := util.GenerateID(40)
+			mk := Marker{ID: MarkerID(id), PortalID: p.ID, Type: in.MarkerType}
+			mk.Task.ID = TaskID(id)
+			mk.Order = order
+			mk.Comment = s.name
+			o.Markers = append(o.Markers, mk)
+		case "line":
+			report.Unmatched = append(report.Unmatched, unmatched...)
+			for i := 1; i < len(matched); i++ {
+				if matched[i-1].ID != "" && matched[i].ID != "" {
+					addLink(matched[i-1], matched[i])
+				}
+			}
+		case "polygon":
+			// fully matched polygons are fields, anything else is an area and becomes a zone
+			if len(unmatched) == 0 && len(matched) > 1 {
+				for i := range matched {
+					addLink(matched[i], matched[(i+1)%len(matched)])
+				}
+				continue
+			}
+			// the polygon's vertices do not all match portals, report those which do not
+			report.Unmatched = append(report.Unmatched, unmatched...)
+			switch {
+			case len(s.points) < 3:
+				report.Skipped = append(report.Skipped, ImportSkip{Source: s.name, Reason: "a zone needs at least 3 points"})
+				continue
+			case len(s.points) > importZonePointsMax:
+				report.Skipped = append(report.Skipped, ImportSkip{Source: s.name, Reason: fmt.Sprintf("a zone can have at most %d points", importZonePointsMax)})
+				continue
+			case nextZone > zoneMax:
+				report.Skipped = append(report.Skipped, ImportSkip{Source: s.name, Reason: "no zones left"})
+				continue
+			}
+			z := ZoneListElement{Name: s.name, Color: "green", Zone: nextZone}
+			if z.Name == "" {
+				z.Name = fmt.Sprintf("zone %d", nextZone)
+			}
+			for i, pt := range s.points {
+				z.Points = append(z.Points, zonepoint{Position: uint8(i), Lat: pt.Lat, Lon: pt.Lon})
+			}
+			o.Zones = append(o.Zones, z)
+			nextZone++
+		}
+	}
+
+	for _, p := range portals {
+		o.OpPortals = append(o.OpPortals, p)
+	}
+
+	if len(o.OpPortals) == 0 && len(o.Zones) == 1 {
+		err := errors.New(ErrImportNoMatches)
+		log.Infow(err.Error(), "GID", gid, "unmatched", len(report.Unmatched))
+		return &report, err
+	}
+
+	if err := DrawInsert(ctx, &o, gid); err != nil {
+		return nil, err
+	}
+
+	report.Portals = len(o.OpPortals)
+	report.Links = len(o.Links)
+	report.Markers = len(o.Markers)
+	report.Zones = len(o.Zones) - 1
+	log.Infow("imported operation", "GID", gid, "resource", o.ID, "format", in.Format, "links", report.Links, "markers", report.Markers, "unmatched", len(report.Unmatched))
+	return &report, nil
+}
+
+// portalMatcher finds the portal at a location, looking first at the supplied portals then in the agent's ops
+type portalMatcher struct {
+	supplied  []Portal
+	ops       []OperationID
+	tolerance float64
+}
+
+func newPortalMatcher(gid GoogleID, supplied []Portal, tolerance float64) (*portalMatcher, error) {
+	ops, err := gid.fullReadOps()
+	if err != nil {
+		return nil, err
+	}
+	return &portalMatcher{supplied: supplied, ops: ops, tolerance: tolerance}, nil
+}
+
+func (m *portalMatcher) match(lat, lon float64) (Portal, bool) {
+	var best Portal
+	bestDistance := m.tolerance
+
+	for _, p := range m.supplied {
+		plat, err := strconv.ParseFloat(p.Lat, 64)
+		if err != nil {
+			continue
+		}
+		plon, err := strconv.ParseFloat(p.Lon, 64)
+		if err != nil {
+			continue
+		}
+		if d := util.Distance(lat, lon, plat, plon); d <= bestDistance {
+			best, bestDistance = Portal{ID: p.ID, Name: p.Name, Lat: p.Lat, Lon: p.Lon}, d
+		}
+	}
+	if best.ID != "" {
+		return best, true
+	}
+
+	if len(m.ops) == 0 {
+		return best, false
+	}
+
+	minLat, minLon, maxLat, maxLon := util.BoundingBox(lat, lon, m.tolerance)
+	args := []interface{}{minLon, maxLon, minLat, maxLat}
+	for _, opID := range m.ops {
+		args = append(args, opID)
+	}
+	// #nosec -- only placeholders are added to the query
+	q := fmt.Sprintf("SELECT ID, name, Y(loc), X(loc) FROM portal WHERE X(loc) BETWEEN ? AND ? AND Y(loc) BETWEEN ? AND ? AND opID IN (?%s)", strings.Repeat(",?", len(m.ops)-1))
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		log.Error(err)
+		return best, false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Portal
+		var plat, plon float64
+		if err := rows.Scan(&p.ID, &p.Name, &plat, &plon); err != nil {
+			log.Error(err)
+			continue
+		}
+		if d := util.Distance(lat, lon, plat, plon); d <= bestDistance {
+			p.Lat = strconv.FormatFloat(plat, 'f', 6, 64)
+			p.Lon = strconv.FormatFloat(plon, 'f', 6, 64)
+			best, bestDistance = p, d
+		}
+	}
+	return best, best.ID != ""
+}
+
+// IITC draw-tools export format
+type drawToolsItem struct {
+	Type    string          `json:"type"`
+	LatLng  *drawToolsPoint `json:"latLng"`
+	LatLngs json.RawMessage `json:"latLngs"`
+	Color   string          `json:"color"`
+}
+
+type drawToolsPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+func parseDrawTools(data json.RawMessage) ([]importShape, error) {
+	var items []drawToolsItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		log.Info(err)
+		return nil, err
+	}
+
+	var shapes []importShape
+	for i, item := range items {
+		name := fmt.Sprintf("%s %d", item.Type, i)
+		switch item.Type {
+		case "marker":
+			if item.LatLng == nil {
+				continue
+			}
+			shapes = append(shapes, importShape{kind: "point", name: name, points: []ImportPoint{{Lat: item.LatLng.Lat, Lon: item.LatLng.Lng}}})
+		case "polyline", "polygon":
+			var pts []drawToolsPoint
+			if err := json.Unmarshal(item.LatLngs, &pts); err != nil {
+				// some versions nest polygon rings
+				var rings [][]drawToolsPoint
+				if err := json.Unmarshal(item.LatLngs, &rings); err != nil || len(rings) == 0 {
+					log.Infow("skipping unparsable draw-tools item", "index", i, "type", item.Type)
+					continue
+				}
+				pts = rings[0]
+			}
+			s := importShape{kind: "line", name: name}
+			if item.Type == "polygon" {
+				s.kind = "polygon"
+			}
+			for _, p := range pts {
+				s.points = append(s.points, ImportPoint{Lat: p.Lat, Lon: p.Lng})
+			}
+			shapes = append(shapes, s)
+		default:
+			// circles and anything else have no meaning here
+			log.Debugw("skipping draw-tools item", "index", i, "type", item.Type)
+		}
+	}
+	return shapes, nil
+}
+
+// GeoJSON objects, only the parts needed for import
+type geoJSONObject struct {
+	Type        string                 `json:"type"`
+	Features    []geoJSONObject        `json:"features"`
+	Geometry    *geoJSONObject         `json:"geometry"`
+	Geometries  []geoJSONObject        `json:"geometries"`
+	Coordinates json.RawMessage        `json:"coordinates"`
+	Properties  map[string]interface{} `json:"properties"`
+	ID          json.RawMessage        `json:"id"`
+}
+
+func parseGeoJSON(data json.RawMessage) ([]importShape, error) {
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		log.Info(err)
+		return nil, err
+	}
+
+	var shapes []importShape
+	if err := obj.shapes("", &shapes); err != nil {
+		return nil, err
+	}
+	return shapes, nil
+}
+
+func (g *geoJSONObject) shapes(name string, out *[]importShape) error {
+	if name == "" && g.Properties != nil {
+		if n, ok := g.Properties["name"].(string); ok {
+			name = n
+		}
+	}
+
+	toPoint := func(c []float64) (ImportPoint, error) {
+		if len(c) < 2 {
+			return ImportPoint{}, errors.New("invalid GeoJSON position")
+		}
+		return ImportPoint{Lat: c[1], Lon: c[0]}, nil
+	}
+	toPoints := func(cs [][]float64) ([]ImportPoint, error) {
+		var pts []ImportPoint
+		for _, c := range cs {
+			p, err := toPoint(c)
+			if err != nil {
+				return nil, err
+			}
+			pts = append(pts, p)
+		}
+		return pts, nil
+	}
+	// GeoJSON rings repeat the first point at the end
+	openRing := func(pts []ImportPoint) []ImportPoint {
+		if len(pts) > 1 && pts[0] == pts[len(pts)-1] {
+			return pts[:len(pts)-1]
+		}
+		return pts
+	}
+
+	switch g.Type {
+	case "FeatureCollection":
+		for i := range g.Features {
+			if err := g.Features[i].shapes("", out); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if g.Geometry != nil {
+			return g.Geometry.shapes(name, out)
+		}
+	case "GeometryCollection":
+		for i := range g.Geometries {
+			if err := g.Geometries[i].shapes(name, out); err != nil {
+				return err
+			}
+		}
+	case "Point":
+		var c []float64
+		if err := json.Unmarshal(g.Coordinates, &c); err != nil {
+			return err
+		}
+		p, err := toPoint(c)
+		if err != nil {
+			return err
+		}
+		*out = append(*out, importShape{kind: "point", name: name, points: []ImportPoint{p}})
+	case "MultiPoint":
+		var cs [][]float64
+		if err := json.Unmarshal(g.Coordinates, &cs); err != nil {
+			return err
+		}
+		for _, c := range cs {
+			p, err := toPoint(c)
+			if err != nil {
+				return err
+			}
+			*out = append(*out, importShape{kind: "point", name: name, points: []ImportPoint{p}})
+		}
+	case "LineString":
+		var cs [][]float64
+		if err := json.Unmarshal(g.Coordinates, &cs); err != nil {
+			return err
+		}
+		pts, err := toPoints(cs)
+		if err != nil {
+			return err
+		}
+		*out = append(*out, importShape{kind: "line", name: name, points: pts})
+	case "MultiLineString":
+		var lines [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &lines); err != nil {
+			return err
+		}
+		for _, cs := range lines {
+			pts, err := toPoints(cs)
+			if err != nil {
+				return err
+			}
+			*out = append(*out, importShape{kind: "line", name: name, points: pts})
+		}
+	case "Polygon":
+		var rings [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+			return err
+		}
+		if len(rings) == 0 {
+			return nil
+		}
+		// holes are ignored
+		pts, err := toPoints(rings[0])
+		if err != nil {
+			return err
+		}
+		*out = append(*out, importShape{kind: "polygon", name: name, points: openRing(pts)})
+	case "MultiPolygon":
+		var polys [][][][]float64
+		if err := json.Unmarshal(g.Coordinates, &polys); err != nil {
+			return err
+		}
+		for _, rings := range polys {
+			if len(rings) == 0 {
+				continue
+			}
+			pts, err := toPoints(rings[0])
+			if err != nil {
+				return err
+			}
+			*out = append(*out, importShape{kind: "polygon", name: name, points: openRing(pts)})
+		}
+	default:
+		return fmt.Errorf("unsupported GeoJSON type: %s", g.Type)
+	}
+	return nil
+}
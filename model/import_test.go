@@ -0,0 +1,71 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseDrawTools(t *testing.T) {
+	data := json.RawMessage(`[
+		{"type":"polyline","latLngs":[{"lat":1,"lng":2},{"lat":3,"lng":4}],"color":"#a24ac3"},
+		{"type":"polygon","latLngs":[[{"lat":0,"lng":0},{"lat":0,"lng":1},{"lat":1,"lng":1}]]},
+		{"type":"marker","latLng":{"lat":5,"lng":6}},
+		{"type":"circle","latLng":{"lat":7,"lng":8},"radius":100}
+	]`)
+
+	shapes, err := parseDrawTools(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shapes) != 3 {
+		t.Fatalf("got %d shapes, want 3 (circles are skipped)", len(shapes))
+	}
+	if shapes[0].kind != "line" || len(shapes[0].points) != 2 || shapes[0].points[1] != (ImportPoint{Lat: 3, Lon: 4}) {
+		t.Errorf("polyline parsed as %+v", shapes[0])
+	}
+	if shapes[1].kind != "polygon" || len(shapes[1].points) != 3 {
+		t.Errorf("nested polygon parsed as %+v", shapes[1])
+	}
+	if shapes[2].kind != "point" || shapes[2].points[0] != (ImportPoint{Lat: 5, Lon: 6}) {
+		t.Errorf("marker parsed as %+v", shapes[2])
+	}
+
+	if _, err := parseDrawTools(json.RawMessage(`{"type":"marker"}`)); err == nil {
+		t.Error("draw-tools data must be a list")
+	}
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	data := json.RawMessage(`{
+		"type":"FeatureCollection",
+		"features":[
+			{"type":"Feature","properties":{"name":"route"},"geometry":{"type":"LineString","coordinates":[[2,1],[4,3]]}},
+			{"type":"Feature","properties":{"name":"area"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}},
+			{"type":"Feature","properties":{},"geometry":{"type":"MultiPoint","coordinates":[[6,5],[8,7]]}}
+		]
+	}`)
+
+	shapes, err := parseGeoJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shapes) != 4 {
+		t.Fatalf("got %d shapes, want 4", len(shapes))
+	}
+
+	// GeoJSON positions are longitude first
+	if shapes[0].kind != "line" || shapes[0].name != "route" || shapes[0].points[0] != (ImportPoint{Lat: 1, Lon: 2}) {
+		t.Errorf("line parsed as %+v", shapes[0])
+	}
+	// the closing point of a ring is dropped
+	if shapes[1].kind != "polygon" || shapes[1].name != "area" || len(shapes[1].points) != 3 {
+		t.Errorf("polygon parsed as %+v", shapes[1])
+	}
+	if shapes[2].kind != "point" || shapes[3].points[0] != (ImportPoint{Lat: 7, Lon: 8}) {
+		t.Errorf("multipoint parsed as %+v %+v", shapes[2], shapes[3])
+	}
+
+	if _, err := parseGeoJSON(json.RawMessage(`{"type":"Point","coordinates":[1]}`)); err == nil {
+		t.Error("a position needs a longitude and latitude")
+	}
+}
@@ -0,0 +1,138 @@
+package model
+
+import (
+	"sort"
+)
+
+// KeyRequirements lists the keys needed to throw an op's links and where they fall short
+type KeyRequirements struct {
+	ID         OperationID           `json:"ID"`
+	LastEditID string                `json:"lasteditid"`
+	Portals    []KeyRequirement      `json:"portals"`
+	Agents     []AgentKeyRequirement `json:"agents"`
+}
+
+// KeyRequirement is the key situation for a single portal
+// Required counts the incoming links which are not yet completed
+type KeyRequirement struct {
+	ID        PortalID    `json:"portalId"`
+	Name      string      `json:"name"`
+	Required  int32       `json:"required"`
+	Onhand    int32       `json:"onhand"`
+	Shortfall int32       `json:"shortfall"`
+	Holders   []KeyOnHand `json:"holders"` // per agent and capsule
+}
+
+// AgentKeyRequirement lists the keys an agent must carry for the links assigned to them
+type AgentKeyRequirement struct {
+	Gid     GoogleID         `json:"gid"`
+	Portals []AgentKeyNeeded `json:"portals"`
+}
+
+// AgentKeyNeeded is a portal for which an agent has assigned links
+// Onhand is only the agent's own keys, Shortfall is what they still need to farm or be given
+type AgentKeyNeeded struct {
+	ID        PortalID `json:"portalId"`
+	Name      string   `json:"name"`
+	Required  int32    `json:"required"`
+	Onhand    int32    `json:"onhand"`
+	Shortfall int32    `json:"shortfall"`
+	Links     []LinkID `json:"links"`
+}
+
+// KeyRequirements builds the key requirement report for the links and keys gid can see
+func (o *Operation) KeyRequirements(gid GoogleID) (*KeyRequirements, error) {
+	if err := o.Populate(gid); err != nil {
+		return nil, err
+	}
+
+	kr := KeyRequirements{
+		ID:         o.ID,
+		LastEditID: o.LastEditID,
+		Portals:    make([]KeyRequirement, 0),
+		Agents:     make([]AgentKeyRequirement, 0),
+	}
+
+	names := make(map[PortalID]string)
+	for _, p := range o.OpPortals {
+		names[p.ID] = p.Name
+	}
+
+	portals := make(map[PortalID]*KeyRequirement)
+	portal := func(id PortalID) *KeyRequirement {
+		r, ok := portals[id]
+		if !ok {
+			r = &KeyRequirement{ID: id, Name: names[id], Holders: make([]KeyOnHand, 0)}
+			portals[id] = r
+		}
+		return r
+	}
+
+	agents := make(map[GoogleID]map[PortalID]*AgentKeyNeeded)
+	for _, l := range o.Links {
+		if l.State == "completed" {
+			continue
+		}
+		portal(l.To).Required++
+
+		for _, a := range l.Assignments {
+			if _, ok := agents[a]; !ok {
+				agents[a] = make(map[PortalID]*AgentKeyNeeded)
+			}
+			n, ok := agents[a][l.To]
+			if !ok {
+				n = &AgentKeyNeeded{ID: l.To, Name: names[l.To]}
+				agents[a][l.To] = n
+			}
+			n.Required++
+			n.Links = append(n.Links, l.ID)
+		}
+	}
+
+	for _, k := range o.Keys {
+		// keys for portals without links are still listed so they are not forgotten
+		r := portal(k.ID)
+		r.Onhand += k.Onhand
+		r.Holders = append(r.Holders, k)
+
+		if n, ok := agents[k.Gid][k.ID]; ok {
+			n.Onhand += k.Onhand
+		}
+	}
+
+	for _, r := range portals {
+		if r.Required > r.Onhand {
+			r.Shortfall = r.Required - r.Onhand
+		}
+		kr.Portals = append(kr.Portals, *r)
+	}
+	// worst first
+	sort.Slice(kr.Portals, func(i, j int) bool {
+		if kr.Portals[i].Shortfall != kr.Portals[j].Shortfall {
+			return kr.Portals[i].Shortfall > kr.Portals[j].Shortfall
+		}
+		return kr.Portals[i].Name < kr.Portals[j].Name
+	})
+
+	for gid, needs := range agents {
+		a := AgentKeyRequirement{Gid: gid}
+		for _, n := range needs {
+			if n.Required > n.Onhand {
+				n.Shortfall = n.Required - n.Onhand
+			}
+			a.Portals = append(a.Portals, *n)
+		}
+		sort.Slice(a.Portals, func(i, j int) bool {
+			if a.Portals[i].Shortfall != a.Portals[j].Shortfall {
+				return a.Portals[i].Shortfall > a.Portals[j].Shortfall
+			}
+			return a.Portals[i].Name < a.Portals[j].Name
+		})
+		kr.Agents = append(kr.Agents, a)
+	}
+	sort.Slice(kr.Agents, func(i, j int) bool {
+		return kr.Agents[i].Gid < kr.Agents[j].Gid
+	})
+
+	return &kr, nil
+}
@@ -135,10 +135,15 @@ func (o *Operation) KeyOnHand(ctx context.Context, gid GoogleID, portalID Portal
 		}
 	}()
 
+	if err := o.ID.checkWritable(tx); err != nil {
+		return err
+	}
+
 	if err := o.insertKey(k, tx); err != nil {
 		log.Error(err)
 		return err
 	}
+	o.ID.logChange(changeKey, string(portalID), changeChange, tx)
 
 	if err := tx.Commit(); err != nil {
 		log.Error(err)
@@ -29,7 +29,7 @@ type Link struct {
 // TODO use the logic from insertZone to unify insertLink and updateLink
 
 // insertLink adds a link to the database
-func (opID OperationID) insertLink(l Link, tx *sql.Tx) error {
+func (opID OperationID) insertLink(l Link, gid GoogleID, tx *sql.Tx) error {
 	if l.To == l.From {
 		log.Infow("source and destination the same, ignoring link", "resource", opID)
 		return nil
@@ -75,7 +75,7 @@ func (opID OperationID) insertLink(l Link, tx *sql.Tx) error {
 	}
 
 	// clears if none set
-	if err := l.SetAssignments(l.Assignments, tx); err != nil {
+	if err := l.SetAssignments(gid, l.Assignments, tx); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -104,10 +104,17 @@ func (opID OperationID) deleteLink(lid LinkID, tx *sql.Tx) error {
 		log.Error(err)
 		return err
 	}
+
+	// nothing can depend on a task which no longer exists
+	_, err = tx.Exec("DELETE FROM depends WHERE opID = ? and dependsOn = ?", opID, lid)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
 	return nil
 }
 
-func (opID OperationID) updateLink(l Link, tx *sql.Tx) error {
+func (opID OperationID) updateLink(l Link, gid GoogleID, tx *sql.Tx) error {
 	if l.To == l.From {
 		log.Infow("source and destination the same, ignoring link", "resource", opID)
 		return nil
@@ -140,6 +147,10 @@ func (opID OperationID) updateLink(l Link, tx *sql.Tx) error {
 
 	comment := makeNullString(util.Sanitize(l.Comment))
 
+	if err := l.logUpload(gid, comment.String, tx); err != nil {
+		return err
+	}
+
 	_, err := tx.Exec("INSERT INTO task (ID, opID, comment, taskorder, state, zone, delta) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE comment = ?, taskorder = ?, state = ?, zone = ?, delta = ?",
 		l.ID, opID, comment, l.Order, l.State, l.Zone, l.DeltaMinutes,
 		comment, l.Order, l.State, l.Zone, l.DeltaMinutes)
@@ -155,7 +166,7 @@ func (opID OperationID) updateLink(l Link, tx *sql.Tx) error {
 	}
 
 	// empty assignments clears them
-	if err := l.SetAssignments(l.Assignments, tx); err != nil {
+	if err := l.SetAssignments(gid, l.Assignments, tx); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -175,7 +186,7 @@ func (opID OperationID) updateLink(l Link, tx *sql.Tx) error {
 func (o *Operation) populateLinks(zones []Zone, inGid GoogleID, assignments map[TaskID][]GoogleID, depends map[TaskID][]TaskID) error {
 	var description sql.NullString
 
-	rows, err := db.Query("SELECT link.ID, link.fromPortalID, link.toPortalID, task.comment, task.taskorder, task.state, link.color, task.zone, task.delta FROM link JOIN task ON link.ID = task.ID WHERE task.opID = ? AND link.opID = task.opID", o.ID)
+	rows, err := db.Query("SELECT link.ID, link.fromPortalID, link.toPortalID, task.comment, task.taskorder, task.state, link.color, link.mu, task.zone, task.delta FROM link JOIN task ON link.ID = task.ID WHERE task.opID = ? AND link.opID = task.opID", o.ID)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -186,7 +197,7 @@ func (o *Operation) populateLinks(zones []Zone, inGid GoogleID, assignments map[
 		tmpLink := Link{}
 		tmpLink.opID = o.ID
 
-		err := rows.Scan(&tmpLink.ID, &tmpLink.From, &tmpLink.To, &description, &tmpLink.Order, &tmpLink.State, &tmpLink.Color, &tmpLink.Zone, &tmpLink.DeltaMinutes)
+		err := rows.Scan(&tmpLink.ID, &tmpLink.From, &tmpLink.To, &description, &tmpLink.Order, &tmpLink.State, &tmpLink.Color, &tmpLink.MuCaptured, &tmpLink.Zone, &tmpLink.DeltaMinutes)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -229,34 +240,41 @@ func (l LinkID) String() string {
 
 // LinkOrder changes the order of the throws for an operation
 func (o *Operation) LinkOrder(order string) error {
-	stmt, err := db.Prepare("UPDATE link SET throworder = ? WHERE opID = ? AND ID = ?")
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-
-	pos := 1
-	links := strings.Split(order, ",")
-	for i := range links {
-		if links[i] == "000" { // the header, could be anyplace in the order if the user was being silly
-			continue
-		}
-		if _, err := stmt.Exec(pos, o.ID, links[i]); err != nil {
+	return o.ID.changeTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("UPDATE link SET throworder = ? WHERE opID = ? AND ID = ?")
+		if err != nil {
 			log.Error(err)
-			continue
+			return err
 		}
-		pos++
-	}
-	return err
+		defer stmt.Close()
+
+		pos := 1
+		links := strings.Split(order, ",")
+		for i := range links {
+			if links[i] == "000" { // the header, could be anyplace in the order if the user was being silly
+				continue
+			}
+			if _, err := stmt.Exec(pos, o.ID, links[i]); err != nil {
+				log.Error(err)
+				continue
+			}
+			o.ID.logChange(changeLink, links[i], changeChange, tx)
+			pos++
+		}
+		return nil
+	})
 }
 
 // SetColor changes the color of a link in an operation
 func (l *Link) SetColor(color string) error {
-	_, err := db.Exec("UPDATE link SET color = ? WHERE ID = ? and opID = ?", color, l.ID, l.opID)
-	if err != nil {
-		log.Error(err)
-	}
-	return err
+	return l.opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE link SET color = ? WHERE ID = ? and opID = ?", color, l.ID, l.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		l.opID.logChange(changeLink, string(l.ID), changeChange, tx)
+		return nil
+	})
 }
 
 // Swap changes the direction of a link in an operation
@@ -269,12 +287,14 @@ func (l *Link) Swap() error {
 		return err
 	}
 
-	_, err = db.Exec("UPDATE link SET fromPortalID = ?, toPortalID = ? WHERE ID = ? and opID = ?", tmpLink.To, tmpLink.From, l.ID, l.opID)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+	return l.opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE link SET fromPortalID = ?, toPortalID = ? WHERE ID = ? and opID = ?", tmpLink.To, tmpLink.From, l.ID, l.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		l.opID.logChange(changeLink, string(l.ID), changeChange, tx)
+		return nil
+	})
 }
 
 // GetLink looks up and returns a populated Link from an id
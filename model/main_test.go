@@ -0,0 +1,17 @@
+package model
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// the helpers tested here do not touch the database, they only need logging
+func TestMain(m *testing.M) {
+	log.Start(context.Background(), &log.Configuration{
+		Console: true,
+	})
+	os.Exit(m.Run())
+}
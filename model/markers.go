@@ -42,7 +42,11 @@ type Attribute struct {
 // TODO use the logic from insertZone to unify insertMarker and updateMarker
 
 // insertMarkers adds a marker to the database
-func (opID OperationID) insertMarker(m Marker, tx *sql.Tx) error {
+func (opID OperationID) insertMarker(m Marker, gid GoogleID, tx *sql.Tx) error {
+	if err := m.normalize(); err != nil {
+		return err
+	}
+
 	if m.State == "" {
 		m.State = "pending"
 	}
@@ -72,7 +76,7 @@ func (opID OperationID) insertMarker(m Marker, tx *sql.Tx) error {
 	}
 
 	// empty m.Assignments clears any
-	if err := m.SetAssignments(m.Assignments, tx); err != nil {
+	if err := m.SetAssignments(gid, m.Assignments, tx); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -85,17 +89,20 @@ func (opID OperationID) insertMarker(m Marker, tx *sql.Tx) error {
 		}
 	}
 
-	if len(m.Attributes) > 0 {
-		if err := m.setAttributes(m.Attributes, tx); err != nil {
-			log.Error(err)
-			return err
-		}
+	// normalize checked the attributes, the marker carries exactly what was sent
+	if err := m.setAttributes(m.Attributes, tx); err != nil {
+		log.Error(err)
+		return err
 	}
 
 	return nil
 }
 
-func (opID OperationID) updateMarker(m Marker, tx *sql.Tx) error {
+func (opID OperationID) updateMarker(m Marker, gid GoogleID, tx *sql.Tx) error {
+	if err := m.normalize(); err != nil {
+		return err
+	}
+
 	if m.State == "" {
 		m.State = "pending"
 	}
@@ -115,6 +122,10 @@ func (opID OperationID) updateMarker(m Marker, tx *sql.Tx) error {
 
 	comment := makeNullString(util.Sanitize(m.Comment))
 
+	if err := m.logUpload(gid, comment.String, tx); err != nil {
+		return err
+	}
+
 	_, err := tx.Exec("INSERT INTO task (ID, opID, comment, taskorder, state, zone, delta) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE comment = ?, taskorder = ?, state = ?, zone = ?, delta = ?",
 		m.ID, opID, comment, m.Order, m.State, m.Zone, m.DeltaMinutes,
 		comment, m.Order, m.State, m.Zone, m.DeltaMinutes)
@@ -129,7 +140,7 @@ func (opID OperationID) updateMarker(m Marker, tx *sql.Tx) error {
 	}
 
 	// empty m.Assignments clears any
-	if err := m.SetAssignments(m.Assignments, tx); err != nil {
+	if err := m.SetAssignments(gid, m.Assignments, tx); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -142,11 +153,10 @@ func (opID OperationID) updateMarker(m Marker, tx *sql.Tx) error {
 		}
 	}
 
-	if len(m.Attributes) > 0 {
-		if err := m.setAttributes(m.Attributes, tx); err != nil {
-			log.Error(err)
-			return err
-		}
+	// normalize checked the attributes, the marker carries exactly what was sent
+	if err := m.setAttributes(m.Attributes, tx); err != nil {
+		log.Error(err)
+		return err
 	}
 
 	return nil
@@ -165,6 +175,13 @@ func (opID OperationID) deleteMarker(mid MarkerID, tx *sql.Tx) error {
 		log.Error(err)
 		return err
 	}
+
+	// nothing can depend on a task which no longer exists
+	_, err = tx.Exec("DELETE FROM depends WHERE opID = ? and dependsOn = ?", opID, mid)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
 	return nil
 }
 
@@ -253,25 +270,29 @@ func (o *Operation) GetMarker(markerID MarkerID) (*Marker, error) {
 
 // MarkerOrder changes the order of the tasks for an operation
 func (o *Operation) MarkerOrder(order string) error {
-	stmt, err := db.Prepare("UPDATE marker SET taskorder = ? WHERE opID = ? AND ID = ?")
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-
-	pos := 1
-	markers := strings.Split(order, ",")
-	for i := range markers {
-		if markers[i] == "000" { // the header, could be any place in the order if the user was being silly
-			continue
-		}
-		if _, err := stmt.Exec(pos, o.ID, markers[i]); err != nil {
+	return o.ID.changeTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("UPDATE marker SET taskorder = ? WHERE opID = ? AND ID = ?")
+		if err != nil {
 			log.Error(err)
-			continue
+			return err
 		}
-		pos++
-	}
-	return nil
+		defer stmt.Close()
+
+		pos := 1
+		markers := strings.Split(order, ",")
+		for i := range markers {
+			if markers[i] == "000" { // the header, could be any place in the order if the user was being silly
+				continue
+			}
+			if _, err := stmt.Exec(pos, o.ID, markers[i]); err != nil {
+				log.Error(err)
+				continue
+			}
+			o.ID.logChange(changeMarker, markers[i], changeChange, tx)
+			pos++
+		}
+		return nil
+	})
 }
 
 // NewMarkerType is used to change from the old to the new marker type names
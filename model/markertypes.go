@@ -0,0 +1,153 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// attribute value types
+const (
+	attrString = "string"
+	attrNumber = "number"
+	attrBool   = "boolean"
+)
+
+// MarkerAttributeSchema declares an attribute a marker type may carry
+type MarkerAttributeSchema struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"` // string, number or boolean
+	Required bool     `json:"required"`
+	Values   []string `json:"values,omitempty"` // if set, the only permitted values
+}
+
+// MarkerTypeSchema declares a marker type and the attributes it may carry
+type MarkerTypeSchema struct {
+	Type       MarkerType              `json:"type"`
+	Name       string                  `json:"name"`
+	Attributes []MarkerAttributeSchema `json:"attributes"`
+}
+
+// markerTypes is the registry of marker types, in the order clients should list them
+var markerTypes = []MarkerTypeSchema{
+	{"capture", "Capture portal", []MarkerAttributeSchema{}},
+	{"decay", "Let decay", []MarkerAttributeSchema{}},
+	{"destroy", "Destroy portal", []MarkerAttributeSchema{}},
+	{"exclude", "Exclude markers", []MarkerAttributeSchema{}},
+	{"farm", "Farm keys", []MarkerAttributeSchema{
+		{Name: "keys", Type: attrNumber},
+	}},
+	{"goto", "Go to portal", []MarkerAttributeSchema{}},
+	{"key", "Get key", []MarkerAttributeSchema{
+		{Name: "keys", Type: attrNumber},
+	}},
+	{"link", "Create link from portal", []MarkerAttributeSchema{}},
+	{"meetagent", "Meet agent", []MarkerAttributeSchema{
+		{Name: "agent", Type: attrString},
+	}},
+	{"other", "Other", []MarkerAttributeSchema{}},
+	{"recharge", "Recharge portal", []MarkerAttributeSchema{}},
+	{"upgrade", "Upgrade portal", []MarkerAttributeSchema{}},
+	{"virus", "Use virus", []MarkerAttributeSchema{
+		{Name: "virus", Type: attrString, Values: []string{"jarvis", "ada"}},
+	}},
+}
+
+// MarkerTypes returns the registry of marker types
+func MarkerTypes() []MarkerTypeSchema {
+	return markerTypes
+}
+
+// markerTypeSchema looks up a marker type in the registry
+func markerTypeSchema(t MarkerType) (*MarkerTypeSchema, bool) {
+	for i := range markerTypes {
+		if markerTypes[i].Type == t {
+			return &markerTypes[i], true
+		}
+	}
+	return nil, false
+}
+
+// MarkerAttributeError names an attribute the registry does not permit on a marker
+type MarkerAttributeError struct {
+	Marker    MarkerID `json:"marker"`
+	Attribute string   `json:"attribute"`
+	Reason    string   `json:"reason"`
+}
+
+// Error satisfies the error interface
+func (e *MarkerAttributeError) Error() string {
+	return fmt.Sprintf("marker %s attribute %s: %s", e.Marker, e.Attribute, e.Reason)
+}
+
+// normalize converts legacy marker type names and checks the type and attributes against the registry
+// a *MarkerAttributeError names the first attribute which does not match the registry
+func (m *Marker) normalize() error {
+	m.Type = MarkerType(NewMarkerType(m.Type))
+
+	schema, ok := markerTypeSchema(m.Type)
+	if !ok {
+		err := errors.New(ErrUnknownMarkerType)
+		log.Infow(err.Error(), "marker", m.ID, "type", m.Type)
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range m.Attributes {
+		var as *MarkerAttributeSchema
+		for i := range schema.Attributes {
+			if schema.Attributes[i].Name == a.Name {
+				as = &schema.Attributes[i]
+			}
+		}
+		if as == nil {
+			return m.attributeError(a.Name, fmt.Sprintf("not permitted on %s markers", m.Type))
+		}
+		if seen[a.Name] {
+			return m.attributeError(a.Name, "repeated")
+		}
+		if err := as.check(a.Value); err != nil {
+			return m.attributeError(a.Name, err.Error())
+		}
+		seen[a.Name] = true
+	}
+
+	for _, as := range schema.Attributes {
+		if as.Required && !seen[as.Name] {
+			return m.attributeError(as.Name, fmt.Sprintf("required on %s markers", m.Type))
+		}
+	}
+	return nil
+}
+
+func (m *Marker) attributeError(name, reason string) error {
+	err := &MarkerAttributeError{Marker: m.ID, Attribute: name, Reason: reason}
+	log.Infow(err.Error(), "marker", m.ID, "type", m.Type)
+	return err
+}
+
+// check verifies an attribute value matches its declared type
+func (as *MarkerAttributeSchema) check(value string) error {
+	switch as.Type {
+	case attrNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("attribute %s must be a number", as.Name)
+		}
+	case attrBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("attribute %s must be true or false", as.Name)
+		}
+	}
+
+	if len(as.Values) == 0 {
+		return nil
+	}
+	for _, v := range as.Values {
+		if v == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("attribute %s must be one of %v", as.Name, as.Values)
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMarkerNormalize(t *testing.T) {
+	m := Marker{ID: "m1", Type: "GetKeyPortalMarker", Attributes: []Attribute{{Name: "keys", Value: "3"}}}
+	if err := m.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != "key" {
+		t.Errorf("legacy type converted to %s", m.Type)
+	}
+	if len(m.Attributes) != 1 || m.Attributes[0].Value != "3" {
+		t.Errorf("attributes %+v, want keys=3", m.Attributes)
+	}
+
+	m = Marker{ID: "m3", Type: "virus", Attributes: []Attribute{{Name: "virus", Value: "jarvis"}}}
+	if err := m.normalize(); err != nil || len(m.Attributes) != 1 {
+		t.Errorf("permitted value refused: %v %+v", err, m.Attributes)
+	}
+
+	m = Marker{ID: "m5", Type: "nosuchtype"}
+	if err := m.normalize(); err == nil || err.Error() != ErrUnknownMarkerType {
+		t.Errorf("unknown type gave %v", err)
+	}
+}
+
+func TestMarkerNormalizeRefused(t *testing.T) {
+	tests := []struct {
+		name      string
+		m         Marker
+		attribute string
+	}{
+		{"unknown", Marker{ID: "m1", Type: "key", Attributes: []Attribute{{Name: "keys", Value: "3"}, {Name: "color", Value: "red"}}}, "color"},
+		{"repeated", Marker{ID: "m1", Type: "key", Attributes: []Attribute{{Name: "keys", Value: "3"}, {Name: "keys", Value: "4"}}}, "keys"},
+		{"not a number", Marker{ID: "m2", Type: "farm", Attributes: []Attribute{{Name: "keys", Value: "lots"}}}, "keys"},
+		{"outside the list", Marker{ID: "m4", Type: "virus", Attributes: []Attribute{{Name: "virus", Value: "flu"}}}, "virus"},
+	}
+
+	for _, tt := range tests {
+		err := tt.m.normalize()
+		var ae *MarkerAttributeError
+		if !errors.As(err, &ae) {
+			t.Errorf("%s: got %v, want a MarkerAttributeError", tt.name, err)
+			continue
+		}
+		if ae.Attribute != tt.attribute || ae.Marker != tt.m.ID {
+			t.Errorf("%s: error names %s on %s, want %s on %s", tt.name, ae.Attribute, ae.Marker, tt.attribute, tt.m.ID)
+		}
+	}
+}
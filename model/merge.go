@@ -0,0 +1,435 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// OpConflictError is returned when an update is based on an out-of-date copy of an op
+// if Conflicts is empty the base was stale and no merge was attempted (or possible)
+type OpConflictError struct {
+	LastEditID string          `json:"lasteditid"`
+	Conflicts  []MergeConflict `json:"conflicts,omitempty"`
+}
+
+// MergeConflict identifies a single item changed both by the incoming update and on the server
+type MergeConflict struct {
+	Type string `json:"type"` // operation, portal, link, marker, task, zone
+	ID   string `json:"ID"`
+}
+
+// Error satisfies the error interface
+func (e *OpConflictError) Error() string {
+	if len(e.Conflicts) > 0 {
+		return ErrOpMergeConflict
+	}
+	return ErrOpStale
+}
+
+// checkBase verifies that the incoming op was based on the current version of the op
+// if it was not and merge is requested, the incoming op is rewritten to the three-way merge of
+// the base revision, the current server copy and the incoming changes
+// edits which only touch the op (claims, assignments, comments) do not store a revision, an older one is used instead
+// returns the update ID the check was made against, the write must confirm it with checkLastEdit
+func (o *Operation) checkBase(base string, merge bool, gid GoogleID) (string, error) {
+	stat, err := o.ID.Stat()
+	if err != nil {
+		return "", err
+	}
+	if stat.LastEditID == base {
+		return stat.LastEditID, nil
+	}
+
+	if !merge {
+		err := &OpConflictError{LastEditID: stat.LastEditID}
+		log.Infow(err.Error(), "GID", gid, "resource", o.ID, "base", base, "LastEditID", stat.LastEditID)
+		return "", err
+	}
+
+	rev, err := o.ID.baseRevision(base)
+	if err != nil {
+		// base is too old or was never stored, nothing to merge against
+		err := &OpConflictError{LastEditID: stat.LastEditID}
+		log.Infow(err.Error(), "GID", gid, "resource", o.ID, "base", base, "LastEditID", stat.LastEditID, "message", "base revision unavailable")
+		return "", err
+	}
+
+	var baseOp Operation
+	if err := json.Unmarshal(rev.Operation, &baseOp); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	current := Operation{ID: o.ID}
+	if err := current.Populate(gid); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	if conflicts := o.mergeFrom(&baseOp, &current); len(conflicts) > 0 {
+		err := &OpConflictError{LastEditID: stat.LastEditID, Conflicts: conflicts}
+		log.Infow(err.Error(), "GID", gid, "resource", o.ID, "base", base, "LastEditID", stat.LastEditID, "conflicts", len(conflicts))
+		return "", err
+	}
+
+	log.Infow("merged concurrent update", "GID", gid, "resource", o.ID, "base", base, "LastEditID", stat.LastEditID)
+	return stat.LastEditID, nil
+}
+
+// mergeFrom rewrites o to contain the changes made to current since base plus the changes made in o since base
+// items changed on both sides are reported as conflicts
+func (o *Operation) mergeFrom(base, current *Operation) []MergeConflict {
+	var conflicts []MergeConflict
+
+	// top-level op data is treated as a single item
+	opItem := func(x *Operation) map[string]string {
+		return map[string]string{
+			string(x.ID): canonical(struct {
+				Name, Color, Comment, ReferenceTime string
+			}{x.Name, x.Color, x.Comment, x.ReferenceTime}),
+		}
+	}
+	useMine, c := mergeIDs(opItem(base), opItem(current), opItem(o))
+	conflicts = append(conflicts, toConflicts("operation", c)...)
+	if !useMine[string(o.ID)] {
+		o.Name = current.Name
+		o.Color = current.Color
+		o.Comment = current.Comment
+		o.ReferenceTime = current.ReferenceTime
+	}
+
+	// portals
+	basePortals, currentPortals, minePortals := make(map[string]string), make(map[string]string), make(map[string]string)
+	portalItems := make(map[string]Portal)
+	for _, p := range base.OpPortals {
+		basePortals[string(p.ID)] = canonicalPortal(p)
+	}
+	for _, p := range current.OpPortals {
+		currentPortals[string(p.ID)] = canonicalPortal(p)
+	}
+	mine := make(map[string]Portal)
+	for _, p := range o.OpPortals {
+		minePortals[string(p.ID)] = canonicalPortal(p)
+		mine[string(p.ID)] = p
+	}
+	useMine, c = mergeIDs(basePortals, currentPortals, minePortals)
+	conflicts = append(conflicts, toConflicts("portal", c)...)
+	for _, p := range current.OpPortals {
+		if !useMine[string(p.ID)] {
+			portalItems[string(p.ID)] = p
+		}
+	}
+	for id, p := range mine {
+		if useMine[id] {
+			portalItems[id] = p
+		}
+	}
+	o.OpPortals = make([]Portal, 0, len(portalItems))
+	for _, p := range portalItems {
+		o.OpPortals = append(o.OpPortals, p)
+	}
+
+	// links
+	baseLinks, currentLinks, mineLinks := make(map[string]string), make(map[string]string), make(map[string]string)
+	for _, l := range base.Links {
+		baseLinks[string(l.ID)] = canonicalLink(l)
+	}
+	for _, l := range current.Links {
+		currentLinks[string(l.ID)] = canonicalLink(l)
+	}
+	for _, l := range o.Links {
+		mineLinks[string(l.ID)] = canonicalLink(l)
+	}
+	useMine, c = mergeIDs(baseLinks, currentLinks, mineLinks)
+	conflicts = append(conflicts, toConflicts("link", c)...)
+	var links []Link
+	for _, l := range current.Links {
+		if !useMine[string(l.ID)] {
+			links = append(links, l)
+		}
+	}
+	for _, l := range o.Links {
+		if useMine[string(l.ID)] {
+			links = append(links, l)
+		}
+	}
+	o.Links = links
+
+	// markers
+	baseMarkers, currentMarkers, mineMarkers := make(map[string]string), make(map[string]string), make(map[string]string)
+	for _, m := range base.Markers {
+		baseMarkers[string(m.ID)] = canonicalMarker(m)
+	}
+	for _, m := range current.Markers {
+		currentMarkers[string(m.ID)] = canonicalMarker(m)
+	}
+	for _, m := range o.Markers {
+		mineMarkers[string(m.ID)] = canonicalMarker(m)
+	}
+	useMine, c = mergeIDs(baseMarkers, currentMarkers, mineMarkers)
+	conflicts = append(conflicts, toConflicts("marker", c)...)
+	var markers []Marker
+	for _, m := range current.Markers {
+		if !useMine[string(m.ID)] {
+			markers = append(markers, m)
+		}
+	}
+	for _, m := range o.Markers {
+		if useMine[string(m.ID)] {
+			markers = append(markers, m)
+		}
+	}
+	o.Markers = markers
+
+	// generic tasks, old clients do not send them and the stored ones are left alone
+	if o.Tasks != nil {
+		baseTasks, currentTasks, mineTasks := make(map[string]string), make(map[string]string), make(map[string]string)
+		for _, g := range base.Tasks {
+			baseTasks[string(g.ID)] = canonicalGenericTask(g)
+		}
+		for _, g := range current.Tasks {
+			currentTasks[string(g.ID)] = canonicalGenericTask(g)
+		}
+		for _, g := range o.Tasks {
+			mineTasks[string(g.ID)] = canonicalGenericTask(g)
+		}
+		useMine, c = mergeIDs(baseTasks, currentTasks, mineTasks)
+		conflicts = append(conflicts, toConflicts("task", c)...)
+		tasks := make([]GenericTask, 0)
+		for _, g := range current.Tasks {
+			if !useMine[string(g.ID)] {
+				tasks = append(tasks, g)
+			}
+		}
+		for _, g := range o.Tasks {
+			if useMine[string(g.ID)] {
+				tasks = append(tasks, g)
+			}
+		}
+		o.Tasks = tasks
+	}
+
+	// zones
+	baseZones, currentZones, mineZones := make(map[string]string), make(map[string]string), make(map[string]string)
+	for _, z := range base.Zones {
+		baseZones[strconv.Itoa(int(z.Zone))] = canonical(z)
+	}
+	for _, z := range current.Zones {
+		currentZones[strconv.Itoa(int(z.Zone))] = canonical(z)
+	}
+	for _, z := range o.Zones {
+		mineZones[strconv.Itoa(int(z.Zone))] = canonical(z)
+	}
+	useMine, c = mergeIDs(baseZones, currentZones, mineZones)
+	conflicts = append(conflicts, toConflicts("zone", c)...)
+	var zones []ZoneListElement
+	for _, z := range current.Zones {
+		if !useMine[strconv.Itoa(int(z.Zone))] {
+			zones = append(zones, z)
+		}
+	}
+	for _, z := range o.Zones {
+		if useMine[strconv.Itoa(int(z.Zone))] {
+			zones = append(zones, z)
+		}
+	}
+	o.Zones = zones
+
+	// one side deleted a portal the other side still uses
+	for _, l := range o.Links {
+		_, fok := portalItems[string(l.From)]
+		_, tok := portalItems[string(l.To)]
+		if !fok || !tok {
+			conflicts = append(conflicts, MergeConflict{Type: "link", ID: string(l.ID)})
+		}
+	}
+	for _, m := range o.Markers {
+		if _, ok := portalItems[string(m.PortalID)]; !ok {
+			conflicts = append(conflicts, MergeConflict{Type: "marker", ID: string(m.ID)})
+		}
+	}
+	for _, g := range o.Tasks {
+		if g.PortalID == "" {
+			continue
+		}
+		if _, ok := portalItems[string(g.PortalID)]; !ok {
+			conflicts = append(conflicts, MergeConflict{Type: "task", ID: string(g.ID)})
+		}
+	}
+
+	return conflicts
+}
+
+// mergeIDs does the three-way comparison of the canonical forms of a set of items
+// for each ID it reports true if the incoming (mine) version should be used, false to keep the current version
+// a missing entry in either map means the item does not exist on that side
+func mergeIDs(base, current, mine map[string]string) (map[string]bool, []string) {
+	useMine := make(map[string]bool)
+	var conflicts []string
+
+	all := make(map[string]bool)
+	for id := range base {
+		all[id] = true
+	}
+	for id := range current {
+		all[id] = true
+	}
+	for id := range mine {
+		all[id] = true
+	}
+
+	for id := range all {
+		b, bok := base[id]
+		c, cok := current[id]
+		m, mok := mine[id]
+
+		mineChanged := bok != mok || b != m
+		theirsChanged := bok != cok || b != c
+
+		switch {
+		case !mineChanged:
+			useMine[id] = false
+		case !theirsChanged:
+			useMine[id] = true
+		case cok == mok && c == m: // both made the same change
+			useMine[id] = true
+		default:
+			useMine[id] = false
+			conflicts = append(conflicts, id)
+		}
+	}
+	sort.Strings(conflicts)
+	return useMine, conflicts
+}
+
+// checkLastEdit confirms, in the write transaction, that the op is still at the update ID checkBase used
+// the row is locked until the transaction ends, so no other write can slip in between
+func (opID OperationID) checkLastEdit(checked string, tx *sql.Tx) error {
+	var current string
+	if err := tx.QueryRow("SELECT lasteditid FROM operation WHERE ID = ? FOR UPDATE", opID).Scan(&current); err != nil {
+		log.Error(err)
+		return err
+	}
+	if current != checked {
+		err := &OpConflictError{LastEditID: current}
+		log.Infow(err.Error(), "resource", opID, "checked", checked, "LastEditID", current)
+		return err
+	}
+	return nil
+}
+
+func toConflicts(t string, ids []string) []MergeConflict {
+	var out []MergeConflict
+	for _, id := range ids {
+		out = append(out, MergeConflict{Type: t, ID: id})
+	}
+	return out
+}
+
+func canonical(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	return string(b)
+}
+
+// canonicalCoord reduces the lat/lng strings to a consistent precision, the database does not round-trip the client's strings
+func canonicalCoord(in string) string {
+	f, err := strconv.ParseFloat(in, 64)
+	if err != nil {
+		return in
+	}
+	return strconv.FormatFloat(f, 'f', 6, 64)
+}
+
+func canonicalPortal(p Portal) string {
+	return canonical(struct {
+		Name, Lat, Lon, Comment, Hardness string
+		SBUL                              uint8
+	}{p.Name, canonicalCoord(p.Lat), canonicalCoord(p.Lon), p.Comment, p.Hardness, p.SBUL})
+}
+
+// canonicalTask applies the same defaults the insert/update functions do
+func canonicalTask(t Task, assignedTo GoogleID) interface{} {
+	if t.State == "" {
+		t.State = "pending"
+	}
+	if !t.Zone.Valid() || t.Zone == ZoneAll {
+		t.Zone = zonePrimary
+	}
+
+	assignments := make(map[GoogleID]bool)
+	for _, gid := range t.Assignments {
+		assignments[gid] = true
+	}
+	if assignedTo != "" {
+		assignments[assignedTo] = true
+	}
+	a := make([]string, 0, len(assignments))
+	for gid := range assignments {
+		a = append(a, string(gid))
+	}
+	sort.Strings(a)
+
+	d := make([]string, 0, len(t.DependsOn))
+	for _, dep := range t.DependsOn {
+		d = append(d, string(dep))
+	}
+	sort.Strings(d)
+
+	return struct {
+		Comment, State string
+		Zone           Zone
+		Delta          int32
+		Order          int16
+		Assignments    []string
+		DependsOn      []string
+	}{t.Comment, t.State, t.Zone, t.DeltaMinutes, t.Order, a, d}
+}
+
+func canonicalLink(l Link) string {
+	if l.Desc != "" {
+		l.Comment = l.Desc
+	}
+	if l.ThrowOrder != 0 {
+		l.Order = l.ThrowOrder
+	}
+	if l.Completed {
+		l.State = "completed"
+	}
+	return canonical(struct {
+		From, To PortalID
+		Color    string
+		Task     interface{}
+	}{l.From, l.To, l.Color, canonicalTask(l.Task, l.AssignedTo)})
+}
+
+func canonicalGenericTask(g GenericTask) string {
+	return canonical(struct {
+		Name     string
+		PortalID PortalID
+		Lat, Lon string
+		Task     interface{}
+	}{g.Name, g.PortalID, canonicalCoord(g.Lat), canonicalCoord(g.Lon), canonicalTask(g.Task, "")})
+}
+
+func canonicalMarker(m Marker) string {
+	a := make([]string, 0, len(m.Attributes))
+	for _, attr := range m.Attributes {
+		a = append(a, attr.Name+"="+attr.Value)
+	}
+	sort.Strings(a)
+
+	return canonical(struct {
+		PortalID   PortalID
+		Type       MarkerType
+		Attributes []string
+		Task       interface{}
+	}{m.PortalID, m.Type, a, canonicalTask(m.Task, m.AssignedTo)})
+}
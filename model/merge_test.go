@@ -0,0 +1,70 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestMergeIDs(t *testing.T) {
+	base := map[string]string{
+		"same":       "a",
+		"mine":       "a",
+		"theirs":     "a",
+		"both":       "a",
+		"conflict":   "a",
+		"deletemine": "a",
+		"deleteboth": "a",
+	}
+	current := map[string]string{
+		"same":       "a",
+		"mine":       "a",
+		"theirs":     "b",
+		"both":       "b",
+		"conflict":   "b",
+		"deletemine": "a",
+		"added":      "x",
+	}
+	mine := map[string]string{
+		"same":     "a",
+		"mine":     "b",
+		"theirs":   "a",
+		"both":     "b",
+		"conflict": "c",
+		"new":      "y",
+	}
+
+	useMine, conflicts := mergeIDs(base, current, mine)
+
+	want := map[string]bool{
+		"same":       false,
+		"mine":       true,
+		"theirs":     false,
+		"both":       true,
+		"conflict":   false,
+		"deletemine": true,
+		"deleteboth": true, // both sides removed it
+		"added":      false,
+		"new":        true,
+	}
+	for id, w := range want {
+		if useMine[id] != w {
+			t.Errorf("%s: useMine %v, want %v", id, useMine[id], w)
+		}
+	}
+	if len(conflicts) != 1 || conflicts[0] != "conflict" {
+		t.Errorf("conflicts %v, want [conflict]", conflicts)
+	}
+}
+
+func TestMergeIDsEditDeleted(t *testing.T) {
+	base := map[string]string{"x": "a"}
+	current := map[string]string{}
+	mine := map[string]string{"x": "b"}
+
+	useMine, conflicts := mergeIDs(base, current, mine)
+	if useMine["x"] {
+		t.Error("an edit of an item deleted on the server must not win")
+	}
+	if len(conflicts) != 1 || conflicts[0] != "x" {
+		t.Errorf("conflicts %v, want [x]", conflicts)
+	}
+}
@@ -0,0 +1,196 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// NearbyRadius is the search radius used when none is given, in meters
+const NearbyRadius = 10000
+
+// nearbyRadiusMax is the largest search radius permitted, in meters
+const nearbyRadiusMax = 500000
+
+// NearbyOp is an op whose portals or zones come within the search radius
+type NearbyOp struct {
+	ID       OperationID `json:"ID"`
+	Name     string      `json:"name"`
+	Color    string      `json:"color"`
+	IsOwner  bool        `json:"isowner"`
+	Distance float64     `json:"distance"` // meters to the nearest portal or zone, 0 if inside a zone
+}
+
+// NearbyOps lists the ops gid can read whose footprint comes within radius meters of lat, lon, nearest first
+// the footprint is the op's portals and its zone polygons, as far as gid may see them; archived ops are not included
+func (gid GoogleID) NearbyOps(lat, lon, radius float64) ([]NearbyOp, error) {
+	nearby := make([]NearbyOp, 0)
+
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nearby, fmt.Errorf("invalid location")
+	}
+	if radius <= 0 || radius > nearbyRadiusMax {
+		return nearby, fmt.Errorf("radius must be between 0 and %d meters", nearbyRadiusMax)
+	}
+
+	ad := Agent{GoogleID: gid}
+	if err := adOps(&ad, false); err != nil {
+		return nearby, err
+	}
+
+	readable := make(map[OperationID]AdOperation)
+	// agents who cannot see every zone only get the portals and zones Populate would give them
+	limited := make(map[OperationID][]Zone)
+	var args, fullArgs []interface{}
+	for _, adop := range ad.Ops {
+		o := Operation{ID: adop.ID}
+		read, zones := o.ReadAccess(gid)
+		if !read {
+			if !o.AssignedOnlyAccess(gid) {
+				continue
+			}
+			zones = []Zone{}
+		}
+		readable[adop.ID] = adop
+		args = append(args, adop.ID)
+		if ZoneAll.inZones(zones) {
+			fullArgs = append(fullArgs, adop.ID)
+		} else {
+			limited[adop.ID] = zones
+		}
+	}
+	if len(readable) == 0 {
+		return nearby, nil
+	}
+	in := "?" + strings.Repeat(",?", len(args)-1)
+
+	distance := make(map[OperationID]float64)
+	closer := func(opID OperationID, d float64) {
+		if d > radius {
+			return
+		}
+		if cur, ok := distance[opID]; !ok || d < cur {
+			distance[opID] = d
+		}
+	}
+
+	if len(fullArgs) > 0 {
+		minLat, minLon, maxLat, maxLon := util.BoundingBox(lat, lon, radius)
+		fullIn := "?" + strings.Repeat(",?", len(fullArgs)-1)
+		portalArgs := append(append([]interface{}{}, fullArgs...), minLat, maxLat, minLon, maxLon)
+		// #nosec -- only placeholders are added to the query
+		rows, err := db.Query("SELECT portal.opID, Y(COALESCE(portalcatalog.loc, portal.loc)) AS lat, X(COALESCE(portalcatalog.loc, portal.loc)) AS lon FROM portal "+catalogJoin+
+			" WHERE portal.opID IN ("+fullIn+") HAVING lat BETWEEN ? AND ? AND lon BETWEEN ? AND ?", portalArgs...)
+		if err != nil {
+			log.Error(err)
+			return nearby, err
+		}
+		for rows.Next() {
+			var opID OperationID
+			var plat, plon float64
+			if err := rows.Scan(&opID, &plat, &plon); err != nil {
+				log.Error(err)
+				continue
+			}
+			closer(opID, util.Distance(lat, lon, plat, plon))
+		}
+		rows.Close()
+	}
+
+	for opID := range limited {
+		o := Operation{ID: opID}
+		if err := o.Populate(gid); err != nil {
+			continue
+		}
+		for _, p := range o.OpPortals {
+			if plat, plon, ok := parseLatLon(p.Lat, p.Lon); ok {
+				closer(opID, util.Distance(lat, lon, plat, plon))
+			}
+		}
+	}
+
+	type opZone struct {
+		opID OperationID
+		zone Zone
+	}
+	zones := make(map[opZone]*autoZone)
+	// #nosec -- only placeholders are added to the query
+	zrows, err := db.Query("SELECT opID, zoneID, position, X(point), Y(point) FROM zonepoints WHERE opID IN ("+in+") ORDER BY opID, zoneID, position", args...)
+	if err != nil {
+		log.Error(err)
+		return nearby, err
+	}
+	for zrows.Next() {
+		var k opZone
+		var p zonepoint
+		if err := zrows.Scan(&k.opID, &k.zone, &p.Position, &p.Lat, &p.Lon); err != nil {
+			log.Error(err)
+			continue
+		}
+		if lz, ok := limited[k.opID]; ok && !k.zone.inZones(lz) {
+			continue
+		}
+		if _, ok := zones[k]; !ok {
+			zones[k] = &autoZone{zone: k.zone}
+		}
+		zones[k].points = append(zones[k].points, p)
+	}
+	zrows.Close()
+
+	for k, z := range zones {
+		if len(z.points) < 3 {
+			continue
+		}
+		closer(k.opID, z.distance(lat, lon))
+	}
+
+	for opID, d := range distance {
+		adop := readable[opID]
+		nearby = append(nearby, NearbyOp{
+			ID:       opID,
+			Name:     adop.Name,
+			Color:    adop.Color,
+			IsOwner:  adop.IsOwner,
+			Distance: math.Round(d),
+		})
+	}
+	sort.Slice(nearby, func(i, j int) bool {
+		if nearby[i].Distance == nearby[j].Distance {
+			return nearby[i].Name < nearby[j].Name
+		}
+		return nearby[i].Distance < nearby[j].Distance
+	})
+	return nearby, nil
+}
+
+// distance is how far the point is from the zone's polygon in meters, 0 if inside
+func (z *autoZone) distance(lat, lon float64) float64 {
+	if z.contains(lat, lon) {
+		return 0
+	}
+
+	// an equirectangular projection around the point is close enough at zone scales
+	rad := math.Pi / 180
+	project := func(p zonepoint) xy {
+		return xy{
+			x: (p.Lon - lon) * rad * util.EarthRadius * math.Cos(lat*rad),
+			y: (p.Lat - lat) * rad * util.EarthRadius,
+		}
+	}
+
+	nearest := math.Inf(1)
+	for i, j := 0, len(z.points)-1; i < len(z.points); j, i = i, i+1 {
+		a, b := project(z.points[j]), project(z.points[i])
+		dx, dy := b.x-a.x, b.y-a.y
+		t := 0.0
+		if l := dx*dx + dy*dy; l > 0 {
+			t = math.Max(0, math.Min(1, -(a.x*dx+a.y*dy)/l))
+		}
+		nearest = math.Min(nearest, math.Hypot(a.x+t*dx, a.y+t*dy))
+	}
+	return nearest
+}
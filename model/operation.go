@@ -17,15 +17,16 @@ type OperationID string
 // Operation is defined by the Wasabee IITC plugin.
 // It is the top level item in the JSON file.
 type Operation struct {
-	ID        OperationID `json:"ID"`      // 40-char string
-	Name      string      `json:"name"`    // freeform
-	Gid       GoogleID    `json:"creator"` // IITC plugin sends agent name on first upload, we convert to GID
-	Color     string      `json:"color"`   // now free-form
-	OpPortals []Portal    `json:"opportals"`
-	Anchors   []PortalID  `json:"anchors"` // We should let the clients build this themselves
-	Links     []Link      `json:"links"`
-	// Blockers   []Link            `json:"blockers"` // ignored by Wasabee-Server -- do not store this
+	ID            OperationID       `json:"ID"`      // 40-char string
+	Name          string            `json:"name"`    // freeform
+	Gid           GoogleID          `json:"creator"` // IITC plugin sends agent name on first upload, we convert to GID
+	Color         string            `json:"color"`   // now free-form
+	OpPortals     []Portal          `json:"opportals"`
+	Anchors       []PortalID        `json:"anchors"` // We should let the clients build this themselves
+	Links         []Link            `json:"links"`
+	Blockers      []Blocker         `json:"blockers"` // nil leaves the stored blockers untouched on update
 	Markers       []Marker          `json:"markers"`
+	Tasks         []GenericTask     `json:"tasks"` // nil leaves the stored generic tasks untouched on update
 	Teams         []OpPermission    `json:"teamlist"`
 	Modified      string            `json:"modified"`      // time.RFC1123 format
 	LastEditID    string            `json:"lasteditid"`    // 40-char string, generated by Touch()
@@ -34,6 +35,9 @@ type Operation struct {
 	Keys          []KeyOnHand       `json:"keysonhand"`
 	Fetched       string            `json:"fetched"` // time.RFC1123 format
 	Zones         []ZoneListElement `json:"zones"`
+	Reminders     bool              `json:"reminders"` // set by the owner, ignored on upload
+	AutoZone      bool              `json:"autozone"`  // set by the owner, ignored on upload; task zones follow the zone polygons
+	State         OpState           `json:"state"`     // set by the owner, ignored on upload; archived ops are read-only
 }
 
 // OpStat is a minimal struct to determine if the op has been updated
@@ -84,7 +88,8 @@ func DrawInsert(ctx context.Context, o *Operation, gid GoogleID) error {
 	}()
 
 	// start the insert process
-	_, err = tx.Exec("INSERT INTO operation (ID, name, gid, color, modified, comment, referencetime) VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), ?, ?)", o.ID, o.Name, gid, o.Color, comment, reftime.Format("2006-01-02 15:04:05"))
+	o.LastEditID = util.GenerateID(40)
+	_, err = tx.Exec("INSERT INTO operation (ID, name, gid, color, modified, comment, referencetime, lasteditid) VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), ?, ?, ?)", o.ID, o.Name, gid, o.Color, comment, reftime.Format("2006-01-02 15:04:05"), o.LastEditID)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -93,7 +98,7 @@ func DrawInsert(ctx context.Context, o *Operation, gid GoogleID) error {
 	portalMap := make(map[PortalID]bool)
 	for _, p := range o.OpPortals {
 		portalMap[p.ID] = true
-		if err = o.ID.insertPortal(p, tx); err != nil {
+		if err = o.ID.insertPortal(p, gid, tx); err != nil {
 			// log.Error(err)
 			return err
 		}
@@ -111,7 +116,7 @@ func DrawInsert(ctx context.Context, o *Operation, gid GoogleID) error {
 
 		// assignments here would be invalid since teams are not known
 		m.AssignedTo = ""
-		if err = o.ID.insertMarker(m, tx); err != nil {
+		if err = o.ID.insertMarker(m, gid, tx); err != nil {
 			// log.Error(err)
 			return err
 		}
@@ -134,12 +139,26 @@ func DrawInsert(ctx context.Context, o *Operation, gid GoogleID) error {
 		}
 		// assignments here would be invalid since teams are not known
 		l.AssignedTo = ""
-		if err = o.ID.insertLink(l, tx); err != nil {
+		if err = o.ID.insertLink(l, gid, tx); err != nil {
 			// log.Error(err)
 			return err
 		}
 	}
 
+	if err := o.checkGenericTasks(portalMap); err != nil {
+		return err
+	}
+	for _, g := range o.Tasks {
+		// assignments are kept as they are for link and marker tasks, clones rely on this
+		if err = o.ID.insertGenericTask(g, gid, tx); err != nil {
+			return err
+		}
+	}
+
+	if err := o.ID.setBlockers(o.Blockers, portalMap, tx); err != nil {
+		return err
+	}
+
 	for _, k := range o.Keys {
 		if err := o.insertKey(k, tx); err != nil {
 			// log.Error(err)
@@ -158,11 +177,24 @@ func DrawInsert(ctx context.Context, o *Operation, gid GoogleID) error {
 		}
 	}
 
+	if err := o.ID.validateDepends(tx); err != nil {
+		return err
+	}
+
+	if err := o.ID.stampChanges(o.LastEditID, tx); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		log.Error(err)
 		return err
 	}
 
+	if err := o.ID.saveRevision(gid); err != nil {
+		log.Error(err)
+		// carry on, the op itself is saved
+	}
+
 	return nil
 }
 
@@ -170,7 +202,15 @@ func DrawInsert(ctx context.Context, o *Operation, gid GoogleID) error {
 // Links & Markers are added/removed as necessary -- assignments are properly updated as necessary (including notifications on change)
 // Key count data is left untouched (unless the portal is no longer listed in the portals list).
 // Database is locked per-op, each update runs in an all-or-nothing transaction
+// o.LastEditID is set to the new update ID on success
 func DrawUpdate(ctx context.Context, o *Operation, gid GoogleID) error {
+	return DrawUpdateFrom(ctx, o, gid, "", false)
+}
+
+// DrawUpdateFrom is DrawUpdate with optimistic concurrency: base is the lasteditid the client's copy was based upon
+// if base is not the current lasteditid the update is refused with an *OpConflictError, unless merge is set and
+// the changes made on the server since base do not overlap with the incoming changes; an empty base skips the check
+func DrawUpdateFrom(ctx context.Context, o *Operation, gid GoogleID, base string, merge bool) error {
 	if o.ID.IsDeletedOp() {
 		err := errors.New("attempt to update a deleted opID; duplicate and upload the copy instead")
 		log.Infow(err.Error(), "GID", gid, "opID", o.ID)
@@ -193,15 +233,26 @@ func DrawUpdate(ctx context.Context, o *Operation, gid GoogleID) error {
 		return err
 	}
 
-	if _, err := db.ExecContext(ctx, "SELECT GET_LOCK(?,1)", o.ID); err != nil {
-		log.Error(err)
+	lock, err := o.ID.lock(ctx)
+	if err != nil {
 		return err
 	}
-	defer func() {
-		if _, err := db.Exec("SELECT RELEASE_LOCK(?)", o.ID); err != nil {
-			log.Error(err)
+	defer lock.unlock()
+
+	// the lock keeps other writers out while merging, checkLastEdit confirms it in the transaction
+	var checked string
+	if base != "" {
+		if checked, err = o.checkBase(base, merge, gid); err != nil {
+			return err
 		}
-	}()
+	}
+
+	// the current state, used to determine what this update changes
+	before := Operation{ID: o.ID}
+	if err := before.Populate(gid); err != nil {
+		log.Error(err)
+		return err
+	}
 
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
@@ -216,6 +267,15 @@ func DrawUpdate(ctx context.Context, o *Operation, gid GoogleID) error {
 		}
 	}()
 
+	if base != "" {
+		if err := o.ID.checkLastEdit(checked, tx); err != nil {
+			return err
+		}
+	}
+	if err := o.ID.checkWritable(tx); err != nil {
+		return err
+	}
+
 	reftime, err := time.Parse(time.RFC1123, o.ReferenceTime)
 	if err != nil {
 		reftime = time.Now()
@@ -223,14 +283,16 @@ func DrawUpdate(ctx context.Context, o *Operation, gid GoogleID) error {
 
 	comment := makeNullString(util.Sanitize(o.Comment))
 
-	_, err = tx.Exec("UPDATE operation SET name = ?, color = ?, comment = ?, referencetime = ? WHERE ID = ?",
-		o.Name, o.Color, comment, reftime.Format("2006-01-02 15:04:05"), o.ID)
+	// bump the update ID in the same transaction so the stored revision matches
+	updateID := util.GenerateID(40)
+	_, err = tx.Exec("UPDATE operation SET name = ?, color = ?, comment = ?, referencetime = ?, modified = UTC_TIMESTAMP(), lasteditid = ? WHERE ID = ?",
+		o.Name, o.Color, comment, reftime.Format("2006-01-02 15:04:05"), updateID, o.ID)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 
-	portalMap, err := drawOpUpdatePortals(o, tx)
+	portalMap, err := drawOpUpdatePortals(o, gid, tx)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -242,31 +304,73 @@ func DrawUpdate(ctx context.Context, o *Operation, gid GoogleID) error {
 		return err
 	}
 
-	if err := drawOpUpdateMarkers(o, portalMap, agentMap, tx); err != nil {
+	if err := drawOpUpdateMarkers(o, portalMap, agentMap, gid, tx); err != nil {
 		log.Error(err)
 		return err
 	}
 
-	if err := drawOpUpdateLinks(o, portalMap, agentMap, tx); err != nil {
+	if err := drawOpUpdateLinks(o, portalMap, agentMap, gid, tx); err != nil {
 		log.Error(err)
 		return err
 	}
 
+	known := make(map[PortalID]bool, len(portalMap))
+	for id := range portalMap {
+		known[id] = true
+	}
+
+	// old clients do not send generic tasks, leave them alone
+	if o.Tasks != nil {
+		if err := drawOpUpdateGenericTasks(o, known, gid, tx); err != nil {
+			log.Error(err)
+			return err
+		}
+	} else if err := o.ID.clearGenericTaskPortals(tx); err != nil {
+		return err
+	}
+
 	if err := drawOpUpdateZones(o, tx); err != nil {
 		log.Error(err)
 		return err
 	}
 
+	if err := o.ID.applyAutoZones(gid, tx); err != nil {
+		return err
+	}
+
+	// old clients do not send blockers, leave them alone
+	if o.Blockers != nil {
+		if err := o.ID.setBlockers(o.Blockers, known, tx); err != nil {
+			return err
+		}
+	}
+
+	if err := o.ID.validateDepends(tx); err != nil {
+		return err
+	}
+
+	// record what this upload changed for the change feed
+	o.ID.logDiff(&before, o, tx)
+	if err := o.ID.stampChanges(updateID, tx); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		log.Error(err)
 		return err
 	}
+	o.LastEditID = updateID
+
+	if err := o.ID.saveRevision(gid); err != nil {
+		log.Error(err)
+		// carry on, the op itself is saved
+	}
 
 	// XXX TBD remove unused opkey portals?
 	return nil
 }
 
-func drawOpUpdatePortals(o *Operation, tx *sql.Tx) (map[PortalID]Portal, error) {
+func drawOpUpdatePortals(o *Operation, gid GoogleID, tx *sql.Tx) (map[PortalID]Portal, error) {
 	// get the current portal list and stash in map
 	curPortals := make(map[PortalID]bool)
 	portalRows, err := tx.Query("SELECT ID FROM portal WHERE OpID = ?", o.ID)
@@ -290,7 +394,7 @@ func drawOpUpdatePortals(o *Operation, tx *sql.Tx) (map[PortalID]Portal, error)
 	portalMap := make(map[PortalID]Portal)
 	for _, p := range o.OpPortals {
 		portalMap[p.ID] = p
-		if err = o.ID.updatePortal(p, tx); err != nil {
+		if err = o.ID.updatePortal(p, gid, tx); err != nil {
 			return portalMap, err
 		}
 		delete(curPortals, p.ID)
@@ -304,7 +408,7 @@ func drawOpUpdatePortals(o *Operation, tx *sql.Tx) (map[PortalID]Portal, error)
 	return portalMap, nil
 }
 
-func drawOpUpdateMarkers(o *Operation, portalMap map[PortalID]Portal, agentMap map[GoogleID]bool, tx *sql.Tx) error {
+func drawOpUpdateMarkers(o *Operation, portalMap map[PortalID]Portal, agentMap map[GoogleID]bool, gid GoogleID, tx *sql.Tx) error {
 	curMarkers := make(map[MarkerID]bool)
 	markerRows, err := tx.Query("SELECT ID FROM marker WHERE OpID = ?", o.ID)
 	if err != nil {
@@ -334,7 +438,7 @@ func drawOpUpdateMarkers(o *Operation, portalMap map[PortalID]Portal, agentMap m
 
 		// m.checkAssignments(agentMap)
 
-		if err := o.ID.updateMarker(m, tx); err != nil {
+		if err := o.ID.updateMarker(m, gid, tx); err != nil {
 			return err
 		}
 		delete(curMarkers, m.ID)
@@ -349,7 +453,7 @@ func drawOpUpdateMarkers(o *Operation, portalMap map[PortalID]Portal, agentMap m
 	return nil
 }
 
-func drawOpUpdateLinks(o *Operation, portalMap map[PortalID]Portal, agentMap map[GoogleID]bool, tx *sql.Tx) error {
+func drawOpUpdateLinks(o *Operation, portalMap map[PortalID]Portal, agentMap map[GoogleID]bool, gid GoogleID, tx *sql.Tx) error {
 	curLinks := make(map[LinkID]bool)
 	linkRows, err := tx.Query("SELECT ID FROM link WHERE OpID = ?", o.ID)
 	if err != nil {
@@ -385,7 +489,7 @@ func drawOpUpdateLinks(o *Operation, portalMap map[PortalID]Portal, agentMap map
 
 		// l.checkAssignments(agentMap)
 
-		if err = o.ID.updateLink(l, tx); err != nil {
+		if err = o.ID.updateLink(l, gid, tx); err != nil {
 			return err
 		}
 		delete(curLinks, l.ID)
@@ -440,7 +544,8 @@ func drawOpUpdateZones(o *Operation, tx *sql.Tx) error {
 	return nil
 }
 
-// Delete removes an operation and all associated data
+// Delete moves an operation to the owner's trash, it is purged after the retention period
+// the op is kept intact so it can be restored with Undelete
 func (o *Operation) Delete(gid GoogleID) error {
 	if !o.ID.IsOwner(gid) {
 		err := errors.New("permission denied")
@@ -448,13 +553,23 @@ func (o *Operation) Delete(gid GoogleID) error {
 		return err
 	}
 
-	_, err := db.Exec("INSERT INTO deletedops (opID, deletedate, gid) VALUES (?, UTC_TIMESTAMP(), ?)", o.ID, gid)
+	// deleting again must not restart the trash retention clock
+	r, err := db.Exec("INSERT IGNORE INTO deletedops (opID, deletedate, gid) VALUES (?, UTC_TIMESTAMP(), ?)", o.ID, gid)
 	if err != nil {
 		log.Error(err)
-		// carry on
+		return err
 	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		err := errors.New(ErrOpInTrash)
+		log.Infow(err.Error(), "resource", o.ID, "GID", gid)
+		return err
+	}
+	return nil
+}
 
-	_, err = db.Exec("DELETE FROM operation WHERE ID = ?", o.ID)
+// purge removes an operation and all associated data, the tombstone in deletedops is kept
+func (opID OperationID) purge() error {
+	_, err := db.Exec("DELETE FROM operation WHERE ID = ?", opID)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -465,7 +580,7 @@ func (o *Operation) Delete(gid GoogleID) error {
 	for _, v := range tables {
 		// #nosec
 		q := fmt.Sprintf("DELETE FROM %s WHERE opID = ?", v)
-		if _, err = db.Exec(q, o.ID); err != nil {
+		if _, err = db.Exec(q, opID); err != nil {
 			log.Info(err)
 			// carry on
 		}
@@ -474,7 +589,7 @@ func (o *Operation) Delete(gid GoogleID) error {
 	return nil
 }
 
-// IsDeletedOp reports back if a particular op has been deleted
+// IsDeletedOp reports back if a particular op has been deleted, either in the trash or purged
 func (opID OperationID) IsDeletedOp() bool {
 	var i int
 	r := db.QueryRow("SELECT COUNT(*) FROM deletedops WHERE opID = ?", opID)
@@ -490,7 +605,7 @@ func (opID OperationID) IsDeletedOp() bool {
 // checks to see that either the gid created the operation or the gid is on the team assigned to the operation
 func (o *Operation) Populate(gid GoogleID) error {
 	var comment sql.NullString
-	err := db.QueryRow("SELECT name, gid, color, modified, comment, lasteditid, referencetime FROM operation WHERE ID = ?", o.ID).Scan(&o.Name, &o.Gid, &o.Color, &o.Modified, &comment, &o.LastEditID, &o.ReferenceTime)
+	err := db.QueryRow("SELECT name, gid, color, modified, comment, lasteditid, referencetime, reminders, autozone, state FROM operation WHERE ID = ?", o.ID).Scan(&o.Name, &o.Gid, &o.Color, &o.Modified, &comment, &o.LastEditID, &o.ReferenceTime, &o.Reminders, &o.AutoZone, &o.State)
 	if err != nil && err == sql.ErrNoRows {
 		err = errors.New(ErrOpNotFound)
 		log.Errorw(err.Error(), "resource", o.ID, "GID", gid, "opID", o.ID)
@@ -562,11 +677,23 @@ func (o *Operation) Populate(gid GoogleID) error {
 		return err
 	}
 
+	if err = o.populateGenericTasks(zones, gid, assignments, depends); err != nil {
+		log.Error(err)
+		return err
+	}
+
 	if err = o.populateAnchors(); err != nil {
 		log.Error(err)
 		return err
 	}
 
+	if err = o.populateBlockers(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	o.schedule(st)
+
 	if assignedOnly {
 		if err = o.populateMyKeys(gid); err != nil {
 			log.Error(err)
@@ -595,20 +722,49 @@ func (o *Operation) Populate(gid GoogleID) error {
 
 // SetInfo changes the description of an operation
 func (o *Operation) SetInfo(info string, gid GoogleID) error {
-	_, err := db.Exec("UPDATE operation SET comment = ? WHERE ID = ?", info, o.ID)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+	return o.ID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE operation SET comment = ? WHERE ID = ?", info, o.ID); err != nil {
+			log.Error(err)
+			return err
+		}
+		return nil
+	})
 }
 
 // Touch updates the modified timestamp on an operation
 func (o *Operation) Touch() (string, error) {
 	updateID := util.GenerateID(40)
 
-	_, err := db.Exec("UPDATE operation SET modified = UTC_TIMESTAMP(), lasteditid = ? WHERE ID = ?", updateID, o.ID)
+	// stamping must not interleave with an upload or patch stamping its own changes
+	lock, err := o.ID.lock(context.Background())
 	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && err != sql.ErrTxDone {
+			log.Error(err)
+		}
+	}()
+
+	if _, err := tx.Exec("UPDATE operation SET modified = UTC_TIMESTAMP(), lasteditid = ? WHERE ID = ?", updateID, o.ID); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	// tag the changes made since the last touch with this update ID for the change feed
+	if err := o.ID.stampChanges(updateID, tx); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
 		log.Error(err)
 		return "", err
 	}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// opLockWait is how long to wait for another writer to finish with an op, in seconds
+const opLockWait = 10
+
+// opLock is an op's named lock, GET_LOCK belongs to a connection so the lock holds its own
+type opLock struct {
+	opID OperationID
+	conn *sql.Conn
+}
+
+// lock takes the op's named lock, serializing writers which check the base and stamp changes
+// ErrOpBusy is returned if another writer holds it for longer than opLockWait
+func (opID OperationID) lock(ctx context.Context) (*opLock, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?,?)", opID, opLockWait).Scan(&got); err != nil {
+		log.Error(err)
+		_ = conn.Close()
+		return nil, err
+	}
+	if !got.Valid || got.Int64 != 1 {
+		err := errors.New(ErrOpBusy)
+		log.Warnw(err.Error(), "resource", opID)
+		_ = conn.Close()
+		return nil, err
+	}
+	return &opLock{opID: opID, conn: conn}, nil
+}
+
+// unlock releases the op's named lock and returns the connection to the pool
+func (l *opLock) unlock() {
+	if _, err := l.conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", l.opID); err != nil {
+		log.Error(err)
+	}
+	if err := l.conn.Close(); err != nil {
+		log.Error(err)
+	}
+}
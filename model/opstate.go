@@ -0,0 +1,210 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// OpState is where an op is in its lifecycle
+type OpState string
+
+// the lifecycle states of an op
+const (
+	OpStatePlanning OpState = "planning"
+	OpStateBriefed  OpState = "briefed"
+	OpStateLive     OpState = "live"
+	OpStateFinished OpState = "finished"
+	OpStateArchived OpState = "archived"
+)
+
+// opStateTransitions lists the states an owner may move an op to from each state
+// archived ops must be brought back to finished before they can be changed further
+var opStateTransitions = map[OpState][]OpState{
+	OpStatePlanning: {OpStateBriefed, OpStateLive, OpStateFinished, OpStateArchived},
+	OpStateBriefed:  {OpStatePlanning, OpStateLive, OpStateFinished, OpStateArchived},
+	OpStateLive:     {OpStateBriefed, OpStateFinished, OpStateArchived},
+	OpStateFinished: {OpStateLive, OpStateArchived},
+	OpStateArchived: {OpStateFinished},
+}
+
+// State returns the op's current lifecycle state
+func (opID OperationID) State() (OpState, error) {
+	var state OpState
+	err := db.QueryRow("SELECT state FROM operation WHERE ID = ?", opID).Scan(&state)
+	if err != nil && err == sql.ErrNoRows {
+		err = errors.New(ErrOpNotFound)
+		log.Infow(err.Error(), "resource", opID)
+		return state, err
+	}
+	if err != nil {
+		log.Error(err)
+		return state, err
+	}
+	return state, nil
+}
+
+// IsArchived reports if the op is archived, archived ops are read-only
+func (opID OperationID) IsArchived() bool {
+	state, err := opID.State()
+	if err != nil {
+		return false
+	}
+	return state == OpStateArchived
+}
+
+// SetState moves an op to a new lifecycle state, only the owner may do this
+func (opID OperationID) SetState(gid GoogleID, state OpState) error {
+	if !opID.IsOwner(gid) {
+		err := errors.New(ErrNotOpOwner)
+		log.Warnw(err.Error(), "GID", gid, "resource", opID)
+		return err
+	}
+
+	current, err := opID.State()
+	if err != nil {
+		return err
+	}
+	if current == state {
+		return nil
+	}
+
+	permitted := false
+	for _, s := range opStateTransitions[current] {
+		if s == state {
+			permitted = true
+		}
+	}
+	if !permitted {
+		err := fmt.Errorf("cannot move an op from %s to %s", current, state)
+		log.Infow(err.Error(), "GID", gid, "resource", opID)
+		return err
+	}
+
+	// not changeTx, archived ops must be able to leave the archive
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && err != sql.ErrTxDone {
+			log.Error(err)
+		}
+	}()
+
+	if _, err := tx.Exec("UPDATE operation SET state = ? WHERE ID = ?", state, opID); err != nil {
+		log.Error(err)
+		return err
+	}
+	opID.logChange(changeOp, string(opID), changeChange, tx)
+
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infow("op state changed", "GID", gid, "resource", opID, "from", current, "to", state)
+	return nil
+}
+
+// ArchiveOps archives ops whose reference time is more than days in the past and which have not been modified since
+// zero days turns off automatic archiving
+func ArchiveOps(days int) {
+	if days <= 0 {
+		return
+	}
+
+	rows, err := db.Query("SELECT ID FROM operation WHERE state != 'archived' AND referencetime < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? DAY) AND modified < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? DAY) AND ID NOT IN (SELECT opID FROM deletedops)", days, days)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	var ops []OperationID
+	for rows.Next() {
+		var opID OperationID
+		if err := rows.Scan(&opID); err != nil {
+			log.Error(err)
+			continue
+		}
+		ops = append(ops, opID)
+	}
+	rows.Close()
+
+	count := 0
+	for _, opID := range ops {
+		if archived, err := opID.archive(); err == nil && archived {
+			count++
+		}
+	}
+	if count > 0 {
+		log.Infow("archived ops", "count", count, "days", days)
+	}
+}
+
+// archive moves the op to archived with a new update ID, so clients refetch and see the op is read-only
+func (opID OperationID) archive() (bool, error) {
+	lock, err := opID.lock(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer lock.unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && err != sql.ErrTxDone {
+			log.Error(err)
+		}
+	}()
+
+	updateID := util.GenerateID(40)
+	r, err := tx.Exec("UPDATE operation SET state = 'archived', lasteditid = ? WHERE ID = ? AND state != 'archived'", updateID, opID)
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	opID.logChange(changeOp, string(opID), changeChange, tx)
+	if err := opID.stampChanges(updateID, tx); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return true, nil
+}
+
+// checkWritable refuses changes to archived ops, every change to an op's contents passes through here
+// the state is read with a shared lock so the op cannot be archived before tx commits
+func (opID OperationID) checkWritable(tx *sql.Tx) error {
+	var state OpState
+	err := tx.QueryRow("SELECT state FROM operation WHERE ID = ? LOCK IN SHARE MODE", opID).Scan(&state)
+	if err != nil && err == sql.ErrNoRows {
+		err = errors.New(ErrOpNotFound)
+		log.Infow(err.Error(), "resource", opID)
+		return err
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if state == OpStateArchived {
+		err := errors.New(ErrOpArchived)
+		log.Infow(err.Error(), "resource", opID)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// PatchItem is a single change in a partial op update
+// Value holds the complete portal, link, marker, task, zone or key for add and update
+// ID identifies the item for delete; keys are deleted by sending the key in Value
+type PatchItem struct {
+	Op    string          `json:"op"`   // add, update, delete
+	Type  string          `json:"type"` // portal, link, marker, task, zone, key
+	ID    string          `json:"ID"`
+	Value json.RawMessage `json:"value"`
+}
+
+// PatchError reports the patch item which could not be applied, Index is -1 if the patch as a whole was refused
+type PatchError struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// Error satisfies the error interface
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("patch item %d: %s", e.Index, e.Reason)
+}
+
+// patchState is the set of items in the op as the patch is applied
+type patchState struct {
+	portals map[PortalID]bool
+	links   map[LinkID]bool
+	markers map[MarkerID]bool
+	tasks   map[TaskID]bool // generic tasks
+	zones   map[Zone]bool
+}
+
+// DrawPatch applies a list of changes to an op in a single transaction, lasteditid is bumped once
+// if base is set the patch is refused with an *OpConflictError unless base is the current lasteditid
+// returns the new lasteditid
+func DrawPatch(ctx context.Context, opID OperationID, gid GoogleID, patch []PatchItem, base string) (string, error) {
+	if opID.IsDeletedOp() {
+		err := errors.New("attempt to update a deleted opID")
+		log.Infow(err.Error(), "GID", gid, "opID", opID)
+		return "", err
+	}
+
+	o := Operation{ID: opID}
+	if !o.WriteAccess(gid) {
+		err := fmt.Errorf("write access denied to op: %s", o.ID)
+		log.Error(err)
+		return "", err
+	}
+
+	lock, err := o.ID.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+
+	var checked string
+	if base != "" {
+		if checked, err = o.checkBase(base, false, gid); err != nil {
+			return "", err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && err != sql.ErrTxDone {
+			log.Error(err)
+		}
+	}()
+
+	if base != "" {
+		if err := o.ID.checkLastEdit(checked, tx); err != nil {
+			return "", err
+		}
+	}
+	if err := o.ID.checkWritable(tx); err != nil {
+		return "", err
+	}
+
+	state, err := o.ID.loadPatchState(tx)
+	if err != nil {
+		return "", err
+	}
+
+	for i, item := range patch {
+		if err := o.applyPatchItem(item, state, gid, tx); err != nil {
+			var pe *PatchError
+			if errors.As(err, &pe) {
+				pe.Index = i
+				log.Infow("refusing patch", "GID", gid, "resource", o.ID, "index", i, "reason", pe.Reason)
+			}
+			return "", err
+		}
+	}
+
+	if err := o.ID.applyAutoZones(gid, tx); err != nil {
+		return "", err
+	}
+
+	// the dependency graph can only be checked once every item is applied
+	if err := o.ID.validateDepends(tx); err != nil {
+		if err.Error() == ErrDependCycle || err.Error() == ErrDependNotFound {
+			return "", &PatchError{Index: -1, Reason: err.Error()}
+		}
+		return "", err
+	}
+
+	updateID := util.GenerateID(40)
+	if _, err := tx.Exec("UPDATE operation SET modified = UTC_TIMESTAMP(), lasteditid = ? WHERE ID = ?", updateID, o.ID); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if err := o.ID.stampChanges(updateID, tx); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	if err := o.ID.saveRevision(gid); err != nil {
+		log.Error(err)
+		// carry on, the patch is saved
+	}
+	return updateID, nil
+}
+
+func (opID OperationID) loadPatchState(tx *sql.Tx) (*patchState, error) {
+	state := patchState{
+		portals: make(map[PortalID]bool),
+		links:   make(map[LinkID]bool),
+		markers: make(map[MarkerID]bool),
+		tasks:   make(map[TaskID]bool),
+		zones:   make(map[Zone]bool),
+	}
+
+	load := func(q string, add func(string)) error {
+		rows, err := tx.Query(q, opID)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				log.Error(err)
+				continue
+			}
+			add(id)
+		}
+		return nil
+	}
+
+	if err := load("SELECT ID FROM portal WHERE opID = ?", func(id string) { state.portals[PortalID(id)] = true }); err != nil {
+		return nil, err
+	}
+	if err := load("SELECT ID FROM link WHERE opID = ?", func(id string) { state.links[LinkID(id)] = true }); err != nil {
+		return nil, err
+	}
+	if err := load("SELECT ID FROM marker WHERE opID = ?", func(id string) { state.markers[MarkerID(id)] = true }); err != nil {
+		return nil, err
+	}
+	if err := load("SELECT ID FROM generictask WHERE opID = ?", func(id string) { state.tasks[TaskID(id)] = true }); err != nil {
+		return nil, err
+	}
+	if err := load("SELECT ID FROM zone WHERE opID = ?", func(id string) {
+		z, _ := strconv.Atoi(id)
+		state.zones[Zone(z)] = true
+	}); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (o *Operation) applyPatchItem(item PatchItem, state *patchState, gid GoogleID, tx *sql.Tx) error {
+	if item.Op != "add" && item.Op != "update" && item.Op != "delete" {
+		return &PatchError{Reason: fmt.Sprintf("unknown op: %s", item.Op)}
+	}
+	if item.Op != "delete" && len(item.Value) == 0 {
+		return &PatchError{Reason: "value required for add and update"}
+	}
+
+	switch item.Type {
+	case "portal":
+		return o.patchPortal(item, state, gid, tx)
+	case "link":
+		return o.patchLink(item, state, gid, tx)
+	case "marker":
+		return o.patchMarker(item, state, gid, tx)
+	case "task":
+		return o.patchGenericTask(item, state, gid, tx)
+	case "zone":
+		return o.patchZone(item, state, tx)
+	case "key":
+		return o.patchKey(item, state, gid, tx)
+	}
+	return &PatchError{Reason: fmt.Sprintf("unknown type: %s", item.Type)}
+}
+
+// checkExists enforces that add only creates new items and update/delete only touch existing ones
+func (item PatchItem) checkExists(exists bool) error {
+	if item.Op == "add" && exists {
+		return &PatchError{Reason: fmt.Sprintf("%s already exists", item.Type)}
+	}
+	if item.Op != "add" && !exists {
+		return &PatchError{Reason: fmt.Sprintf("%s not found", item.Type)}
+	}
+	return nil
+}
+
+func (o *Operation) patchPortal(item PatchItem, state *patchState, gid GoogleID, tx *sql.Tx) error {
+	if item.Op == "delete" {
+		pid := PortalID(item.ID)
+		if err := item.checkExists(state.portals[pid]); err != nil {
+			return err
+		}
+
+		var inuse int
+		if err := tx.QueryRow("SELECT (SELECT COUNT(*) FROM link WHERE opID = ? AND (fromPortalID = ? OR toPortalID = ?)) + (SELECT COUNT(*) FROM marker WHERE opID = ? AND portalID = ?) + (SELECT COUNT(*) FROM generictask WHERE opID = ? AND portalID = ?)", o.ID, pid, pid, o.ID, pid, o.ID, pid).Scan(&inuse); err != nil {
+			log.Error(err)
+			return err
+		}
+		if inuse > 0 {
+			return &PatchError{Reason: "portal is used by links, markers or tasks"}
+		}
+
+		if err := o.ID.deletePortal(pid, tx); err != nil {
+			return err
+		}
+		delete(state.portals, pid)
+		o.ID.logChange(changePortal, string(pid), changeDelete, tx)
+		return nil
+	}
+
+	var p Portal
+	if err := json.Unmarshal(item.Value, &p); err != nil {
+		return &PatchError{Reason: err.Error()}
+	}
+	if p.ID == "" {
+		return &PatchError{Reason: "portal ID required"}
+	}
+	if err := item.checkExists(state.portals[p.ID]); err != nil {
+		return err
+	}
+	lat, laterr := strconv.ParseFloat(p.Lat, 64)
+	lon, lonerr := strconv.ParseFloat(p.Lon, 64)
+	if laterr != nil || lonerr != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return &PatchError{Reason: "invalid portal location"}
+	}
+
+	if err := o.ID.updatePortal(p, gid, tx); err != nil {
+		return err
+	}
+	state.portals[p.ID] = true
+	o.ID.logChange(changePortal, string(p.ID), patchAction(item.Op), tx)
+	return nil
+}
+
+func (o *Operation) patchLink(item PatchItem, state *patchState, gid GoogleID, tx *sql.Tx) error {
+	if item.Op == "delete" {
+		lid := LinkID(item.ID)
+		if err := item.checkExists(state.links[lid]); err != nil {
+			return err
+		}
+		if err := o.ID.deleteLink(lid, tx); err != nil {
+			return err
+		}
+		delete(state.links, lid)
+		o.ID.logChange(changeLink, string(lid), changeDelete, tx)
+		return nil
+	}
+
+	var l Link
+	if err := json.Unmarshal(item.Value, &l); err != nil {
+		return &PatchError{Reason: err.Error()}
+	}
+	if l.ID == "" {
+		return &PatchError{Reason: "link ID required"}
+	}
+	if err := item.checkExists(state.links[l.ID]); err != nil {
+		return err
+	}
+	if state.tasks[TaskID(l.ID)] || state.markers[MarkerID(l.ID)] {
+		return &PatchError{Reason: "task ID already in use"}
+	}
+	if !state.portals[l.From] {
+		return &PatchError{Reason: "attempt to source link from unknown portal"}
+	}
+	if !state.portals[l.To] {
+		return &PatchError{Reason: "attempt to send link to unknown portal"}
+	}
+	if l.From == l.To {
+		return &PatchError{Reason: "source and destination the same"}
+	}
+	if l.Zone != ZoneAll && !l.Zone.Valid() {
+		return &PatchError{Reason: "invalid zone"}
+	}
+
+	l.opID = o.ID
+	l.Task.ID = TaskID(l.ID)
+	if item.Op == "add" {
+		if err := o.ID.insertLink(l, gid, tx); err != nil {
+			return err
+		}
+	} else {
+		if err := o.ID.updateLink(l, gid, tx); err != nil {
+			return err
+		}
+	}
+	state.links[l.ID] = true
+	o.ID.logChange(changeLink, string(l.ID), patchAction(item.Op), tx)
+	return nil
+}
+
+func (o *Operation) patchMarker(item PatchItem, state *patchState, gid GoogleID, tx *sql.Tx) error {
+	if item.Op == "delete" {
+		mid := MarkerID(item.ID)
+		if err := item.checkExists(state.markers[mid]); err != nil {
+			return err
+		}
+		if err := o.ID.deleteMarker(mid, tx); err != nil {
+			return err
+		}
+		delete(state.markers, mid)
+		o.ID.logChange(changeMarker, string(mid), changeDelete, tx)
+		return nil
+	}
+
+	var m Marker
+	if err := json.Unmarshal(item.Value, &m); err != nil {
+		return &PatchError{Reason: err.Error()}
+	}
+	if m.ID == "" {
+		return &PatchError{Reason: "marker ID required"}
+	}
+	if err := item.checkExists(state.markers[m.ID]); err != nil {
+		return err
+	}
+	if state.tasks[TaskID(m.ID)] || state.links[LinkID(m.ID)] {
+		return &PatchError{Reason: "task ID already in use"}
+	}
+	if !state.portals[m.PortalID] {
+		return &PatchError{Reason: "attempt to add marker to unknown portal"}
+	}
+	if m.Zone != ZoneAll && !m.Zone.Valid() {
+		return &PatchError{Reason: "invalid zone"}
+	}
+	if err := m.normalize(); err != nil {
+		return &PatchError{Reason: err.Error()}
+	}
+
+	m.opID = o.ID
+	m.Task.ID = TaskID(m.ID)
+	if item.Op == "add" {
+		if err := o.ID.insertMarker(m, gid, tx); err != nil {
+			return err
+		}
+	} else {
+		if err := o.ID.updateMarker(m, gid, tx); err != nil {
+			return err
+		}
+	}
+	state.markers[m.ID] = true
+	o.ID.logChange(changeMarker, string(m.ID), patchAction(item.Op), tx)
+	return nil
+}
+
+func (o *Operation) patchGenericTask(item PatchItem, state *patchState, gid GoogleID, tx *sql.Tx) error {
+	if item.Op == "delete" {
+		id := TaskID(item.ID)
+		if err := item.checkExists(state.tasks[id]); err != nil {
+			return err
+		}
+		if err := o.ID.deleteGenericTask(id, tx); err != nil {
+			return err
+		}
+		delete(state.tasks, id)
+		o.ID.logChange(changeGeneric, string(id), changeDelete, tx)
+		return nil
+	}
+
+	var g GenericTask
+	if err := json.Unmarshal(item.Value, &g); err != nil {
+		return &PatchError{Reason: err.Error()}
+	}
+	if g.ID == "" {
+		return &PatchError{Reason: "task ID required"}
+	}
+	if err := item.checkExists(state.tasks[g.ID]); err != nil {
+		return err
+	}
+	if state.links[LinkID(g.ID)] || state.markers[MarkerID(g.ID)] {
+		return &PatchError{Reason: "task ID already in use"}
+	}
+	if g.PortalID != "" && !state.portals[g.PortalID] {
+		return &PatchError{Reason: "attempt to add task to unknown portal"}
+	}
+	if _, _, ok := g.location(); !ok && (g.Lat != "" || g.Lon != "") {
+		return &PatchError{Reason: "invalid task location"}
+	}
+	if g.Zone != ZoneAll && !g.Zone.Valid() {
+		return &PatchError{Reason: "invalid zone"}
+	}
+
+	if err := o.ID.insertGenericTask(g, gid, tx); err != nil {
+		return err
+	}
+	state.tasks[g.ID] = true
+	o.ID.logChange(changeGeneric, string(g.ID), patchAction(item.Op), tx)
+	return nil
+}
+
+func (o *Operation) patchZone(item PatchItem, state *patchState, tx *sql.Tx) error {
+	if item.Op == "delete" {
+		zi, err := strconv.Atoi(item.ID)
+		if err != nil {
+			return &PatchError{Reason: "invalid zone"}
+		}
+		z := Zone(zi)
+		if err := item.checkExists(state.zones[z]); err != nil {
+			return err
+		}
+		if z == zonePrimary {
+			return &PatchError{Reason: "the primary zone cannot be deleted"}
+		}
+		if err := o.ID.deleteZone(z, tx); err != nil {
+			return err
+		}
+		delete(state.zones, z)
+		o.ID.logChange(changeZone, item.ID, changeDelete, tx)
+		return nil
+	}
+
+	var z ZoneListElement
+	if err := json.Unmarshal(item.Value, &z); err != nil {
+		return &PatchError{Reason: err.Error()}
+	}
+	if !z.Zone.Valid() || z.Zone == ZoneAll {
+		return &PatchError{Reason: "invalid zone"}
+	}
+	if err := item.checkExists(state.zones[z.Zone]); err != nil {
+		return err
+	}
+
+	if err := o.insertZone(z, tx); err != nil {
+		return err
+	}
+	state.zones[z.Zone] = true
+	o.ID.logChange(changeZone, strconv.Itoa(int(z.Zone)), patchAction(item.Op), tx)
+	return nil
+}
+
+func (o *Operation) patchKey(item PatchItem, state *patchState, gid GoogleID, tx *sql.Tx) error {
+	var k KeyOnHand
+	if len(item.Value) == 0 {
+		return &PatchError{Reason: "value required for keys"}
+	}
+	if err := json.Unmarshal(item.Value, &k); err != nil {
+		return &PatchError{Reason: err.Error()}
+	}
+	if !state.portals[k.ID] {
+		return &PatchError{Reason: "key for unknown portal"}
+	}
+	if k.Gid == "" {
+		k.Gid = gid
+	}
+	if item.Op == "delete" {
+		k.Onhand = 0
+	}
+
+	if err := o.insertKey(k, tx); err != nil {
+		return err
+	}
+	o.ID.logChange(changeKey, string(k.ID), changeChange, tx)
+	return nil
+}
+
+func patchAction(op string) string {
+	if op == "add" {
+		return changeAdd
+	}
+	return changeChange
+}
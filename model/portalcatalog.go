@@ -0,0 +1,187 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// the catalog holds the latest name and location of every portal, the portal table holds each op's comment, hardness and SBUL
+// portals not yet in the catalog fall back to the op's copy
+const (
+	catalogJoin    = "LEFT JOIN portalcatalog ON portal.ID = portalcatalog.ID"
+	catalogNameLoc = "COALESCE(portalcatalog.name, portal.name), Y(COALESCE(portalcatalog.loc, portal.loc)) AS lat, X(COALESCE(portalcatalog.loc, portal.loc)) AS lon"
+)
+
+// portalSearchMax is the most portals a search returns
+const portalSearchMax = 100
+
+// catalogMoveMax is the furthest, in meters, an upload may move a portal in the catalog without a second agent confirming it
+const catalogMoveMax = 100
+
+// CatalogPortal is a portal as known across all ops
+type CatalogPortal struct {
+	ID      PortalID     `json:"id"`
+	Name    string       `json:"name"`
+	Lat     string       `json:"lat"`
+	Lon     string       `json:"lng"`
+	Updated string       `json:"updated"` // time.RFC1123 format
+	Pending *CatalogMove `json:"pending,omitempty"`
+}
+
+// CatalogMove is an uploaded move further than catalogMoveMax, held until another agent uploads the same location
+type CatalogMove struct {
+	Name  string   `json:"name"`
+	Lat   string   `json:"lat"`
+	Lon   string   `json:"lng"`
+	Agent GoogleID `json:"agent"`
+	Since string   `json:"since"` // time.RFC1123 format
+}
+
+// PortalSearch is the criteria for a catalog search, at least one of name, the bounding box or the radius must be set
+// the bounding box is South, West, North, East; Radius is in meters around Lat, Lon
+type PortalSearch struct {
+	Name   string
+	Box    []float64
+	Lat    float64
+	Lon    float64
+	Radius float64
+}
+
+// updateCatalog records the portal's name and location, the most recent upload wins
+// an upload moving a portal further than catalogMoveMax is held as the pending move until a different agent uploads the same location
+func (opID OperationID) updateCatalog(p Portal, gid GoogleID, tx *sql.Tx) error {
+	lat, lon, ok := parseLatLon(p.Lat, p.Lon)
+	if !ok || p.Name == "" {
+		return nil
+	}
+
+	var name string
+	var clat, clon float64
+	var plat, plon sql.NullFloat64
+	var pgid sql.NullString
+	err := tx.QueryRow("SELECT name, Y(loc), X(loc), Y(pendingloc), X(pendingloc), pendinggid FROM portalcatalog WHERE ID = ? FOR UPDATE", p.ID).Scan(&name, &clat, &clon, &plat, &plon, &pgid)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(err)
+		return err
+	}
+	if err == sql.ErrNoRows {
+		if _, err := tx.Exec("INSERT IGNORE INTO portalcatalog (ID, name, loc, updated) VALUES (?, ?, POINT(?, ?), UTC_TIMESTAMP())", p.ID, p.Name, p.Lon, p.Lat); err != nil {
+			log.Error(err)
+			return err
+		}
+		return nil
+	}
+
+	moved := util.Distance(clat, clon, lat, lon)
+	if moved > catalogMoveMax {
+		confirmed := plat.Valid && plon.Valid && pgid.String != string(gid) && util.Distance(plat.Float64, plon.Float64, lat, lon) <= catalogMoveMax
+		if !confirmed {
+			if _, err := tx.Exec("UPDATE portalcatalog SET pendingname = ?, pendingloc = POINT(?, ?), pendinggid = ?, pendingsince = UTC_TIMESTAMP() WHERE ID = ?", p.Name, p.Lon, p.Lat, gid, p.ID); err != nil {
+				log.Error(err)
+				return err
+			}
+			log.Warnw("portal catalog move held until another agent confirms it", "GID", gid, "resource", opID, "portal", p.ID, "name", p.Name, "distance", math.Round(moved), "lat", lat, "lon", lon)
+			return nil
+		}
+		log.Infow("portal catalog move confirmed", "GID", gid, "resource", opID, "portal", p.ID, "proposedby", pgid.String, "distance", math.Round(moved))
+	} else if name == p.Name && clat == lat && clon == lon {
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE portalcatalog SET name = ?, loc = POINT(?, ?), updated = UTC_TIMESTAMP(), pendingname = NULL, pendingloc = NULL, pendinggid = NULL, pendingsince = NULL WHERE ID = ?", p.Name, p.Lon, p.Lat, p.ID); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infow("portal catalog updated", "GID", gid, "resource", opID, "portal", p.ID, "oldname", name, "name", p.Name, "oldlat", clat, "oldlon", clon, "lat", lat, "lon", lon)
+	return nil
+}
+
+// SearchPortals finds catalog portals matching the search, limited to portals in ops gid can fully read
+func SearchPortals(gid GoogleID, s PortalSearch) ([]CatalogPortal, error) {
+	portals := make([]CatalogPortal, 0)
+
+	if s.Name == "" && len(s.Box) == 0 && s.Radius <= 0 {
+		return portals, errors.New("search requires a name, a bounding box or a radius")
+	}
+	if len(s.Box) != 0 && len(s.Box) != 4 {
+		return portals, errors.New("bounding box requires south, west, north and east")
+	}
+
+	ops, err := gid.fullReadOps()
+	if err != nil {
+		return portals, err
+	}
+	if len(ops) == 0 {
+		return portals, nil
+	}
+
+	var where []string
+	var args []interface{}
+	if s.Name != "" {
+		where = append(where, "portalcatalog.name LIKE ?")
+		args = append(args, "%"+strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s.Name)+"%")
+	}
+	if len(s.Box) == 4 {
+		where = append(where, "Y(portalcatalog.loc) BETWEEN ? AND ? AND X(portalcatalog.loc) BETWEEN ? AND ?")
+		args = append(args, s.Box[0], s.Box[2], s.Box[1], s.Box[3])
+	}
+	if s.Radius > 0 {
+		minLat, minLon, maxLat, maxLon := util.BoundingBox(s.Lat, s.Lon, s.Radius)
+		where = append(where, "Y(portalcatalog.loc) BETWEEN ? AND ? AND X(portalcatalog.loc) BETWEEN ? AND ?")
+		args = append(args, minLat, maxLat, minLon, maxLon)
+	}
+	for _, opID := range ops {
+		args = append(args, opID)
+	}
+
+	// #nosec -- only fixed conditions and placeholders are added to the query
+	q := fmt.Sprintf("SELECT DISTINCT portalcatalog.ID, portalcatalog.name, Y(portalcatalog.loc), X(portalcatalog.loc), portalcatalog.updated, portalcatalog.pendingname, Y(portalcatalog.pendingloc), X(portalcatalog.pendingloc), portalcatalog.pendinggid, portalcatalog.pendingsince FROM portalcatalog JOIN portal ON portalcatalog.ID = portal.ID WHERE %s AND portal.opID IN (?%s) ORDER BY portalcatalog.name",
+		strings.Join(where, " AND "), strings.Repeat(",?", len(ops)-1))
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		log.Error(err)
+		return portals, err
+	}
+	defer rows.Close()
+
+	for rows.Next() && len(portals) < portalSearchMax {
+		var p CatalogPortal
+		var lat, lon float64
+		var updated string
+		var pname, pgid, psince sql.NullString
+		var plat, plon sql.NullFloat64
+		if err := rows.Scan(&p.ID, &p.Name, &lat, &lon, &updated, &pname, &plat, &plon, &pgid, &psince); err != nil {
+			log.Error(err)
+			continue
+		}
+		if s.Radius > 0 && util.Distance(s.Lat, s.Lon, lat, lon) > s.Radius {
+			continue
+		}
+		p.Lat = strconv.FormatFloat(lat, 'f', 6, 64)
+		p.Lon = strconv.FormatFloat(lon, 'f', 6, 64)
+		if ts, err := time.ParseInLocation("2006-01-02 15:04:05", updated, time.UTC); err == nil {
+			p.Updated = ts.Format(time.RFC1123)
+		}
+		if plat.Valid && plon.Valid {
+			p.Pending = &CatalogMove{
+				Name:  pname.String,
+				Lat:   strconv.FormatFloat(plat.Float64, 'f', 6, 64),
+				Lon:   strconv.FormatFloat(plon.Float64, 'f', 6, 64),
+				Agent: GoogleID(pgid.String),
+			}
+			if ts, err := time.ParseInLocation("2006-01-02 15:04:05", psince.String, time.UTC); err == nil {
+				p.Pending.Since = ts.Format(time.RFC1123)
+			}
+		}
+		portals = append(portals, p)
+	}
+	return portals, nil
+}
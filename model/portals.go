@@ -8,6 +8,13 @@ import (
 	"github.com/wasabee-project/Wasabee-Server/util"
 )
 
+// outbound link limits, each SoftBank Ultra Link adds linksPerSBUL to the base
+const (
+	outboundLinks = 8
+	linksPerSBUL  = 8
+	maxSBUL       = 4
+)
+
 // PortalID wrapper to ensure type safety
 type PortalID string
 
@@ -19,34 +26,35 @@ type Portal struct {
 	Lon      string   `json:"lng"`
 	Comment  string   `json:"comment"`
 	Hardness string   `json:"hardness"` // string for now, enum in the future
+	SBUL     uint8    `json:"sbul"`     // SoftBank Ultra Links planned for the portal, raises the outbound link limit
 	opID     OperationID
 }
 
 // insertPortal adds a portal to the database
-func (opID OperationID) insertPortal(p Portal, tx *sql.Tx) error {
+func (opID OperationID) insertPortal(p Portal, gid GoogleID, tx *sql.Tx) error {
 	comment := makeNullString(util.Sanitize(p.Comment))
 	hardness := makeNullString(util.Sanitize(p.Hardness))
 
-	_, err := tx.Exec("INSERT IGNORE INTO portal (ID, opID, name, loc, comment, hardness) VALUES (?, ?, ?, POINT(?, ?), ?, ?)",
-		p.ID, opID, p.Name, p.Lon, p.Lat, comment, hardness)
+	_, err := tx.Exec("INSERT IGNORE INTO portal (ID, opID, name, loc, comment, hardness, sbul) VALUES (?, ?, ?, POINT(?, ?), ?, ?, ?)",
+		p.ID, opID, p.Name, p.Lon, p.Lat, comment, hardness, p.SBUL)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	return nil
+	return opID.updateCatalog(p, gid, tx)
 }
 
-func (opID OperationID) updatePortal(p Portal, tx *sql.Tx) error {
+func (opID OperationID) updatePortal(p Portal, gid GoogleID, tx *sql.Tx) error {
 	comment := makeNullString(util.Sanitize(p.Comment))
 	hardness := makeNullString(util.Sanitize(p.Hardness))
 
-	_, err := tx.Exec("REPLACE INTO portal (ID, opID, name, loc, comment, hardness) VALUES (?, ?, ?, POINT(?, ?), ?, ?)", // REPLACE OK SCB (so long as any task is rebuilt after)
-		p.ID, opID, p.Name, p.Lon, p.Lat, comment, hardness)
+	_, err := tx.Exec("REPLACE INTO portal (ID, opID, name, loc, comment, hardness, sbul) VALUES (?, ?, ?, POINT(?, ?), ?, ?, ?)", // REPLACE OK SCB (so long as any task is rebuilt after)
+		p.ID, opID, p.Name, p.Lon, p.Lat, comment, hardness, p.SBUL)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	return nil
+	return opID.updateCatalog(p, gid, tx)
 }
 
 func (opID OperationID) deletePortal(p PortalID, tx *sql.Tx) error {
@@ -63,7 +71,7 @@ func (o *Operation) populatePortals() error {
 	var p Portal
 	p.opID = o.ID
 
-	rows, err := db.Query("SELECT ID, name, Y(loc) AS lat, X(loc) AS lon, comment, hardness FROM portal WHERE opID = ?", o.ID)
+	rows, err := db.Query("SELECT portal.ID, "+catalogNameLoc+", portal.comment, portal.hardness, portal.sbul FROM portal "+catalogJoin+" WHERE portal.opID = ?", o.ID)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -73,7 +81,7 @@ func (o *Operation) populatePortals() error {
 	for rows.Next() {
 		var comment, hardness sql.NullString
 
-		err := rows.Scan(&p.ID, &p.Name, &p.Lat, &p.Lon, &comment, &hardness)
+		err := rows.Scan(&p.ID, &p.Name, &p.Lat, &p.Lon, &comment, &hardness, &p.SBUL)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -109,6 +117,20 @@ func (o *Operation) filterPortals() error {
 		set[m.PortalID] = p
 	}
 
+	for _, g := range o.Tasks {
+		if g.PortalID != "" {
+			p, _ := o.getPortal(g.PortalID)
+			set[g.PortalID] = p
+		}
+	}
+
+	for _, b := range o.Blockers {
+		p, _ := o.getPortal(b.From)
+		set[b.From] = p
+		p, _ = o.getPortal(b.To)
+		set[b.To] = p
+	}
+
 	for _, k := range o.Keys {
 		p, _ := o.getPortal(k.ID)
 		set[k.ID] = p
@@ -135,6 +157,11 @@ func (o *Operation) populateAnchors() error {
 	return nil
 }
 
+// outboundLimit is the number of links which can be thrown from the portal
+func (p Portal) outboundLimit() int {
+	return outboundLinks + int(p.SBUL)*linksPerSBUL
+}
+
 // String returns the string version of a PortalID
 func (p PortalID) String() string {
 	return string(p)
@@ -144,24 +171,46 @@ func (p PortalID) String() string {
 func (opID OperationID) PortalHardness(portalID PortalID, hardness string) error {
 	h := makeNullString(util.Sanitize(hardness))
 
-	_, err := db.Exec("UPDATE portal SET hardness = ? WHERE ID = ? AND opID = ?", h, portalID, opID)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+	return opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE portal SET hardness = ? WHERE ID = ? AND opID = ?", h, portalID, opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		opID.logChange(changePortal, string(portalID), changeChange, tx)
+		return nil
+	})
 }
 
 // PortalComment updates the comment on a portal
 func (opID OperationID) PortalComment(portalID PortalID, comment string) error {
 	c := makeNullString(util.Sanitize(comment))
 
-	_, err := db.Exec("UPDATE portal SET comment = ? WHERE ID = ? AND opID = ?", c, portalID, opID)
-	if err != nil {
-		log.Error(err)
+	return opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE portal SET comment = ? WHERE ID = ? AND opID = ?", c, portalID, opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		opID.logChange(changePortal, string(portalID), changeChange, tx)
+		return nil
+	})
+}
+
+// PortalSBUL sets the number of SoftBank Ultra Links planned for a portal
+func (opID OperationID) PortalSBUL(portalID PortalID, sbul uint8) error {
+	if sbul > maxSBUL {
+		err := fmt.Errorf("a portal can have at most %d SBULs", maxSBUL)
+		log.Infow(err.Error(), "resource", opID, "portal", portalID)
 		return err
 	}
-	return nil
+
+	return opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE portal SET sbul = ? WHERE ID = ? AND opID = ?", sbul, portalID, opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		opID.logChange(changePortal, string(portalID), changeChange, tx)
+		return nil
+	})
 }
 
 // PortalDetails returns information about the portal
@@ -178,7 +227,7 @@ func (o *Operation) PortalDetails(portalID PortalID, gid GoogleID) (*Portal, err
 	}
 
 	var comment, hardness sql.NullString
-	err := db.QueryRow("SELECT name, Y(loc) AS lat, X(loc) AS lon, comment, hardness FROM portal WHERE opID = ? AND ID = ?", o.ID, portalID).Scan(&p.Name, &p.Lat, &p.Lon, &comment, &hardness)
+	err := db.QueryRow("SELECT "+catalogNameLoc+", portal.comment, portal.hardness FROM portal "+catalogJoin+" WHERE portal.opID = ? AND portal.ID = ?", o.ID, portalID).Scan(&p.Name, &p.Lat, &p.Lon, &comment, &hardness)
 	if err != nil && err == sql.ErrNoRows {
 		err := fmt.Errorf("portal %s not in op", portalID)
 		return &p, err
@@ -203,7 +252,7 @@ func (opID OperationID) portalDetails(portalID PortalID, tx *sql.Tx) (*Portal, e
 	p.opID = opID
 
 	var comment, hardness sql.NullString
-	err := tx.QueryRow("SELECT name, Y(loc) AS lat, X(loc) AS lon, comment, hardness FROM portal WHERE opID = ? AND ID = ?", opID, portalID).Scan(&p.Name, &p.Lat, &p.Lon, &comment, &hardness)
+	err := tx.QueryRow("SELECT "+catalogNameLoc+", portal.comment, portal.hardness, portal.sbul FROM portal "+catalogJoin+" WHERE portal.opID = ? AND portal.ID = ?", opID, portalID).Scan(&p.Name, &p.Lat, &p.Lon, &comment, &hardness, &p.SBUL)
 	if err != nil && err == sql.ErrNoRows {
 		err := fmt.Errorf("portal %s not in op", portalID)
 		return &p, err
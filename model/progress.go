@@ -0,0 +1,199 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// progressRecent is the number of recent completions reported
+const progressRecent = 10
+
+// ProgressCount is the number of tasks in each state
+// for agents, assigned tasks are those not yet acknowledged
+type ProgressCount struct {
+	Total        int     `json:"total"`
+	Pending      int     `json:"pending"`
+	Assigned     int     `json:"assigned"`
+	Acknowledged int     `json:"acknowledged"`
+	Completed    int     `json:"completed"`
+	Percent      float64 `json:"percent"` // completed, 0-100
+}
+
+// OverdueTask is a task whose scheduled time has passed but which is not completed
+type OverdueTask struct {
+	Task        TaskID     `json:"task"`
+	Type        string     `json:"type"`
+	State       string     `json:"state"`
+	Scheduled   string     `json:"scheduled"` // time.RFC1123 format
+	Assignments []GoogleID `json:"assignments"`
+}
+
+// OpProgress summarizes the state of an op's tasks
+// Types is keyed by "link", "task" or the marker type; Colors only covers links
+type OpProgress struct {
+	ID         OperationID               `json:"ID"`
+	LastEditID string                    `json:"lasteditid"`
+	Fetched    string                    `json:"fetched"` // time.RFC1123 format
+	Overall    ProgressCount             `json:"overall"`
+	Zones      map[string]*ProgressCount `json:"zones"`
+	Agents     map[string]*ProgressCount `json:"agents"`
+	Types      map[string]*ProgressCount `json:"types"`
+	Colors     map[string]*ProgressCount `json:"colors"`
+	Overdue    []OverdueTask             `json:"overdue"`
+	Recent     []TaskEvent               `json:"recent"` // the most recent completions, newest first
+}
+
+// add counts a task in the given state
+func (p *ProgressCount) add(state string) {
+	p.Total++
+	switch state {
+	case "assigned":
+		p.Assigned++
+	case "acknowledged":
+		p.Acknowledged++
+	case "completed":
+		p.Completed++
+	default:
+		p.Pending++
+	}
+	p.Percent = float64(p.Completed) * 100 / float64(p.Total)
+}
+
+// Progress reports the state of the op's tasks, limited to what gid can see
+// it reads the task tables directly rather than populating the op so it can be polled
+func (o *Operation) Progress(gid GoogleID) (*OpProgress, error) {
+	read, zones := o.ReadAccess(gid)
+	if !read {
+		err := fmt.Errorf("unauthorized: you are not on a team authorized to see this full operation (%s: %s)", gid, o.ID)
+		log.Warnw(err.Error(), "GID", gid, "resource", o.ID)
+		return nil, err
+	}
+
+	p := OpProgress{
+		ID:      o.ID,
+		Fetched: time.Now().UTC().Format(time.RFC1123),
+		Zones:   make(map[string]*ProgressCount),
+		Agents:  make(map[string]*ProgressCount),
+		Types:   make(map[string]*ProgressCount),
+		Colors:  make(map[string]*ProgressCount),
+		Overdue: make([]OverdueTask, 0),
+		Recent:  make([]TaskEvent, 0),
+	}
+
+	var reference string
+	err := db.QueryRow("SELECT lasteditid, referencetime FROM operation WHERE ID = ?", o.ID).Scan(&p.LastEditID, &reference)
+	if err == sql.ErrNoRows {
+		err = errors.New(ErrOpNotFound)
+		log.Warnw(err.Error(), "GID", gid, "resource", o.ID)
+		return nil, err
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	rt, err := time.ParseInLocation("2006-01-02 15:04:05", reference, time.UTC)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	assignments, err := o.ID.assignmentPrecache()
+	if err != nil {
+		return nil, err
+	}
+
+	count := func(m map[string]*ProgressCount, key, state string) {
+		if _, ok := m[key]; !ok {
+			m[key] = &ProgressCount{}
+		}
+		m[key].add(state)
+	}
+
+	now := time.Now().UTC()
+	visible := make(map[TaskID]bool)
+
+	rows, err := db.Query("SELECT task.ID, task.state, task.zone, task.delta, link.color, marker.type FROM task LEFT JOIN link ON task.ID = link.ID AND task.opID = link.opID LEFT JOIN marker ON task.ID = marker.ID AND task.opID = marker.opID WHERE task.opID = ?", o.ID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Task
+		var color, markerType sql.NullString
+		if err := rows.Scan(&t.ID, &t.State, &t.Zone, &t.DeltaMinutes, &color, &markerType); err != nil {
+			log.Error(err)
+			continue
+		}
+		if t.State == "" { // enums in sql default to "" if invalid
+			t.State = "pending"
+		}
+		t.Assignments = assignments[t.ID]
+
+		assignedToMe := false
+		for _, a := range t.Assignments {
+			if a == gid {
+				assignedToMe = true
+			}
+		}
+		if !t.Zone.inZones(zones) && !assignedToMe {
+			continue
+		}
+		visible[t.ID] = true
+
+		taskType := "task"
+		if color.Valid {
+			taskType = "link"
+			count(p.Colors, color.String, t.State)
+		} else if markerType.Valid {
+			taskType = markerType.String
+		}
+
+		p.Overall.add(t.State)
+		count(p.Zones, strconv.Itoa(int(t.Zone)), t.State)
+		count(p.Types, taskType, t.State)
+		for _, a := range t.Assignments {
+			count(p.Agents, string(a), t.State)
+		}
+
+		if scheduled := t.scheduledAt(rt); t.State != "completed" && scheduled.Before(now) {
+			a := t.Assignments
+			if a == nil {
+				a = make([]GoogleID, 0)
+			}
+			p.Overdue = append(p.Overdue, OverdueTask{
+				Task:        t.ID,
+				Type:        taskType,
+				State:       t.State,
+				Scheduled:   scheduled.Format(time.RFC1123),
+				Assignments: a,
+			})
+		}
+	}
+
+	// completions of tasks gid cannot see are skipped, read a few more than needed to fill the list
+	erows, err := db.Query("SELECT taskID, gid, event, oldvalue, newvalue, changed FROM taskevents WHERE opID = ? AND (event = ? OR (event = ? AND newvalue = 'completed')) ORDER BY seq DESC LIMIT ?", o.ID, taskEventComplete, taskEventState, progressRecent*5)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer erows.Close()
+
+	for erows.Next() && len(p.Recent) < progressRecent {
+		e, err := scanTaskEvent(erows)
+		if err != nil {
+			continue
+		}
+		if !visible[e.Task] {
+			continue
+		}
+		p.Recent = append(p.Recent, e)
+	}
+	return &p, nil
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestProgressCountAdd(t *testing.T) {
+	var p ProgressCount
+	for _, s := range []string{"pending", "assigned", "acknowledged", "completed", "completed", "unknown"} {
+		p.add(s)
+	}
+
+	want := ProgressCount{Total: 6, Pending: 2, Assigned: 1, Acknowledged: 1, Completed: 2}
+	want.Percent = float64(2) * 100 / 6
+	if p != want {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+
+	var done ProgressCount
+	done.add("completed")
+	if done.Percent != 100 {
+		t.Errorf("one completed task is %f percent", done.Percent)
+	}
+}
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/messaging"
+)
+
+// SetReminders turns task reminders on or off for an op, only the owner may do this
+func (opID OperationID) SetReminders(gid GoogleID, enabled bool) error {
+	if !opID.IsOwner(gid) {
+		err := errors.New(ErrNotOpOwner)
+		log.Warnw(err.Error(), "GID", gid, "resource", opID)
+		return err
+	}
+
+	return opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE operation SET reminders = ? WHERE ID = ?", enabled, opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		opID.logChange(changeOp, string(opID), changeChange, tx)
+		return nil
+	})
+}
+
+// SendReminders tells assignees that a task is coming up, leads are the minutes before the scheduled time to send them
+// only the closest lead which has been reached is sent, so a restart does not deliver a burst of stale reminders
+// sent reminders are recorded against the scheduled time, rescheduled tasks are reminded again
+func SendReminders(leads []int) {
+	if len(leads) == 0 {
+		return
+	}
+	sorted := make([]int, len(leads))
+	copy(sorted, leads)
+	sort.Ints(sorted)
+	furthest := sorted[len(sorted)-1]
+
+	rows, err := db.Query("SELECT task.opID, task.ID, assignments.gid, operation.name, task.taskorder, DATE_ADD(operation.referencetime, INTERVAL task.delta MINUTE), TIMESTAMPDIFF(SECOND, UTC_TIMESTAMP(), DATE_ADD(operation.referencetime, INTERVAL task.delta MINUTE)) FROM task JOIN operation ON task.opID = operation.ID JOIN assignments ON assignments.opID = task.opID AND assignments.taskID = task.ID WHERE operation.reminders = 1 AND operation.state != 'archived' AND task.state IN ('pending', 'assigned') AND task.opID NOT IN (SELECT opID FROM deletedops) AND DATE_ADD(operation.referencetime, INTERVAL task.delta MINUTE) BETWEEN UTC_TIMESTAMP() AND DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? MINUTE)", furthest)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	type reminder struct {
+		opID      OperationID
+		taskID    TaskID
+		gid       GoogleID
+		name      string
+		order     int16
+		scheduled string
+		lead      int
+	}
+	var due []reminder
+	for rows.Next() {
+		var r reminder
+		var secs int64
+		if err := rows.Scan(&r.opID, &r.taskID, &r.gid, &r.name, &r.order, &r.scheduled, &secs); err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, l := range sorted {
+			if secs <= int64(l)*60 {
+				r.lead = l
+				break
+			}
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+
+	for _, r := range due {
+		// the record is the lock, if it is already there the reminder was sent
+		res, err := db.Exec("INSERT IGNORE INTO reminders (opID, taskID, gid, scheduled, leadtime) VALUES (?, ?, ?, ?, ?)", r.opID, r.taskID, r.gid, r.scheduled, r.lead)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		msg := fmt.Sprintf("Reminder: step %d of %s is due in %d minutes", r.order, r.name, r.lead)
+		log.Debugw("sending reminder", "resource", r.opID, "task", r.taskID, "GID", r.gid, "lead", r.lead)
+		if _, err := messaging.SendMessage(messaging.GoogleID(r.gid), msg); err != nil {
+			log.Info(err)
+		}
+		messaging.SendAssignment(messaging.GoogleID(r.gid), messaging.TaskID(r.taskID), messaging.OperationID(r.opID), "reminder")
+	}
+}
+
+// ReminderClean removes the record of reminders for tasks scheduled more than a day ago
+func ReminderClean() {
+	if _, err := db.Exec("DELETE FROM reminders WHERE scheduled < DATE_SUB(UTC_TIMESTAMP(), INTERVAL 1 DAY)"); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,151 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// Revision is a stored copy of an operation as it was after an upload
+type Revision struct {
+	OpID       OperationID     `json:"opID"`
+	LastEditID string          `json:"lasteditid"`
+	Gid        GoogleID        `json:"gid"`
+	Created    string          `json:"created"`
+	Operation  json.RawMessage `json:"operation,omitempty"`
+}
+
+// saveRevision stores the current state of the op as it is in the database, keyed by the current lasteditid
+// gid must have full read access, callers are expected to have checked write access already
+func (opID OperationID) saveRevision(gid GoogleID) error {
+	o := Operation{ID: opID}
+	if err := o.Populate(gid); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	snapshot, err := json.Marshal(&o)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if _, err := db.Exec("INSERT IGNORE INTO oprevisions (opID, lasteditid, gid, created, snapshot) VALUES (?, ?, ?, UTC_TIMESTAMP(), ?)", opID, o.LastEditID, gid, snapshot); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// Revisions lists the stored revisions for an operation, newest first; the snapshots are not included
+func (opID OperationID) Revisions() ([]Revision, error) {
+	revisions := make([]Revision, 0)
+
+	rows, err := db.Query("SELECT lasteditid, gid, created FROM oprevisions WHERE opID = ? ORDER BY created DESC", opID)
+	if err != nil {
+		log.Error(err)
+		return revisions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := Revision{OpID: opID}
+		if err := rows.Scan(&r.LastEditID, &r.Gid, &r.Created); err != nil {
+			log.Error(err)
+			continue
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, nil
+}
+
+// Revision returns a single stored revision, including the snapshot
+func (opID OperationID) Revision(lasteditid string) (*Revision, error) {
+	r := Revision{OpID: opID}
+
+	var snapshot string
+	err := db.QueryRow("SELECT lasteditid, gid, created, snapshot FROM oprevisions WHERE opID = ? AND lasteditid = ?", opID, lasteditid).Scan(&r.LastEditID, &r.Gid, &r.Created, &snapshot)
+	if err != nil && err == sql.ErrNoRows {
+		err = errors.New(ErrRevisionNotFound)
+		log.Infow(err.Error(), "resource", opID, "revision", lasteditid)
+		return &r, err
+	}
+	if err != nil {
+		log.Error(err)
+		return &r, err
+	}
+	r.Operation = json.RawMessage(snapshot)
+	return &r, nil
+}
+
+// baseRevision returns the revision stored for lasteditid, or the newest revision stored before lasteditid was issued
+// merging against an older revision is only more cautious: items changed on the server since then are reported as conflicts unless both sides agree
+func (opID OperationID) baseRevision(lasteditid string) (*Revision, error) {
+	r, err := opID.Revision(lasteditid)
+	if err == nil || err.Error() != ErrRevisionNotFound {
+		return r, err
+	}
+
+	// Touch records when each lasteditid was issued
+	var older string
+	err = db.QueryRow("SELECT oprevisions.lasteditid FROM oprevisions JOIN opchanges ON opchanges.opID = oprevisions.opID AND opchanges.updateID = ? AND opchanges.action = ? WHERE oprevisions.opID = ? AND oprevisions.created < opchanges.changed ORDER BY oprevisions.created DESC LIMIT 1",
+		lasteditid, changeTouch, opID).Scan(&older)
+	if err != nil && err == sql.ErrNoRows {
+		err = errors.New(ErrRevisionNotFound)
+		log.Infow(err.Error(), "resource", opID, "revision", lasteditid, "message", "no older revision")
+		return r, err
+	}
+	if err != nil {
+		log.Error(err)
+		return r, err
+	}
+	log.Debugw("merging against an older revision", "resource", opID, "base", lasteditid, "revision", older)
+	return opID.Revision(older)
+}
+
+// RestoreRevision overwrites the current op with a stored revision, the restore is stored as a new revision
+// returns the new lasteditid
+func (opID OperationID) RestoreRevision(ctx context.Context, lasteditid string, gid GoogleID) (string, error) {
+	r, err := opID.Revision(lasteditid)
+	if err != nil {
+		return "", err
+	}
+
+	var o Operation
+	if err := json.Unmarshal(r.Operation, &o); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	if o.ID != opID {
+		err := errors.New("revision does not belong to this operation")
+		log.Errorw(err.Error(), "resource", opID, "revision", lasteditid, "mismatch", o.ID)
+		return "", err
+	}
+
+	if err := DrawUpdate(ctx, &o, gid); err != nil {
+		return "", err
+	}
+	log.Infow("restored revision", "resource", opID, "GID", gid, "revision", lasteditid, "updateID", o.LastEditID)
+	return o.LastEditID, nil
+}
+
+// RevisionClean removes revisions older than days and all but the newest keep revisions of each op
+// the newest revision of each op is never removed, so restores and merges always have something to work from
+func RevisionClean(days, keep int) {
+	if keep < 1 {
+		keep = 1
+	}
+
+	r, err := db.Exec("DELETE oprevisions FROM oprevisions JOIN (SELECT opID, lasteditid, ROW_NUMBER() OVER (PARTITION BY opID ORDER BY created DESC, lasteditid) AS n FROM oprevisions) AS ranked ON oprevisions.opID = ranked.opID AND oprevisions.lasteditid = ranked.lasteditid WHERE ranked.n > ? OR (ranked.n > 1 AND oprevisions.created < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? DAY))", keep, days)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if n, _ := r.RowsAffected(); n > 0 {
+		log.Infow("removed old revisions", "count", n)
+	}
+}
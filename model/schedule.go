@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+)
+
+// scheduledAt is when a task should happen, DeltaMinutes after the op's reference time
+func (t *Task) scheduledAt(reference time.Time) time.Time {
+	return reference.Add(time.Duration(t.DeltaMinutes) * time.Minute)
+}
+
+// schedule fills in the Scheduled time on every task
+func (o *Operation) schedule(reference time.Time) {
+	for i := range o.Links {
+		o.Links[i].Scheduled = o.Links[i].scheduledAt(reference).Format(time.RFC1123)
+	}
+	for i := range o.Markers {
+		o.Markers[i].Scheduled = o.Markers[i].scheduledAt(reference).Format(time.RFC1123)
+	}
+	for i := range o.Tasks {
+		o.Tasks[i].Scheduled = o.Tasks[i].scheduledAt(reference).Format(time.RFC1123)
+	}
+}
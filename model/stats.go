@@ -0,0 +1,288 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// statsCacheMax is the number of cached stats above which the cache is emptied
+const statsCacheMax = 1000
+
+// OpStatistics is a summary of an op's plan, computed from what the agent can see
+// lengths are in meters and areas in square meters, areas are approximate
+type OpStatistics struct {
+	ID              OperationID        `json:"ID"`
+	LastEditID      string             `json:"lasteditid"`
+	Links           int                `json:"links"`
+	LinksByColor    map[string]int     `json:"linksbycolor"`
+	LinkLength      float64            `json:"linklength"`
+	AgentLinkLength map[string]float64 `json:"agentlinklength"`
+	PortalsByMarker map[string]int     `json:"portalsbymarker"` // distinct portals with a marker of each type
+	Fields          int                `json:"fields"`          // fields formed when the links are thrown in order
+	FieldArea       float64            `json:"fieldarea"`       // total, layers are counted each time
+	MuRecorded      int64              `json:"murecorded"`
+	MuEstimated     int64              `json:"muestimated"` // recorded MU plus the MU density of recorded fields applied to the rest
+	Bounds          *OpBounds          `json:"bounds,omitempty"`
+	Area            float64            `json:"area"` // the convex hull of the op's portals
+}
+
+// OpBounds is the bounding box of the op's portals
+type OpBounds struct {
+	North float64 `json:"north"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	West  float64 `json:"west"`
+}
+
+var statsCache = struct {
+	sync.RWMutex
+	m map[string]*OpStatistics
+}{m: make(map[string]*OpStatistics)}
+
+// xy is a point projected onto a plane around the op, in meters
+type xy struct {
+	x, y float64
+}
+
+// Stats returns the op summary for gid, cached until the op changes
+func (o *Operation) Stats(gid GoogleID) (*OpStatistics, error) {
+	read, zones := o.ReadAccess(gid)
+
+	// agents who see the whole op share the cached copy, zone limits change without a new lasteditid so they are part of the key
+	key := string(o.ID)
+	if !read || !ZoneAll.inZones(zones) {
+		z := make([]int, 0, len(zones))
+		for _, zone := range zones {
+			z = append(z, int(zone))
+		}
+		sort.Ints(z)
+		key = fmt.Sprintf("%s:%s:%v", o.ID, gid, z)
+	}
+
+	var lasteditid string
+	if err := db.QueryRow("SELECT lasteditid FROM operation WHERE ID = ?", o.ID).Scan(&lasteditid); err != nil {
+		log.Error(err)
+		// let Populate sort it out
+	}
+
+	statsCache.RLock()
+	s, ok := statsCache.m[key]
+	statsCache.RUnlock()
+	if ok && s.LastEditID == lasteditid {
+		return s, nil
+	}
+
+	if err := o.Populate(gid); err != nil {
+		return nil, err
+	}
+	s = o.computeStats()
+
+	statsCache.Lock()
+	if len(statsCache.m) > statsCacheMax {
+		statsCache.m = make(map[string]*OpStatistics)
+	}
+	statsCache.m[key] = s
+	statsCache.Unlock()
+	return s, nil
+}
+
+// computeStats builds the summary from a populated op
+func (o *Operation) computeStats() *OpStatistics {
+	s := OpStatistics{
+		ID:              o.ID,
+		LastEditID:      o.LastEditID,
+		LinksByColor:    make(map[string]int),
+		AgentLinkLength: make(map[string]float64),
+		PortalsByMarker: make(map[string]int),
+	}
+
+	type located struct {
+		lat, lon float64
+	}
+	portals := make(map[PortalID]located)
+	var sumLat, sumLon float64
+	for _, p := range o.OpPortals {
+		lat, lon, ok := parseLatLon(p.Lat, p.Lon)
+		if !ok {
+			continue
+		}
+		portals[p.ID] = located{lat, lon}
+		sumLat += lat
+		sumLon += lon
+
+		if s.Bounds == nil {
+			s.Bounds = &OpBounds{North: lat, South: lat, East: lon, West: lon}
+		}
+		s.Bounds.North = math.Max(s.Bounds.North, lat)
+		s.Bounds.South = math.Min(s.Bounds.South, lat)
+		s.Bounds.East = math.Max(s.Bounds.East, lon)
+		s.Bounds.West = math.Min(s.Bounds.West, lon)
+	}
+
+	// an equirectangular projection around the middle of the op is close enough at op scales
+	var lat0, lon0 float64
+	if len(portals) > 0 {
+		lat0, lon0 = sumLat/float64(len(portals)), sumLon/float64(len(portals))
+	}
+	project := func(id PortalID) (xy, bool) {
+		p, ok := portals[id]
+		if !ok {
+			return xy{}, false
+		}
+		rad := math.Pi / 180
+		return xy{
+			x: (p.lon - lon0) * rad * util.EarthRadius * math.Cos(lat0*rad),
+			y: (p.lat - lat0) * rad * util.EarthRadius,
+		}, true
+	}
+
+	points := make([]xy, 0, len(portals))
+	for id := range portals {
+		p, _ := project(id)
+		points = append(points, p)
+	}
+	s.Area = polygonArea(convexHull(points))
+
+	seen := make(map[string]map[PortalID]bool)
+	for _, m := range o.Markers {
+		t := m.Type.String()
+		if _, ok := seen[t]; !ok {
+			seen[t] = make(map[PortalID]bool)
+		}
+		seen[t][m.PortalID] = true
+	}
+	for t, ps := range seen {
+		s.PortalsByMarker[t] = len(ps)
+	}
+
+	links := make([]Link, len(o.Links))
+	copy(links, o.Links)
+	sort.SliceStable(links, func(i, j int) bool { return links[i].Order < links[j].Order })
+
+	// the area of fields closed by links with no recorded MU, and the MU density of those with
+	var unrecordedArea, sampledArea float64
+	var sampledMu int64
+
+	linked := make(map[PortalID]map[PortalID]bool)
+	for _, l := range links {
+		s.Links++
+		s.LinksByColor[l.Color]++
+		s.MuRecorded += int64(l.MuCaptured)
+
+		from, okf := portals[l.From]
+		to, okt := portals[l.To]
+		if !okf || !okt || l.From == l.To {
+			continue
+		}
+		length := util.Distance(from.lat, from.lon, to.lat, to.lon)
+		s.LinkLength += length
+		for _, a := range l.Assignments {
+			s.AgentLinkLength[string(a)] += length
+		}
+
+		if linked[l.From][l.To] {
+			continue
+		}
+
+		// a link closes the largest field available on each side of it
+		a, _ := project(l.From)
+		b, _ := project(l.To)
+		var left, right float64
+		for c := range linked[l.From] {
+			if !linked[l.To][c] {
+				continue
+			}
+			p, ok := project(c)
+			if !ok {
+				continue
+			}
+			area := triangleArea(a, b, p)
+			if area > 0 && area > left {
+				left = area
+			} else if area < 0 && -area > right {
+				right = -area
+			}
+		}
+		closed := left + right
+		if left > 0 {
+			s.Fields++
+		}
+		if right > 0 {
+			s.Fields++
+		}
+		s.FieldArea += closed
+		if closed > 0 {
+			if l.MuCaptured > 0 {
+				sampledArea += closed
+				sampledMu += int64(l.MuCaptured)
+			} else {
+				unrecordedArea += closed
+			}
+		}
+
+		if linked[l.From] == nil {
+			linked[l.From] = make(map[PortalID]bool)
+		}
+		if linked[l.To] == nil {
+			linked[l.To] = make(map[PortalID]bool)
+		}
+		linked[l.From][l.To] = true
+		linked[l.To][l.From] = true
+	}
+
+	s.MuEstimated = s.MuRecorded
+	if sampledArea > 0 {
+		s.MuEstimated += int64(math.Round(float64(sampledMu) / sampledArea * unrecordedArea))
+	}
+	return &s
+}
+
+// triangleArea is the signed area of abc, positive if c is to the left of ab
+func triangleArea(a, b, c xy) float64 {
+	return ((b.x-a.x)*(c.y-a.y) - (c.x-a.x)*(b.y-a.y)) / 2
+}
+
+// convexHull returns the hull of the points in counter-clockwise order
+func convexHull(points []xy) []xy {
+	if len(points) < 3 {
+		return nil
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].x == points[j].x {
+			return points[i].y < points[j].y
+		}
+		return points[i].x < points[j].x
+	})
+
+	hull := make([]xy, 0, 2*len(points))
+	for _, p := range points {
+		for len(hull) >= 2 && triangleArea(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(points) - 2; i >= 0; i-- {
+		p := points[i]
+		for len(hull) >= lower && triangleArea(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull[:len(hull)-1]
+}
+
+// polygonArea is the area of a simple polygon
+func polygonArea(poly []xy) float64 {
+	var area float64
+	for i := range poly {
+		j := (i + 1) % len(poly)
+		area += poly[i].x*poly[j].y - poly[j].x*poly[i].y
+	}
+	return math.Abs(area) / 2
+}
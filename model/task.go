@@ -1,8 +1,10 @@
 package model
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strconv"
 
 	"github.com/wasabee-project/Wasabee-Server/log"
 	"github.com/wasabee-project/Wasabee-Server/messaging"
@@ -16,7 +18,7 @@ type UnspecifiedTask interface {
 	SetOrder(int16) error
 	GetOrder() int16
 	IsAssignedTo(GoogleID) bool
-	Acknowledge() error
+	Acknowledge(GoogleID) error
 }
 
 // TaskID is the basic type for a task identifier
@@ -33,19 +35,33 @@ type Task struct {
 	Zone         Zone       `json:"zone"`
 	DeltaMinutes int32      `json:"deltaminutes"`
 	Order        int16      `json:"order"`
+	Scheduled    string     `json:"scheduled,omitempty"` // time.RFC1123 format, computed from the op's ReferenceTime and DeltaMinutes
 }
 
-// AddDepend add a single task dependency
+// AddDepend add a single task dependency, the task must be in the same op and must not create a cycle
 func (t *Task) AddDepend(task TaskID) error {
-	_, err := db.Exec("INSERT INTO depends (opID, taskID, dependsOn) VALUES (?, ?, ?)", t.opID, t.ID, task)
+	// the graph is checked against what is committed, concurrent additions must not each miss the other's half of a cycle
+	lock, err := t.opID.lock(context.Background())
 	if err != nil {
-		log.Error(err)
 		return err
 	}
-	return nil
+	defer lock.unlock()
+
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT IGNORE INTO depends (opID, taskID, dependsOn) VALUES (?, ?, ?)", t.opID, t.ID, task); err != nil {
+			log.Error(err)
+			return err
+		}
+		if err := t.opID.validateDepends(tx); err != nil {
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		return nil
+	})
 }
 
-// SetDepends overwrites a task's dependencies, if tx is null, one is created
+// SetDepends overwrites a task's dependencies
+// the graph is checked by validateDepends once all the op's tasks are written
 func (t *Task) SetDepends(d []TaskID, tx *sql.Tx) error {
 	if len(d) < 1 {
 		return nil
@@ -57,7 +73,7 @@ func (t *Task) SetDepends(d []TaskID, tx *sql.Tx) error {
 	}
 
 	for _, depend := range d {
-		if _, err := tx.Exec("INSERT INTO depends (opID, taskID, dependsOn) VALUES (?, ?, ?)", t.opID, t.ID, depend); err != nil {
+		if _, err := tx.Exec("INSERT IGNORE INTO depends (opID, taskID, dependsOn) VALUES (?, ?, ?)", t.opID, t.ID, depend); err != nil {
 			log.Error(err)
 			return err
 		}
@@ -67,12 +83,14 @@ func (t *Task) SetDepends(d []TaskID, tx *sql.Tx) error {
 
 // DelDepend deletes all dependencies for a task
 func (t *Task) DelDepend(task TaskID) error {
-	_, err := db.Exec("DELETE FROM depends WHERE opID = ? AND taskID = ? AND dependsOn = ?", t.opID, t.ID, task)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM depends WHERE opID = ? AND taskID = ? AND dependsOn = ?", t.opID, t.ID, task); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		return nil
+	})
 }
 
 // dependsPrecache -- used to save queries in op.Populate
@@ -183,19 +201,33 @@ func (o OperationID) assignmentPrecache() (map[TaskID][]GoogleID, error) {
 	return buf, nil
 }
 
-// SetAssignments assigns a task to an agent using a given transaction, if the transaction is nil, one is created for this block
-func (t *Task) SetAssignments(gs []GoogleID, tx *sql.Tx) error {
-	needtx := false
+// SetAssignments assigns a task to agents using a given transaction, if the transaction is nil, one is created for this block
+// gid is the agent making the change, recorded in the task's history
+func (t *Task) SetAssignments(gid GoogleID, gs []GoogleID, tx *sql.Tx) error {
+	var added []GoogleID
+	var err error
 	if tx == nil {
-		needtx = true
-		tx, _ = db.Begin()
+		err = t.opID.changeTx(func(tx *sql.Tx) error {
+			added, err = t.assign(gid, gs, tx)
+			return err
+		})
+	} else {
+		added, err = t.assign(gid, gs, tx)
+	}
+	if err != nil {
+		return err
+	}
 
-		defer func() {
-			if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
-				log.Error(err)
-			}
-		}()
+	// Need an messaging.BuildAssignment / messaging.BulkSendAddignments pair to do this in one go
+	for _, a := range added {
+		messaging.SendAssignment(messaging.GoogleID(a), messaging.TaskID(t.ID), messaging.OperationID(t.opID), "assigned")
 	}
+	return nil
+}
+
+// assign does the work of SetAssignments without sending notifications, returning the newly assigned agents
+func (t *Task) assign(gid GoogleID, gs []GoogleID, tx *sql.Tx) ([]GoogleID, error) {
+	var added []GoogleID
 
 	b, err := t.GetAssignments(tx)
 	if err != nil {
@@ -203,61 +235,63 @@ func (t *Task) SetAssignments(gs []GoogleID, tx *sql.Tx) error {
 		// continue
 	}
 	before := make(map[GoogleID]bool)
-	for _, gid := range b {
-		before[gid] = true
+	for _, a := range b {
+		before[a] = true
 	}
+	changed := false
 
 	if len(gs) > 0 {
 		log.Debugw("setting assignments", "opID", t.opID, "taskID", t.ID, "gs", gs, "before", b)
 		deduped := make(map[GoogleID]bool)
-		for _, gid := range gs {
-			deduped[gid] = true
+		for _, a := range gs {
+			deduped[a] = true
 		}
 
-		for gid := range deduped {
-			if gid == "" {
+		for a := range deduped {
+			if a == "" {
 				continue
 			}
-			if _, ok := before[gid]; ok {
-				delete(before, gid)
-				log.Debugw("existing assignment", "gid", gid)
+			if _, ok := before[a]; ok {
+				delete(before, a)
+				log.Debugw("existing assignment", "gid", a)
 			} else {
-				log.Debugw("new assignment", "gid", gid)
-				_, err := tx.Exec("REPLACE INTO assignments (opID, taskID, gid) VALUES (?, ?, ?)", t.opID, t.ID, gid)
+				log.Debugw("new assignment", "gid", a)
+				_, err := tx.Exec("REPLACE INTO assignments (opID, taskID, gid) VALUES (?, ?, ?)", t.opID, t.ID, a)
 				if err != nil {
 					log.Error(err)
-					return err
+					return added, err
 				}
-				messaging.SendAssignment(messaging.GoogleID(gid), messaging.TaskID(t.ID), messaging.OperationID(t.opID), "assigned")
+				changed = true
+				added = append(added, a)
 			}
 		}
-		// Need an messaging.BuildAssignment / messaging.BulkSendAddignments pair to do this in one go
 
-		for gid := range before {
-			if gid == "" {
+		for a := range before {
+			if a == "" {
 				continue
 			}
-			log.Debugw("removing assignment", "gid", gid)
-			_, err := tx.Exec("DELETE FROM assignments WHERE opID = ? AND taskID = ? AND gid = ?", t.opID, t.ID, gid)
+			log.Debugw("removing assignment", "gid", a)
+			_, err := tx.Exec("DELETE FROM assignments WHERE opID = ? AND taskID = ? AND gid = ?", t.opID, t.ID, a)
 			if err != nil {
 				log.Error(err)
-				return err
+				return added, err
 			}
+			changed = true
 		}
 	}
 
 	if len(gs) == 0 && len(before) > 0 {
 		log.Debugw("clearing assignments", "opID", t.opID, "taskID", t.ID, "gs", gs, "before", b)
 		t.ClearAssignments(tx)
+		changed = true
 	}
 
-	if needtx {
-		if err := tx.Commit(); err != nil {
-			log.Error(err)
-			return err
-		}
+	// only log actual changes, uploads call this for every task
+	if changed {
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		t.logEvent(gid, taskEventAssign, joinAssignments(b), joinAssignments(gs), tx)
 	}
-	return nil
+	return added, nil
 }
 
 // ClearAssignments removes any assignments for this task from the database
@@ -289,94 +323,175 @@ func (t *Task) IsAssignedTo(gid GoogleID) bool {
 
 // Claim assignes a task to the calling agent
 func (t *Task) Claim(gid GoogleID) error {
-	if _, err := db.Exec("INSERT IGNORE INTO assignments (opID, taskID, gid) VALUES (?,?,?)", t.opID, t.ID, gid); err != nil {
-		log.Error(err)
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		old, _, _, err := t.current(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT IGNORE INTO assignments (opID, taskID, gid) VALUES (?,?,?)", t.opID, t.ID, gid); err != nil {
+			log.Error(err)
+			return err
+		}
+		if _, err := tx.Exec("UPDATE task SET state = 'acknowledged' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		t.logEvent(gid, taskEventClaim, old, "acknowledged", tx)
+		return nil
+	})
+}
+
+// Complete marks as task as completed by gid
+// tasks with incomplete dependencies are refused unless force is set
+func (t *Task) Complete(gid GoogleID, force bool) error {
+	incomplete, err := t.IncompleteDepends()
+	if err != nil {
 		return err
 	}
-	if _, err := db.Exec("UPDATE task SET state = 'acknowledged' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
-		log.Error(err)
-		return err
+	if len(incomplete) > 0 {
+		if !force {
+			err := errors.New(ErrDependsIncomplete)
+			log.Infow(err.Error(), "resource", t.opID, "task", t.ID, "incomplete", incomplete)
+			return err
+		}
+		log.Infow("completing task with incomplete dependencies", "resource", t.opID, "task", t.ID, "incomplete", incomplete)
 	}
-	return nil
-}
 
-// Complete marks as task as completed
-func (t *Task) Complete() error {
-	if _, err := db.Exec("UPDATE task SET state = 'completed' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
-		log.Error(err)
+	err = t.opID.changeTx(func(tx *sql.Tx) error {
+		old, _, _, err := t.current(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE task SET state = 'completed' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		t.logEvent(gid, taskEventComplete, old, "completed", tx)
+		return nil
+	})
+	if err != nil {
 		return err
 	}
+
+	t.notifyReady()
 	return nil
 }
 
 // Incomplete marks a task as not completed
-func (t *Task) Incomplete() error {
-	if _, err := db.Exec("UPDATE task SET state = 'assigned' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+func (t *Task) Incomplete(gid GoogleID) error {
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		old, _, _, err := t.current(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE task SET state = 'assigned' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		t.logEvent(gid, taskEventIncomplete, old, "assigned", tx)
+		return nil
+	})
 }
 
-// Acknowledge marks a task as acknowledged
-func (t *Task) Acknowledge() error {
-	if _, err := db.Exec("UPDATE task SET state = 'acknowledged' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+// Acknowledge marks a task as acknowledged by gid
+func (t *Task) Acknowledge(gid GoogleID) error {
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		old, _, _, err := t.current(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE task SET state = 'acknowledged' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		t.logEvent(gid, taskEventAcknowledge, old, "acknowledged", tx)
+		return nil
+	})
 }
 
 // Reject unassignes an agent from a task
 func (t *Task) Reject(gid GoogleID) error {
-	if _, err := db.Exec("UPDATE task SET state = 'pending' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
-		log.Error(err)
-		return err
-	}
-	if _, err := db.Exec("DELETE FROM assignments WHERE opID = ? AND taskID = ? AND gid = ?", t.opID, t.ID, gid); err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		old, _, _, err := t.current(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE task SET state = 'pending' WHERE ID = ? AND opID = ?", t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM assignments WHERE opID = ? AND taskID = ? AND gid = ?", t.opID, t.ID, gid); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		t.logEvent(gid, taskEventReject, old, "pending", tx)
+		return nil
+	})
 }
 
-// SetDelta sets the DeltaMinutes of a link in an operation
+// SetDelta sets the DeltaMinutes of a task in an operation
 func (t *Task) SetDelta(delta int) error {
-	_, err := db.Exec("UPDATE link SET delta = ? WHERE ID = ? and opID = ?", delta, t.ID, t.opID)
-	if err != nil {
-		log.Error(err)
-	}
-	return err
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE task SET delta = ? WHERE ID = ? and opID = ?", delta, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		return nil
+	})
 }
 
 // SetComment sets the comment on a task
-func (t *Task) SetComment(comment string) error {
+func (t *Task) SetComment(gid GoogleID, comment string) error {
 	desc := makeNullString(util.Sanitize(comment))
 
-	_, err := db.Exec("UPDATE task SET comment = ? WHERE ID = ? AND opID = ?", desc, t.ID, t.opID)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		_, old, _, err := t.current(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE task SET comment = ? WHERE ID = ? AND opID = ?", desc, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		t.logEvent(gid, taskEventComment, old, desc.String, tx)
+		return nil
+	})
 }
 
 // SetZone updates the task's zone
-func (t *Task) SetZone(z Zone) error {
-	if _, err := db.Exec("UPDATE task SET zone = ? WHERE ID = ? AND opID = ?", z, t.ID, t.opID); err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+func (t *Task) SetZone(gid GoogleID, z Zone) error {
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		_, _, old, err := t.current(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE task SET zone = ? WHERE ID = ? AND opID = ?", z, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		t.logEvent(gid, taskEventZone, strconv.Itoa(int(old)), strconv.Itoa(int(z)), tx)
+		return nil
+	})
 }
 
-// SetOrder updates the task'sorder
+// SetOrder updates the task's order
 func (t *Task) SetOrder(order int16) error {
-	if _, err := db.Exec("UPDATE task SET order = ? WHERE ID = ? AND opID = ?", order, t.ID, t.opID); err != nil {
-		log.Error(err)
-		return err
-	}
-	return nil
+	return t.opID.changeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE task SET taskorder = ? WHERE ID = ? AND opID = ?", order, t.ID, t.opID); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.opID.logChange(changeTask, string(t.ID), changeChange, tx)
+		return nil
+	})
 }
 
 // GetOrder returns a tasks order
@@ -398,6 +513,12 @@ func (o *Operation) GetTask(taskID TaskID) (*Task, error) {
 		}
 	}
 
+	for _, g := range o.Tasks {
+		if g.Task.ID == taskID {
+			return &g.Task, nil
+		}
+	}
+
 	return &Task{}, errors.New(ErrTaskNotFound)
 }
 
@@ -0,0 +1,200 @@
+package model
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// the kinds of task events
+const (
+	taskEventClaim       = "claim"
+	taskEventReject      = "reject"
+	taskEventAcknowledge = "acknowledge"
+	taskEventComplete    = "complete"
+	taskEventIncomplete  = "incomplete"
+	taskEventAssign      = "assign"
+	taskEventComment     = "comment"
+	taskEventZone        = "zone"
+	taskEventState       = "state" // state changed by an upload
+)
+
+// TaskEvent is a single recorded change to a task
+// Gid is the agent who made the change, Old and New depend on the event: the state for state changes, the assignees for assign, the comment or zone
+type TaskEvent struct {
+	Task    TaskID   `json:"task"`
+	Gid     GoogleID `json:"gid"`
+	Event   string   `json:"event"`
+	Old     string   `json:"old"`
+	New     string   `json:"new"`
+	Changed string   `json:"changed"`
+}
+
+// TaskTimeline is every recorded task event in an op, oldest first
+type TaskTimeline struct {
+	ID     OperationID `json:"ID"`
+	Events []TaskEvent `json:"events"`
+}
+
+// logEvent records a task event using a given transaction, if the transaction is nil the database is used directly
+// the history is informational, failures are logged and not returned so they never block the change itself
+func (t *Task) logEvent(gid GoogleID, event, oldvalue, newvalue string, tx *sql.Tx) {
+	q := "INSERT INTO taskevents (opID, taskID, gid, event, oldvalue, newvalue) VALUES (?, ?, ?, ?, ?, ?)"
+	var err error
+	if tx == nil {
+		_, err = db.Exec(q, t.opID, t.ID, gid, event, oldvalue, newvalue)
+	} else {
+		_, err = tx.Exec(q, t.opID, t.ID, gid, event, oldvalue, newvalue)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// current returns the state, comment and zone of the task as stored, for recording the old values of a change
+// the row is locked until tx ends so the change is recorded against what it replaced
+func (t *Task) current(tx *sql.Tx) (string, string, Zone, error) {
+	var state string
+	var comment sql.NullString
+	var zone Zone
+
+	err := tx.QueryRow("SELECT state, comment, zone FROM task WHERE ID = ? AND opID = ? FOR UPDATE", t.ID, t.opID).Scan(&state, &comment, &zone)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(err)
+		return "", "", zone, err
+	}
+	return state, comment.String, zone, nil
+}
+
+// joinAssignments formats a set of assignees for the history
+func joinAssignments(gs []GoogleID) string {
+	s := make([]string, 0, len(gs))
+	for _, gid := range gs {
+		if gid != "" {
+			s = append(s, string(gid))
+		}
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// History returns the recorded events for this task, oldest first
+func (t *Task) History() ([]TaskEvent, error) {
+	events := make([]TaskEvent, 0)
+
+	rows, err := db.Query("SELECT taskID, gid, event, oldvalue, newvalue, changed FROM taskevents WHERE opID = ? AND taskID = ? ORDER BY seq", t.opID, t.ID)
+	if err != nil {
+		log.Error(err)
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanTaskEvent(rows)
+		if err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// TaskTimeline returns the recorded events for every task in the op gid can see
+// events for tasks which have since been removed are only shown to agents who can see the whole op
+func (o *Operation) TaskTimeline(gid GoogleID) (*TaskTimeline, error) {
+	if err := o.Populate(gid); err != nil {
+		return nil, err
+	}
+	read, zones := o.ReadAccess(gid)
+	all := read && ZoneAll.inZones(zones)
+
+	visible := make(map[TaskID]bool)
+	for _, l := range o.Links {
+		visible[l.Task.ID] = true
+	}
+	for _, m := range o.Markers {
+		visible[m.Task.ID] = true
+	}
+	for _, g := range o.Tasks {
+		visible[g.Task.ID] = true
+	}
+
+	tl := TaskTimeline{
+		ID:     o.ID,
+		Events: make([]TaskEvent, 0),
+	}
+
+	rows, err := db.Query("SELECT taskID, gid, event, oldvalue, newvalue, changed FROM taskevents WHERE opID = ? ORDER BY seq", o.ID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanTaskEvent(rows)
+		if err != nil {
+			continue
+		}
+		// agents who see the whole op see every task, including those since removed
+		if !all && !visible[e.Task] {
+			continue
+		}
+		tl.Events = append(tl.Events, e)
+	}
+	return &tl, nil
+}
+
+func scanTaskEvent(rows *sql.Rows) (TaskEvent, error) {
+	var e TaskEvent
+	var oldvalue, newvalue sql.NullString
+	var changed string
+
+	if err := rows.Scan(&e.Task, &e.Gid, &e.Event, &oldvalue, &newvalue, &changed); err != nil {
+		log.Error(err)
+		return e, err
+	}
+	e.Old = oldvalue.String
+	e.New = newvalue.String
+	// convert from SQL to RFC1123
+	ts, err := time.ParseInLocation("2006-01-02 15:04:05", changed, time.UTC)
+	if err != nil {
+		log.Error(err)
+		return e, err
+	}
+	e.Changed = ts.Format(time.RFC1123)
+	return e, nil
+}
+
+// logUpload records the state, comment and zone changes an upload is about to make to an existing task
+// call before the task row is written, comment is the sanitized comment being stored
+func (t *Task) logUpload(gid GoogleID, comment string, tx *sql.Tx) error {
+	var state string
+	var old sql.NullString
+	var zone Zone
+
+	err := tx.QueryRow("SELECT state, comment, zone FROM task WHERE ID = ? AND opID = ?", t.ID, t.opID).Scan(&state, &old, &zone)
+	if err == sql.ErrNoRows {
+		// new task, the assignments are all that is interesting
+		return nil
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if state != t.State {
+		t.logEvent(gid, taskEventState, state, t.State, tx)
+	}
+	if old.String != comment {
+		t.logEvent(gid, taskEventComment, old.String, comment, tx)
+	}
+	if zone != t.Zone {
+		t.logEvent(gid, taskEventZone, strconv.Itoa(int(zone)), strconv.Itoa(int(t.Zone)), tx)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/wasabee-project/Wasabee-Server/log"
+)
+
+// TrashedOp is an operation which has been deleted but not yet purged
+type TrashedOp struct {
+	ID         OperationID `json:"ID"`
+	Name       string      `json:"name"`
+	Color      string      `json:"color"`
+	Modified   string      `json:"modified"`
+	DeleteDate string      `json:"deletedate"`
+	Purge      string      `json:"purge"` // when the op will be permanently removed
+}
+
+// Trash lists the deleted but not yet purged ops owned by an agent
+func (gid GoogleID) Trash(retentionDays int) ([]TrashedOp, error) {
+	trash := make([]TrashedOp, 0)
+
+	rows, err := db.Query("SELECT operation.ID, operation.name, operation.color, operation.modified, deletedops.deletedate, DATE_ADD(deletedops.deletedate, INTERVAL ? DAY) FROM operation JOIN deletedops ON operation.ID = deletedops.opID WHERE operation.gid = ? ORDER BY deletedops.deletedate DESC", retentionDays, gid)
+	if err != nil {
+		log.Error(err)
+		return trash, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t TrashedOp
+		if err := rows.Scan(&t.ID, &t.Name, &t.Color, &t.Modified, &t.DeleteDate, &t.Purge); err != nil {
+			log.Error(err)
+			continue
+		}
+		trash = append(trash, t)
+	}
+	return trash, nil
+}
+
+// Undelete restores an op from the trash, only the owner may do this
+func (opID OperationID) Undelete(gid GoogleID) error {
+	if !opID.IsOwner(gid) {
+		err := errors.New(ErrNotOpOwner)
+		log.Warnw(err.Error(), "GID", gid, "resource", opID)
+		return err
+	}
+
+	r, err := db.Exec("DELETE FROM deletedops WHERE opID = ?", opID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		err := errors.New(ErrOpNotInTrash)
+		log.Infow(err.Error(), "GID", gid, "resource", opID)
+		return err
+	}
+	log.Infow("restored operation from trash", "GID", gid, "resource", opID)
+	return nil
+}
+
+// PurgeTrash permanently removes ops which have been in the trash longer than the retention period
+// the tombstones are kept so the IDs cannot be reused
+func PurgeTrash(retentionDays int) {
+	rows, err := db.Query("SELECT deletedops.opID FROM deletedops JOIN operation ON deletedops.opID = operation.ID WHERE deletedops.deletedate < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? DAY)", retentionDays)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer rows.Close()
+
+	var expired []OperationID
+	for rows.Next() {
+		var opID OperationID
+		if err := rows.Scan(&opID); err != nil {
+			log.Error(err)
+			continue
+		}
+		expired = append(expired, opID)
+	}
+
+	for _, opID := range expired {
+		if err := opID.purge(); err != nil {
+			continue
+		}
+		log.Infow("purged operation from trash", "resource", opID)
+	}
+}
@@ -0,0 +1,225 @@
+package model
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/wasabee-project/Wasabee-Server/util"
+)
+
+// reasons a link is reported by Validate
+const (
+	CrossesEarlierLink = "crosses a link thrown earlier"
+	CrossesSameOrder   = "crosses a link with the same throw order"
+	CrossesBlocker     = "crosses a blocker"
+	OutboundLimit      = "exceeds the outbound link limit of the source portal"
+	DependsNotDone     = "depends on a task which is not completed before it"
+	KeyNotHeld         = "assignee does not hold a key for the destination"
+)
+
+// OpValidation is the result of checking an op's links against each other and against its blockers
+type OpValidation struct {
+	ID         OperationID    `json:"ID"`
+	LastEditID string         `json:"lasteditid"`
+	Valid      bool           `json:"valid"`
+	Crossings  []LinkCrossing `json:"crossings"`
+	Throws     []ThrowProblem `json:"throws"`
+	Unchecked  []LinkID       `json:"unchecked"` // links or blockers on portals without a usable location
+}
+
+// LinkCrossing is a planned link which cannot be thrown as planned
+// Crosses is set for planned links which are in the way, Blocker for known enemy links
+type LinkCrossing struct {
+	Link    LinkID   `json:"link"`
+	Crosses LinkID   `json:"crosses,omitempty"`
+	Blocker *Blocker `json:"blocker,omitempty"`
+	Reason  string   `json:"reason"`
+}
+
+// ThrowProblem is a planned link which cannot be thrown at its step in the throw order
+// Portal is the source portal for outbound problems and the destination for key problems
+type ThrowProblem struct {
+	Link   LinkID   `json:"link"`
+	Agent  GoogleID `json:"gid,omitempty"`
+	Portal PortalID `json:"portalId,omitempty"`
+	Task   TaskID   `json:"task,omitempty"`
+	Reason string   `json:"reason"`
+}
+
+// Validate checks the links visible to gid for crossings, using geodesic (great-circle) links, and for throw-order problems
+// when two planned links cross, the one thrown later is reported
+func (o *Operation) Validate(gid GoogleID) (*OpValidation, error) {
+	if err := o.Populate(gid); err != nil {
+		return nil, err
+	}
+
+	v := OpValidation{
+		ID:         o.ID,
+		LastEditID: o.LastEditID,
+		Crossings:  make([]LinkCrossing, 0),
+		Unchecked:  make([]LinkID, 0),
+	}
+
+	locs := make(map[PortalID]util.LatLon)
+	for _, p := range o.OpPortals {
+		lat, err := strconv.ParseFloat(p.Lat, 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(p.Lon, 64)
+		if err != nil {
+			continue
+		}
+		locs[p.ID] = util.LatLon{Lat: lat, Lon: lon}
+	}
+
+	type segment struct {
+		from, to PortalID
+		a, b     util.LatLon
+	}
+	seg := func(from, to PortalID) (segment, bool) {
+		a, ok := locs[from]
+		if !ok {
+			return segment{}, false
+		}
+		b, ok := locs[to]
+		if !ok {
+			return segment{}, false
+		}
+		return segment{from: from, to: to, a: a, b: b}, true
+	}
+	crosses := func(x, y segment) bool {
+		// links which share a portal never cross
+		if x.from == y.from || x.from == y.to || x.to == y.from || x.to == y.to {
+			return false
+		}
+		return util.ArcsCross(x.a, x.b, y.a, y.b)
+	}
+
+	var links []Link
+	var segs []segment
+	for _, l := range o.Links {
+		s, ok := seg(l.From, l.To)
+		if !ok {
+			v.Unchecked = append(v.Unchecked, l.ID)
+			continue
+		}
+		links = append(links, l)
+		segs = append(segs, s)
+	}
+
+	for i := range links {
+		for j := i + 1; j < len(links); j++ {
+			if !crosses(segs[i], segs[j]) {
+				continue
+			}
+
+			c := LinkCrossing{Link: links[i].ID, Crosses: links[j].ID, Reason: CrossesSameOrder}
+			switch {
+			case links[i].Order > links[j].Order:
+				c.Reason = CrossesEarlierLink
+			case links[i].Order < links[j].Order:
+				c.Link, c.Crosses = links[j].ID, links[i].ID
+				c.Reason = CrossesEarlierLink
+			}
+			v.Crossings = append(v.Crossings, c)
+		}
+	}
+
+	for bi := range o.Blockers {
+		b := o.Blockers[bi]
+		bs, ok := seg(b.From, b.To)
+		if !ok {
+			v.Unchecked = append(v.Unchecked, LinkID(b.ID))
+			continue
+		}
+		for i := range links {
+			if crosses(segs[i], bs) {
+				v.Crossings = append(v.Crossings, LinkCrossing{Link: links[i].ID, Blocker: &b, Reason: CrossesBlocker})
+			}
+		}
+	}
+
+	v.Throws = o.checkThrows()
+	v.Valid = len(v.Crossings) == 0 && len(v.Throws) == 0
+	return &v, nil
+}
+
+// checkThrows walks the links in throw order checking outbound limits, dependencies and the assignees' keys
+// completed links still use an outbound slot but need nothing else
+func (o *Operation) checkThrows() []ThrowProblem {
+	problems := make([]ThrowProblem, 0)
+
+	portals := make(map[PortalID]Portal)
+	for _, p := range o.OpPortals {
+		portals[p.ID] = p
+	}
+
+	type taskState struct {
+		order int16
+		state string
+	}
+	tasks := make(map[TaskID]taskState)
+	for _, l := range o.Links {
+		tasks[l.Task.ID] = taskState{l.Order, l.State}
+	}
+	for _, m := range o.Markers {
+		tasks[m.Task.ID] = taskState{m.Order, m.State}
+	}
+	for _, g := range o.Tasks {
+		tasks[g.Task.ID] = taskState{g.Order, g.State}
+	}
+
+	held := make(map[GoogleID]map[PortalID]int32)
+	for _, k := range o.Keys {
+		if _, ok := held[k.Gid]; !ok {
+			held[k.Gid] = make(map[PortalID]int32)
+		}
+		held[k.Gid][k.ID] += k.Onhand
+	}
+
+	links := make([]Link, len(o.Links))
+	copy(links, o.Links)
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Order < links[j].Order
+	})
+
+	outbound := make(map[PortalID]int)
+	used := make(map[GoogleID]map[PortalID]int32)
+	for _, l := range links {
+		outbound[l.From]++
+		limit := outboundLinks
+		if p, ok := portals[l.From]; ok {
+			limit = p.outboundLimit()
+		}
+		if outbound[l.From] > limit {
+			problems = append(problems, ThrowProblem{Link: l.ID, Portal: l.From, Reason: OutboundLimit})
+		}
+
+		if l.State == "completed" {
+			continue
+		}
+
+		for _, d := range l.DependsOn {
+			t, ok := tasks[d]
+			if !ok {
+				// not visible to this agent, or already removed
+				continue
+			}
+			if t.state != "completed" && t.order >= l.Order {
+				problems = append(problems, ThrowProblem{Link: l.ID, Task: d, Reason: DependsNotDone})
+			}
+		}
+
+		for _, a := range l.Assignments {
+			if _, ok := used[a]; !ok {
+				used[a] = make(map[PortalID]int32)
+			}
+			used[a][l.To]++
+			if used[a][l.To] > held[a][l.To] {
+				problems = append(problems, ThrowProblem{Link: l.ID, Agent: a, Portal: l.To, Reason: KeyNotHeld})
+			}
+		}
+	}
+	return problems
+}
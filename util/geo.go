@@ -0,0 +1,78 @@
+package util
+
+import (
+	"math"
+)
+
+// EarthRadius is the mean radius of the earth in meters
+const EarthRadius = 6371008.8
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// Distance returns the great-circle distance in meters between two points using the haversine formula
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	dlat := radians(lat2 - lat1)
+	dlon := radians(lon2 - lon1)
+
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(radians(lat1))*math.Cos(radians(lat2))*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return EarthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// BoundingBox returns a lat/lon box which contains every point within radius meters of the given point
+// it does not handle crossing the poles or the antimeridian, which Ingress does not need
+func BoundingBox(lat, lon, radius float64) (minLat, minLon, maxLat, maxLon float64) {
+	dlat := radius / EarthRadius * 180 / math.Pi
+	dlon := dlat
+	if c := math.Cos(radians(lat)); c > 0.000001 {
+		dlon = dlat / c
+	}
+	return lat - dlat, lon - dlon, lat + dlat, lon + dlon
+}
+
+// LatLon is a point on the earth's surface, in degrees
+type LatLon struct {
+	Lat float64
+	Lon float64
+}
+
+type vector [3]float64
+
+// unit vector from the center of the earth through the point
+func (p LatLon) vector() vector {
+	lat, lon := radians(p.Lat), radians(p.Lon)
+	return vector{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+}
+
+func (a vector) cross(b vector) vector {
+	return vector{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func (a vector) dot(b vector) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+// onArc reports if p, a point on the great circle with normal n, lies strictly between s and e
+func onArc(s, e, n, p vector) bool {
+	return s.cross(p).dot(n) > 0 && p.cross(e).dot(n) > 0
+}
+
+// ArcsCross reports whether the great-circle arcs a0-a1 and b0-b1 cross each other
+// arcs which only touch, such as those sharing an endpoint, do not cross
+func ArcsCross(a0, a1, b0, b1 LatLon) bool {
+	va0, va1, vb0, vb1 := a0.vector(), a1.vector(), b0.vector(), b1.vector()
+	na, nb := va0.cross(va1), vb0.cross(vb1)
+
+	// each arc's endpoints must be on opposite sides of the other's great circle
+	if na.dot(vb0)*na.dot(vb1) >= 0 || nb.dot(va0)*nb.dot(va1) >= 0 {
+		return false
+	}
+
+	// the great circles meet at two antipodal points, both arcs must contain the same one
+	p := na.cross(nb)
+	if !onArc(va0, va1, na, p) {
+		p = vector{-p[0], -p[1], -p[2]}
+	}
+	return onArc(va0, va1, na, p) && onArc(vb0, vb1, nb, p)
+}
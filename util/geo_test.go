@@ -0,0 +1,64 @@
+package util
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	if d := Distance(51.5, -0.1, 51.5, -0.1); d != 0 {
+		t.Errorf("distance to self is %f", d)
+	}
+
+	// one degree of latitude is about 111.2 km
+	if d := Distance(0, 0, 1, 0); math.Abs(d-111195) > 10 {
+		t.Errorf("one degree of latitude is %f meters", d)
+	}
+
+	// London to Paris is about 343.5 km
+	if d := Distance(51.5074, -0.1278, 48.8566, 2.3522); math.Abs(d-343500) > 1000 {
+		t.Errorf("London to Paris is %f meters", d)
+	}
+
+	if Distance(10, 20, 30, 40) != Distance(30, 40, 10, 20) {
+		t.Error("distance is not symmetric")
+	}
+}
+
+func TestBoundingBox(t *testing.T) {
+	lat, lon, radius := 45.0, 7.0, 1000.0
+	minLat, minLon, maxLat, maxLon := BoundingBox(lat, lon, radius)
+
+	for _, p := range [][2]float64{{minLat, lon}, {maxLat, lon}, {lat, minLon}, {lat, maxLon}} {
+		if d := Distance(lat, lon, p[0], p[1]); d < radius-1 {
+			t.Errorf("box edge %v is only %f meters away", p, d)
+		}
+	}
+}
+
+func TestArcsCross(t *testing.T) {
+	tests := []struct {
+		name   string
+		a0, a1 LatLon
+		b0, b1 LatLon
+		cross  bool
+	}{
+		{"x", LatLon{0, 0}, LatLon{1, 1}, LatLon{0, 1}, LatLon{1, 0}, true},
+		{"parallel", LatLon{0, 0}, LatLon{0, 1}, LatLon{1, 0}, LatLon{1, 1}, false},
+		{"shared endpoint", LatLon{0, 0}, LatLon{1, 1}, LatLon{1, 1}, LatLon{2, 0}, false},
+		{"same link", LatLon{0, 0}, LatLon{1, 1}, LatLon{0, 0}, LatLon{1, 1}, false},
+		{"short of each other", LatLon{0, 0}, LatLon{1, 1}, LatLon{2, 3}, LatLon{3, 2}, false},
+		{"t junction", LatLon{0, 0}, LatLon{0, 2}, LatLon{0, 1}, LatLon{1, 1}, false},
+		// the great circles meet on the far side of the earth, the arcs do not
+		{"antipodal", LatLon{0, 0}, LatLon{1, 1}, LatLon{0, 180}, LatLon{1, 179}, false},
+	}
+
+	for _, tt := range tests {
+		if got := ArcsCross(tt.a0, tt.a1, tt.b0, tt.b1); got != tt.cross {
+			t.Errorf("%s: ArcsCross %v, want %v", tt.name, got, tt.cross)
+		}
+		if got := ArcsCross(tt.b0, tt.b1, tt.a0, tt.a1); got != tt.cross {
+			t.Errorf("%s reversed: ArcsCross %v, want %v", tt.name, got, tt.cross)
+		}
+	}
+}